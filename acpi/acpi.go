@@ -0,0 +1,245 @@
+package acpi
+
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/mem"
+)
+
+const (
+	maxTables  = 32
+	headerSize = 36
+
+	rsdpV1Size = 20
+	rsdpV2Size = 36
+
+	ebdaSegPtr    = 0x40E
+	biosAreaStart = 0xE0000
+	biosAreaEnd   = 0x100000
+)
+
+// tableInfo describes one validated ACPI table
+type tableInfo struct {
+	addr     uintptr
+	sig      [4]byte
+	length   uint32
+	revision uint8
+	oem      [6]byte
+}
+
+var (
+	ready       bool
+	rsdpAddr    uintptr
+	rsdpRev     uint8
+	tables      [maxTables]tableInfo
+	tableCount  int
+	badChecksum int
+)
+
+func readU8(addr uintptr) uint8 {
+	return *(*uint8)(unsafe.Pointer(addr))
+}
+
+func readU16(addr uintptr) uint16 {
+	return *(*uint16)(unsafe.Pointer(addr))
+}
+
+func readU32(addr uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(addr))
+}
+
+func readU64(addr uintptr) uint64 {
+	// ACPI tables do not guarantee natural alignment
+	return uint64(readU32(addr)) | uint64(readU32(addr+4))<<32
+}
+
+// physBase is where physical memory is mapped. Tests lay the tables out
+// in ordinary memory and set it to 0.
+var physBase uintptr = mem.DirectMapBase
+
+// phys turns a physical address found in a table into a pointer we can
+// dereference through the direct map.
+func phys(addr uint64) uintptr {
+	return uintptr(addr) + physBase
+}
+
+// checksum returns true when the n bytes at addr sum to zero (mod 256)
+func checksum(addr uintptr, n uint32) bool {
+	var sum uint8
+	for i := uint32(0); i < n; i++ {
+		sum += readU8(addr + uintptr(i))
+	}
+	return sum == 0
+}
+
+func sigEquals(addr uintptr, sig string) bool {
+	for i := 0; i < len(sig); i++ {
+		if readU8(addr+uintptr(i)) != sig[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// validRSDP checks signature and checksums of an RSDP candidate
+func validRSDP(addr uintptr) bool {
+	if !sigEquals(addr, "RSD PTR ") {
+		return false
+	}
+	if !checksum(addr, rsdpV1Size) {
+		return false
+	}
+	if readU8(addr+15) >= 2 {
+		length := readU32(addr + 20)
+		if length < rsdpV2Size || !checksum(addr, length) {
+			return false
+		}
+	}
+	return true
+}
+
+func scanRSDP(start, end uintptr) uintptr {
+	for p := start; p+rsdpV1Size <= end; p += 16 {
+		if validRSDP(p) {
+			return p
+		}
+	}
+	return 0
+}
+
+// findRSDP looks in the EBDA first kilobyte, then in the BIOS ROM area
+func findRSDP() uintptr {
+	ebda := uintptr(readU16(phys(ebdaSegPtr))) << 4
+	if ebda != 0 {
+		if p := scanRSDP(phys(uint64(ebda)), phys(uint64(ebda))+1024); p != 0 {
+			return p
+		}
+	}
+	return scanRSDP(phys(biosAreaStart), phys(biosAreaEnd))
+}
+
+// addTable validates an SDT and records it in the table list
+func addTable(addr uintptr) bool {
+	if addr == 0 || tableCount >= maxTables {
+		return false
+	}
+	length := readU32(addr + 4)
+	if length < headerSize {
+		return false
+	}
+	if !checksum(addr, length) {
+		badChecksum++
+		return false
+	}
+
+	t := &tables[tableCount]
+	t.addr = addr
+	for i := 0; i < 4; i++ {
+		t.sig[i] = readU8(addr + uintptr(i))
+	}
+	t.length = length
+	t.revision = readU8(addr + 8)
+	for i := 0; i < 6; i++ {
+		t.oem[i] = readU8(addr + 10 + uintptr(i))
+	}
+	tableCount++
+	return true
+}
+
+// Init locates and validates the ACPI tables. rsdp is the address of an
+// RSDP copy handed over by the bootloader, or 0 to scan the BIOS areas.
+func Init(rsdp uintptr) bool {
+	ready = false
+	tableCount = 0
+	badChecksum = 0
+	madt = madtInfo{}
+	fadt = FADT{}
+	hpet = HPETInfo{}
+
+	if rsdp == 0 || !validRSDP(rsdp) {
+		rsdp = findRSDP()
+	}
+	if rsdp == 0 {
+		return false
+	}
+	rsdpAddr = rsdp
+	rsdpRev = readU8(rsdp + 15)
+
+	// Prefer the XSDT (64-bit pointers) when the firmware provides one
+	var root uintptr
+	entrySize := uintptr(4)
+	if rsdpRev >= 2 {
+		if x := readU64(rsdp + 24); x != 0 {
+			root = phys(x)
+			entrySize = 8
+		}
+	}
+	if root == 0 {
+		root = phys(uint64(readU32(rsdp + 16)))
+	}
+	if !addTable(root) {
+		return false
+	}
+
+	length := readU32(root + 4)
+	for p := root + headerSize; p+entrySize <= root+uintptr(length); p += entrySize {
+		var addr uint64
+		if entrySize == 8 {
+			addr = readU64(p)
+		} else {
+			addr = uint64(readU32(p))
+		}
+		addTable(phys(addr))
+	}
+
+	if t := FindTable("FACP"); t != 0 {
+		parseFADT(t)
+		// The DSDT is only referenced from the FADT, not the RSDT/XSDT
+		if fadt.DSDT != 0 {
+			addTable(phys(fadt.DSDT))
+		}
+	}
+	if t := FindTable("APIC"); t != 0 {
+		parseMADT(t)
+	}
+	if t := FindTable("HPET"); t != 0 {
+		parseHPET(t)
+	}
+
+	ready = true
+	return true
+}
+
+func Ready() bool { return ready }
+
+// RSDPRevision returns 0 for ACPI 1.0, 2 for ACPI 2.0+
+func RSDPRevision() uint8 { return rsdpRev }
+
+// FindTable returns the address of the first valid table with the given
+// 4-byte signature, or 0.
+func FindTable(sig string) uintptr {
+	if len(sig) != 4 {
+		return 0
+	}
+	for i := 0; i < tableCount; i++ {
+		t := &tables[i]
+		if t.sig[0] == sig[0] && t.sig[1] == sig[1] && t.sig[2] == sig[2] && t.sig[3] == sig[3] {
+			return t.addr
+		}
+	}
+	return 0
+}
+
+func TableCount() int { return tableCount }
+
+// BadChecksumCount returns how many referenced tables were rejected
+func BadChecksumCount() int { return badChecksum }
+
+// Table returns metadata for the i-th valid table
+func Table(i int) (sig *[4]byte, addr uintptr, length uint32, revision uint8, oem *[6]byte) {
+	if i < 0 || i >= tableCount {
+		return nil, 0, 0, 0, nil
+	}
+	t := &tables[i]
+	return &t.sig, t.addr, t.length, t.revision, &t.oem
+}
@@ -0,0 +1,244 @@
+package acpi
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// fakeFirmware lays out ACPI tables inside a single Go buffer so the parser
+// can walk real pointers, like it does with physical memory in the kernel.
+type fakeFirmware struct {
+	buf [4096]byte
+	off int
+}
+
+func (f *fakeFirmware) addr(off int) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&f.buf[off])))
+}
+
+func (f *fakeFirmware) put8(off int, v uint8) { f.buf[off] = v }
+
+func (f *fakeFirmware) put16(off int, v uint16) {
+	f.buf[off] = byte(v)
+	f.buf[off+1] = byte(v >> 8)
+}
+
+func (f *fakeFirmware) put32(off int, v uint32) {
+	for i := 0; i < 4; i++ {
+		f.buf[off+i] = byte(v >> (8 * i))
+	}
+}
+
+func (f *fakeFirmware) put64(off int, v uint64) {
+	f.put32(off, uint32(v))
+	f.put32(off+4, uint32(v>>32))
+}
+
+func (f *fakeFirmware) putString(off int, s string) {
+	for i := 0; i < len(s); i++ {
+		f.buf[off+i] = s[i]
+	}
+}
+
+// fixChecksum makes bytes [off, off+n) sum to zero using the byte at sumOff
+func (f *fakeFirmware) fixChecksum(off, n, sumOff int) {
+	f.buf[sumOff] = 0
+	var sum uint8
+	for i := 0; i < n; i++ {
+		sum += f.buf[off+i]
+	}
+	f.buf[sumOff] = -sum
+}
+
+// table starts a new SDT with the given signature and length, 16-aligned
+func (f *fakeFirmware) table(sig string, length int) int {
+	off := (f.off + 15) &^ 15
+	f.putString(off, sig)
+	f.put32(off+4, uint32(length))
+	f.put8(off+8, 2)
+	f.putString(off+10, "DAVOS ")
+	f.off = off + length
+	return off
+}
+
+func buildFirmware() *fakeFirmware {
+	physBase = 0 // table addresses are plain pointers into f.buf
+	f := &fakeFirmware{}
+
+	// RSDP (ACPI 2.0) at offset 0
+	f.putString(0, "RSD PTR ")
+	f.putString(9, "DAVOS ")
+	f.put8(15, 2)
+	f.put32(20, rsdpV2Size)
+	f.off = rsdpV2Size
+
+	// MADT: 2 CPUs (one disabled but online capable), 1 IOAPIC, 1 override,
+	// NMI on LINT0
+	madtLen := madtEntriesOffset + 8 + 8 + 12 + 10 + 6
+	m := f.table("APIC", madtLen)
+	f.put32(m+36, 0xFEE00000)
+	f.put32(m+40, madtFlagPCATCompat)
+	p := m + madtEntriesOffset
+	f.put8(p, madtTypeLAPIC)
+	f.put8(p+1, 8)
+	f.put8(p+2, 0)
+	f.put8(p+3, 0)
+	f.put32(p+4, lapicFlagEnabled)
+	p += 8
+	f.put8(p, madtTypeLAPIC)
+	f.put8(p+1, 8)
+	f.put8(p+2, 1)
+	f.put8(p+3, 3)
+	f.put32(p+4, lapicFlagOnlineCap)
+	p += 8
+	f.put8(p, madtTypeIOAPIC)
+	f.put8(p+1, 12)
+	f.put8(p+2, 7)
+	f.put32(p+4, 0xFEC00000)
+	f.put32(p+8, 0)
+	p += 12
+	f.put8(p, madtTypeOverride)
+	f.put8(p+1, 10)
+	f.put8(p+2, 0)
+	f.put8(p+3, 0)
+	f.put32(p+4, 2)
+	f.put16(p+8, 0)
+	p += 10
+	f.put8(p, madtTypeLAPICNMI)
+	f.put8(p+1, 6)
+	f.put8(p+2, 0xFF)
+	f.put16(p+3, 0)
+	f.put8(p+5, 0)
+	f.fixChecksum(m, madtLen, m+9)
+
+	// FADT with a reset register
+	fadtLen := 148
+	fa := f.table("FACP", fadtLen)
+	f.put32(fa+64, 0x604)
+	f.put8(fa+89, 2)
+	f.put32(fa+112, fadtFlagResetReg)
+	f.put8(fa+116, addrSpaceIO)
+	f.put8(fa+117, 8)
+	f.put64(fa+120, 0xCF9)
+	f.put8(fa+128, 0x06)
+	f.fixChecksum(fa, fadtLen, fa+9)
+
+	// HPET
+	hpetLen := 56
+	h := f.table("HPET", hpetLen)
+	f.put8(h+40, addrSpaceMemory)
+	f.put64(h+44, 0xFED00000)
+	f.put16(h+53, 128)
+	f.fixChecksum(h, hpetLen, h+9)
+
+	// XSDT pointing at the three tables
+	xsdtLen := headerSize + 3*8
+	x := f.table("XSDT", xsdtLen)
+	f.put64(x+headerSize, f.addr(m))
+	f.put64(x+headerSize+8, f.addr(fa))
+	f.put64(x+headerSize+16, f.addr(h))
+	f.fixChecksum(x, xsdtLen, x+9)
+
+	f.put64(24, f.addr(x))
+	f.fixChecksum(0, rsdpV1Size, 8)
+	f.fixChecksum(0, rsdpV2Size, 32)
+	return f
+}
+
+func TestValidRSDP(t *testing.T) {
+	f := buildFirmware()
+	if !validRSDP(uintptr(f.addr(0))) {
+		t.Fatalf("valid RSDP rejected")
+	}
+
+	f.buf[9] ^= 0xFF // corrupt the OEM ID without fixing the checksum
+	if validRSDP(uintptr(f.addr(0))) {
+		t.Errorf("RSDP with bad checksum accepted")
+	}
+}
+
+func TestInitParsesTables(t *testing.T) {
+	f := buildFirmware()
+	if !Init(uintptr(f.addr(0))) {
+		t.Fatalf("Init failed")
+	}
+
+	if TableCount() != 4 {
+		t.Errorf("Expected 4 tables (XSDT, APIC, FACP, HPET), got %d", TableCount())
+	}
+	if RSDPRevision() != 2 {
+		t.Errorf("Expected RSDP revision 2, got %d", RSDPRevision())
+	}
+
+	if CPUCount() != 2 {
+		t.Fatalf("Expected 2 CPUs, got %d", CPUCount())
+	}
+	if c := CPUEntry(1); c.APICID != 3 || c.Enabled {
+		t.Errorf("Unexpected second CPU entry: %+v", c)
+	}
+	if IOAPICCount() != 1 || IOAPICEntry(0).Address != 0xFEC00000 || IOAPICEntry(0).ID != 7 {
+		t.Errorf("Unexpected IOAPIC entry: %+v", IOAPICEntry(0))
+	}
+	if OverrideCount() != 1 || OverrideEntry(0).GSI != 2 {
+		t.Errorf("Expected IRQ0 -> GSI2 override, got %+v", OverrideEntry(0))
+	}
+	if !HasLegacyPICs() {
+		t.Errorf("PCAT_COMPAT flag not reported")
+	}
+	if NMILINT() != 0 {
+		t.Errorf("Expected NMI on LINT0, got LINT%d", NMILINT())
+	}
+
+	fa := FADTInfo()
+	if !fa.Present || fa.PM1aControl != 0x604 || fa.ResetReg.Address != 0xCF9 || fa.ResetValue != 6 {
+		t.Errorf("Unexpected FADT: %+v", fa)
+	}
+
+	h := HPET()
+	if !h.Present || h.Address != 0xFED00000 || h.MinTick != 128 {
+		t.Errorf("Unexpected HPET: %+v", h)
+	}
+}
+
+func TestBadTableChecksumIsSkipped(t *testing.T) {
+	f := buildFirmware()
+	Init(uintptr(f.addr(0)))
+	h := FindTable("HPET")
+	if h == 0 {
+		t.Fatalf("HPET not found in the intact tables")
+	}
+	*(*byte)(unsafe.Pointer(h + 50)) ^= 0xFF // corrupt the base address
+
+	if !Init(uintptr(f.addr(0))) {
+		t.Fatalf("Init failed")
+	}
+	if HPET().Present {
+		t.Errorf("HPET with bad checksum was parsed")
+	}
+	if BadChecksumCount() != 1 {
+		t.Errorf("Expected 1 bad checksum, got %d", BadChecksumCount())
+	}
+}
+
+func TestS5SleepTypes(t *testing.T) {
+	f := &fakeFirmware{}
+	// Name (\_S5_, Package (0x04) { 0x05, Zero, Zero, Zero })
+	aml := []byte{0x10, 0x0A, 0x08, '\\', '_', 'S', '5', '_', 0x12, 0x08, 0x04, 0x0A, 0x05, 0x00, 0x00, 0x00}
+	d := f.table("DSDT", headerSize+len(aml))
+	for i, b := range aml {
+		f.put8(d+headerSize+i, b)
+	}
+
+	a, b, ok := s5SleepTypes(uintptr(f.addr(d)))
+	if !ok {
+		t.Fatalf("_S5_ object not found")
+	}
+	if a != 5 || b != 0 {
+		t.Errorf("Expected SLP_TYPa=5 SLP_TYPb=0, got %d %d", a, b)
+	}
+
+	f.put8(d+headerSize+2, 0x00) // no longer a NameOp
+	if _, _, ok := s5SleepTypes(uintptr(f.addr(d))); ok {
+		t.Errorf("_S5_ without NameOp accepted")
+	}
+}
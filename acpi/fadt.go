@@ -0,0 +1,116 @@
+package acpi
+
+const (
+	addrSpaceMemory = 0
+	addrSpaceIO     = 1
+
+	fadtFlagResetReg = 1 << 10
+)
+
+// GenericAddress is an ACPI Generic Address Structure (GAS)
+type GenericAddress struct {
+	Space      uint8
+	BitWidth   uint8
+	BitOffset  uint8
+	AccessSize uint8
+	Address    uint64
+}
+
+// FADT holds the Fixed ACPI Description Table fields the kernel uses
+type FADT struct {
+	Present bool
+
+	DSDT         uint64
+	SCIInterrupt uint16
+	SMICommand   uint32
+	ACPIEnable   uint8
+	ACPIDisable  uint8
+
+	PM1aEvent   uint32
+	PM1bEvent   uint32
+	PM1aControl uint32
+	PM1bControl uint32
+	PMTimer     uint32
+	PM1EventLen uint8
+	PM1CtrlLen  uint8
+	Century     uint8 // CMOS index of the RTC century register, 0 if none
+
+	Flags      uint32
+	ResetReg   GenericAddress
+	ResetValue uint8
+}
+
+// HPETInfo describes the High Precision Event Timer block
+type HPETInfo struct {
+	Present bool
+	Address uint64
+	Number  uint8
+	MinTick uint16
+}
+
+var (
+	fadt FADT
+	hpet HPETInfo
+)
+
+func readGAS(p uintptr) GenericAddress {
+	return GenericAddress{
+		Space:      readU8(p),
+		BitWidth:   readU8(p + 1),
+		BitOffset:  readU8(p + 2),
+		AccessSize: readU8(p + 3),
+		Address:    readU64(p + 4),
+	}
+}
+
+func parseFADT(t uintptr) {
+	length := readU32(t + 4)
+
+	fadt.Present = true
+	fadt.DSDT = uint64(readU32(t + 40))
+	fadt.SCIInterrupt = readU16(t + 46)
+	fadt.SMICommand = readU32(t + 48)
+	fadt.ACPIEnable = readU8(t + 52)
+	fadt.ACPIDisable = readU8(t + 53)
+	fadt.PM1aEvent = readU32(t + 56)
+	fadt.PM1bEvent = readU32(t + 60)
+	fadt.PM1aControl = readU32(t + 64)
+	fadt.PM1bControl = readU32(t + 68)
+	fadt.PMTimer = readU32(t + 76)
+	fadt.PM1EventLen = readU8(t + 88)
+	fadt.PM1CtrlLen = readU8(t + 89)
+	if length >= 109 {
+		fadt.Century = readU8(t + 108)
+	}
+
+	// Everything below only exists in ACPI 2.0+ sized FADTs
+	if length >= 116 {
+		fadt.Flags = readU32(t + 112)
+	}
+	if length >= 129 {
+		fadt.ResetReg = readGAS(t + 116)
+		fadt.ResetValue = readU8(t + 128)
+	}
+	if length >= 148 {
+		if x := readU64(t + 140); x != 0 {
+			fadt.DSDT = x
+		}
+	}
+}
+
+func parseHPET(t uintptr) {
+	gas := readGAS(t + 40)
+	if gas.Space != addrSpaceMemory || gas.Address == 0 {
+		return
+	}
+	hpet.Present = true
+	hpet.Address = gas.Address
+	hpet.Number = readU8(t + 52)
+	hpet.MinTick = readU16(t + 53)
+}
+
+// FADTInfo returns the parsed FADT (Present is false if there was none)
+func FADTInfo() FADT { return fadt }
+
+// HPET returns the parsed HPET table (Present is false if there was none)
+func HPET() HPETInfo { return hpet }
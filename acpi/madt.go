@@ -0,0 +1,155 @@
+package acpi
+
+const (
+	maxCPUs      = 64
+	maxIOAPICs   = 8
+	maxOverrides = 16
+
+	madtEntriesOffset = 44
+
+	madtTypeLAPIC         = 0
+	madtTypeIOAPIC        = 1
+	madtTypeOverride      = 2
+	madtTypeLAPICNMI      = 4
+	madtTypeLAPICOverride = 5
+
+	madtFlagPCATCompat = 1 << 0
+	lapicFlagEnabled   = 1 << 0
+	lapicFlagOnlineCap = 1 << 1
+)
+
+// CPU is a processor local APIC entry from the MADT
+type CPU struct {
+	ProcessorID uint8
+	APICID      uint8
+	Enabled     bool
+}
+
+// IOAPIC is an I/O APIC entry from the MADT
+type IOAPIC struct {
+	ID      uint8
+	Address uint32
+	GSIBase uint32
+}
+
+// Override is an interrupt source override: ISA IRQ Source is wired to GSI
+type Override struct {
+	Bus    uint8
+	Source uint8
+	GSI    uint32
+	Flags  uint16
+}
+
+type madtInfo struct {
+	present   bool
+	lapicAddr uint64
+	flags     uint32
+
+	cpus      [maxCPUs]CPU
+	cpuCount  int
+	ioapics   [maxIOAPICs]IOAPIC
+	ioCount   int
+	overrides [maxOverrides]Override
+	ovCount   int
+
+	nmiLINT uint8 // LAPIC input wired to NMI (usually LINT1)
+}
+
+var madt madtInfo
+
+func parseMADT(t uintptr) {
+	length := readU32(t + 4)
+	madt.present = true
+	madt.lapicAddr = uint64(readU32(t + 36))
+	madt.flags = readU32(t + 40)
+	madt.nmiLINT = 1
+
+	end := t + uintptr(length)
+	for p := t + madtEntriesOffset; p+2 <= end; {
+		typ := readU8(p)
+		l := uintptr(readU8(p + 1))
+		if l < 2 || p+l > end {
+			break
+		}
+
+		switch typ {
+		case madtTypeLAPIC:
+			flags := readU32(p + 4)
+			if flags&(lapicFlagEnabled|lapicFlagOnlineCap) != 0 && madt.cpuCount < maxCPUs {
+				madt.cpus[madt.cpuCount] = CPU{
+					ProcessorID: readU8(p + 2),
+					APICID:      readU8(p + 3),
+					Enabled:     flags&lapicFlagEnabled != 0,
+				}
+				madt.cpuCount++
+			}
+		case madtTypeIOAPIC:
+			if madt.ioCount < maxIOAPICs {
+				madt.ioapics[madt.ioCount] = IOAPIC{
+					ID:      readU8(p + 2),
+					Address: readU32(p + 4),
+					GSIBase: readU32(p + 8),
+				}
+				madt.ioCount++
+			}
+		case madtTypeOverride:
+			if madt.ovCount < maxOverrides {
+				madt.overrides[madt.ovCount] = Override{
+					Bus:    readU8(p + 2),
+					Source: readU8(p + 3),
+					GSI:    readU32(p + 4),
+					Flags:  readU16(p + 8),
+				}
+				madt.ovCount++
+			}
+		case madtTypeLAPICNMI:
+			if lint := readU8(p + 5); lint <= 1 {
+				madt.nmiLINT = lint
+			}
+		case madtTypeLAPICOverride:
+			madt.lapicAddr = readU64(p + 4)
+		}
+
+		p += l
+	}
+}
+
+// MADTPresent reports whether a valid MADT was found
+func MADTPresent() bool { return madt.present }
+
+// LocalAPICAddress returns the physical address of the local APIC
+func LocalAPICAddress() uint64 { return madt.lapicAddr }
+
+// HasLegacyPICs reports whether dual 8259s are present (PCAT_COMPAT)
+func HasLegacyPICs() bool { return madt.flags&madtFlagPCATCompat != 0 }
+
+// NMILINT returns the local APIC input (0 or 1) wired to NMI, LINT1 when
+// the MADT does not say
+func NMILINT() uint8 { return madt.nmiLINT }
+
+func CPUCount() int { return madt.cpuCount }
+
+func CPUEntry(i int) CPU {
+	if i < 0 || i >= madt.cpuCount {
+		return CPU{}
+	}
+	return madt.cpus[i]
+}
+
+func IOAPICCount() int { return madt.ioCount }
+
+func IOAPICEntry(i int) IOAPIC {
+	if i < 0 || i >= madt.ioCount {
+		return IOAPIC{}
+	}
+	return madt.ioapics[i]
+}
+
+func OverrideCount() int { return madt.ovCount }
+
+func OverrideEntry(i int) Override {
+	if i < 0 || i >= madt.ovCount {
+		return Override{}
+	}
+	return madt.overrides[i]
+}
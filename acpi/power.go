@@ -0,0 +1,143 @@
+package acpi
+
+import "unsafe"
+
+func inb(port uint16) byte
+func outb(port uint16, value byte)
+func inw(port uint16) uint16
+func outw(port uint16, value uint16)
+func tripleFault()
+
+const (
+	pm1SCIEnable = 1 << 0
+	pm1SleepType = 10 // SLP_TYPx is bits 10-12 of PM1x_CNT
+	pm1SleepEn   = 1 << 13
+	pm1TypeMask  = 7 << pm1SleepType
+
+	amlNameOp    = 0x08
+	amlPackageOp = 0x12
+	amlBytePref  = 0x0A
+	amlZeroOp    = 0x00
+	amlOneOp     = 0x01
+
+	kbcStatus    = 0x64
+	kbcInputFull = 1 << 1
+	kbcResetCmd  = 0xFE
+
+	acpiEnableSpins = 1000000
+)
+
+// s5SleepTypes finds the \_S5_ package in the DSDT and returns the
+// SLP_TYPa/SLP_TYPb values for soft-off. This is a byte-pattern search,
+// not an AML interpreter, which is enough for QEMU and most firmware.
+func s5SleepTypes(dsdt uintptr) (typA, typB uint16, ok bool) {
+	if dsdt == 0 {
+		return 0, 0, false
+	}
+	length := uintptr(readU32(dsdt + 4))
+	end := dsdt + length
+
+	for p := dsdt + headerSize; p+4 < end; p++ {
+		if !sigEquals(p, "_S5_") {
+			continue
+		}
+		// must be a NameOp, optionally with a root prefix: 08 [5C] _S5_
+		if readU8(p-1) != amlNameOp && (readU8(p-1) != '\\' || readU8(p-2) != amlNameOp) {
+			continue
+		}
+
+		q := p + 4
+		if q >= end || readU8(q) != amlPackageOp {
+			continue
+		}
+		q++
+		// PkgLength: top 2 bits of the lead byte count the extra bytes
+		q += 1 + uintptr(readU8(q)>>6)
+		q++ // NumElements
+
+		var vals [2]uint16
+		for i := 0; i < 2 && q < end; i++ {
+			b := readU8(q)
+			switch b {
+			case amlBytePref:
+				vals[i] = uint16(readU8(q + 1))
+				q += 2
+			case amlZeroOp, amlOneOp:
+				vals[i] = uint16(b)
+				q++
+			default:
+				return 0, 0, false
+			}
+		}
+		return vals[0], vals[1], true
+	}
+	return 0, 0, false
+}
+
+// enableACPIMode hands the PM registers from SMM to the OS if needed.
+func enableACPIMode() {
+	if inw(uint16(fadt.PM1aControl))&pm1SCIEnable != 0 {
+		return
+	}
+	if fadt.SMICommand == 0 || fadt.ACPIEnable == 0 {
+		return
+	}
+	outb(uint16(fadt.SMICommand), fadt.ACPIEnable)
+	for i := 0; i < acpiEnableSpins; i++ {
+		if inw(uint16(fadt.PM1aControl))&pm1SCIEnable != 0 {
+			return
+		}
+	}
+}
+
+// Shutdown enters the S5 (soft-off) state through the FADT PM1 control
+// blocks. It only returns if power off did not happen: false if there is
+// no way to request S5, true if the request was written but the machine
+// is still running.
+func Shutdown() bool {
+	if !ready || !fadt.Present || fadt.PM1aControl == 0 {
+		return false
+	}
+
+	typA, typB, ok := s5SleepTypes(FindTable("DSDT"))
+	if !ok {
+		return false
+	}
+
+	enableACPIMode()
+
+	enterSleep(uint16(fadt.PM1aControl), typA)
+	if fadt.PM1bControl != 0 {
+		enterSleep(uint16(fadt.PM1bControl), typB)
+	}
+	return true
+}
+
+// enterSleep writes the sleep type and SLP_EN to a PM1x_CNT register,
+// keeping SCI_EN and its other bits as they are.
+func enterSleep(port uint16, typ uint16) {
+	old := inw(port) &^ (pm1TypeMask | pm1SleepEn)
+	outw(port, old|typ<<pm1SleepType|pm1SleepEn)
+}
+
+// Reboot resets the machine, trying in order: the ACPI reset register,
+// the 8042 keyboard controller reset line and finally a triple fault.
+func Reboot() {
+	if ready && fadt.Present && fadt.Flags&fadtFlagResetReg != 0 && fadt.ResetReg.Address != 0 {
+		switch fadt.ResetReg.Space {
+		case addrSpaceIO:
+			outb(uint16(fadt.ResetReg.Address), fadt.ResetValue)
+		case addrSpaceMemory:
+			*(*byte)(unsafe.Pointer(phys(fadt.ResetReg.Address))) = fadt.ResetValue
+		}
+	}
+
+	for i := 0; i < 0x10000; i++ {
+		if inb(kbcStatus)&kbcInputFull == 0 {
+			break
+		}
+	}
+	outb(kbcStatus, kbcResetCmd)
+
+	tripleFault()
+}
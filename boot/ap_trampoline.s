@@ -0,0 +1,119 @@
+/* boot/ap_trampoline.s
+ * Application processor (AP) startup trampoline.
+ *
+ * Flow:
+ * - The kernel copies the bytes between ap_trampoline_start and
+ *   ap_trampoline_end to physical 0x8000 and fills the parameter block.
+ * - A Startup IPI with vector 0x08 starts the AP in real mode at 0x8000.
+ * - The AP loads the small GDT below, enters protected mode, turns on PAE
+ *   and long mode with the CR3 given by the BSP (plus NX and write
+ *   protection, like boot.s), then jumps to 64-bit code. The kernel keeps
+ *   0x8000 identity-mapped until every AP is up.
+ * - In long mode it switches to its own stack and calls
+ *   go_0kernel.APEntry(cpu), which never returns.
+ *
+ * Everything is assembled here but runs at 0x8000, so absolute addresses
+ * are computed as (label - ap_trampoline_start + AP_BASE).
+ */
+.set AP_BASE, 0x8000
+
+.section .rodata
+.align 16
+.code16
+
+.global ap_trampoline_start
+ap_trampoline_start:
+	cli
+	jmp ap_rm_entry
+
+/* Parameter block, offsets are mirrored by kernel/smp.go */
+.org ap_trampoline_start + 8
+ap_param_cr3:
+	.quad 0
+ap_param_stack:
+	.quad 0
+ap_param_cpu:
+	.quad 0
+ap_param_ready:
+	.long 0
+	.long 0
+
+ap_gdt:
+	.quad 0x0000000000000000
+	.quad 0x00CF9A000000FFFF   # 0x08: 32-bit code
+	.quad 0x00CF92000000FFFF   # 0x10: data
+	.quad 0x00AF9A000000FFFF   # 0x18: 64-bit code
+ap_gdtr:
+	.word ap_gdtr - ap_gdt - 1
+	.long (ap_gdt - ap_trampoline_start + AP_BASE)
+
+ap_rm_entry:
+	xorw %ax, %ax
+	movw %ax, %ds
+	lgdtl (ap_gdtr - ap_trampoline_start + AP_BASE)
+
+	movl %cr0, %eax
+	orl  $0x1, %eax            # PE
+	movl %eax, %cr0
+	ljmpl $0x08, $(ap_pm_entry - ap_trampoline_start + AP_BASE)
+
+.code32
+ap_pm_entry:
+	movw $0x10, %ax
+	movw %ax, %ds
+	movw %ax, %es
+	movw %ax, %ss
+
+	movl %cr4, %eax
+	orl  $0x20, %eax           # PAE
+	movl %eax, %cr4
+
+	movl (ap_param_cr3 - ap_trampoline_start + AP_BASE), %eax
+	movl %eax, %cr3
+
+	movl $0x80000001, %eax
+	cpuid
+	movl %edx, %edi
+	movl $0xC0000080, %ecx     # EFER.LME, EFER.NXE if supported
+	rdmsr
+	orl  $0x100, %eax
+	testl $(1 << 20), %edi
+	jz 1f
+	orl  $0x800, %eax
+1:	wrmsr
+
+	movl %cr0, %eax
+	orl  $0x80010000, %eax     # PG, WP
+	movl %eax, %cr0
+	ljmp $0x18, $(ap_lm_entry - ap_trampoline_start + AP_BASE)
+
+.code64
+ap_lm_entry:
+	movw $0x10, %ax
+	movw %ax, %ds
+	movw %ax, %es
+	movw %ax, %ss
+	movw %ax, %fs
+	movw %ax, %gs
+
+	# Same FPU/SSE setup as the BSP in boot.s
+	movq %cr0, %rax
+	andq $~0xC, %rax           # clear EM, TS
+	orq  $0x22, %rax           # MP, NE
+	movq %rax, %cr0
+	movq %cr4, %rax
+	orq  $0x600, %rax          # OSFXSR, OSXMMEXCPT
+	movq %rax, %cr4
+	fninit
+
+	movq (ap_param_stack - ap_trampoline_start + AP_BASE), %rsp
+	movq (ap_param_cpu - ap_trampoline_start + AP_BASE), %rdi
+	movabsq $go_0kernel.APEntry, %rax
+	callq *%rax
+
+1:	cli
+	hlt
+	jmp 1b
+
+.global ap_trampoline_end
+ap_trampoline_end:
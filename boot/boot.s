@@ -6,8 +6,9 @@
  * - GRUB jumps to _start with EAX=0x36D76289 and EBX pointing to the multiboot
  *   info struct (per spec).
  * - We immediately disable interrupts (cli) because no IDT/PIC is set up yet.
- * - We set ESP to a known 16 KB stack in .bss, aligned to 16 bytes.
- * - We park the CPU in a HLT loop as a placeholder until real kernel init runs.
+ * - We set ESP to a known 16 KB stack, aligned to 16 bytes.
+ * - We build boot page tables, enter long mode and jump to the higher half,
+ *   where kernel.Main runs (see boot/linker.ld for the layout).
  */
 .code32
 
@@ -60,7 +61,9 @@ stack_bottom:
 	.skip 16384              # 16 KB di stack
 stack_top:
 
-# Long mode paging structures (4 KiB aligned, zero-initialized).
+# Long mode paging structures (4 KiB aligned, zero-initialized). They are
+# linked in the higher half like the rest of the image, so the 32-bit code
+# uses their physical addresses (symbol - KERNEL_VMA).
 .align 4096
 pml4:
 	.skip 4096
@@ -68,6 +71,9 @@ pml4:
 pdpt:
 	.skip 4096
 .align 4096
+pdpt_hi:
+	.skip 4096
+.align 4096
 pd0:
 	.skip 4096
 .align 4096
@@ -82,11 +88,20 @@ pd3:
 .global __bootstrap_end
 __bootstrap_end:
 
-.align 4
-multiboot_info_ptr:
-	.long 0
+# Virtual layout, mirrored by mem/layout.go and boot/linker.ld
+.set KERNEL_VMA,      0xFFFFFFFF80000000
+.set DIRECT_MAP_PML4, 256      # 0xFFFF800000000000
+.set KERNEL_PML4,     511      # 0xFFFFFF8000000000
+.set KERNEL_PDPT,     510      # 0xFFFFFFFF80000000
 
-.section .rodata
+.set EFER_LME, 1 << 8
+.set EFER_NXE, 1 << 11
+.set CPUID_NX, 1 << 20         # CPUID.80000001h:EDX
+.set CR0_PG,   1 << 31
+.set CR0_WP,   1 << 16
+
+/* The GDT is used before paging, so it lives at its physical address */
+.section .boot.rodata, "a"
 .align 8
 gdt64:
 	.quad 0x0000000000000000
@@ -103,21 +118,23 @@ gdt64_end:
  * Executable code
  * ---------------------------
  * GRUB jumps here after validating the header, with:
- * - EAX = 0x2BADB002 (Multiboot magic passed to the kernel)
- * - EBX = pointer to the Multiboot info structure
+ * - EAX = 0x36D76289 (Multiboot2 magic passed to the kernel)
+ * - EBX = physical address of the Multiboot2 info structure
+ * Paging is off, so this part runs at its physical (load) address.
  */
-	.section .text
+	.section .boot.text, "ax"
 	.global  _start
 	.type    _start, @function
 
 _start:
 	cli # disable interrupts (no IDT/PIC set yet)
 
-# initialize ESP to the top of our 16 KB stack in .bss
-	mov  $stack_top, %esp
+# initialize ESP to the top of our 16 KB stack
+	movl $(stack_top - KERNEL_VMA), %esp
 
 # Multiboot2: EBX contains the address of the multiboot info structure.
-	movl %ebx, multiboot_info_ptr
+# ESI survives until kernel.Main gets it.
+	movl %ebx, %esi
 
 	call setup_long_mode
 
@@ -128,115 +145,64 @@ _start:
 .size _start, . - _start
 
 setup_long_mode:
-# Build minimal identity-mapped paging (4 GiB via 2 MiB pages).
-	lea pml4, %edi
-	movl $pdpt, %eax
-	orl $0x03, %eax
-	movl %eax, (%edi)
-	movl $0, 4(%edi)
-
-	lea pdpt, %edi
-	movl $pd0, %eax
-	orl $0x03, %eax
-	movl %eax, (%edi)
-	movl $0, 4(%edi)
-	movl $pd1, %eax
-	orl $0x03, %eax
-	movl %eax, 8(%edi)
-	movl $0, 12(%edi)
-	movl $pd2, %eax
-	orl $0x03, %eax
-	movl %eax, 16(%edi)
-	movl $0, 20(%edi)
-	movl $pd3, %eax
-	orl $0x03, %eax
-	movl %eax, 24(%edi)
-	movl $0, 28(%edi)
-
-	movl $0x83, %edx           # present|rw|ps
-
-	lea pd0, %edi
-	xorl %ecx, %ecx
-	movl $0x00000000, %ebx
-
-.Lmap_2m_pd0:
-	movl %ecx, %eax
-	shll $21, %eax             # ecx * 2 MiB
-	addl %ebx, %eax
-	orl %edx, %eax
-	movl %eax, (%edi)
-	movl $0, 4(%edi)
-	addl $8, %edi
-	incl %ecx
-	cmpl $512, %ecx
-	jne .Lmap_2m_pd0
-
-	lea pd1, %edi
+# Boot page tables, all with 2 MiB pages over the same four directories:
+# - 0-4 GiB identity mapped, for this code until it jumps high
+# - 0-4 GiB at the direct map
+# - 0-1 GiB at KERNEL_VMA, for the kernel image
+# vmm.Init replaces them with tables that drop the identity map.
+	movl $(pdpt - KERNEL_VMA + 0x03), %eax
+	movl %eax, (pml4 - KERNEL_VMA)
+	movl %eax, (pml4 - KERNEL_VMA + DIRECT_MAP_PML4 * 8)
+	movl $(pdpt_hi - KERNEL_VMA + 0x03), (pml4 - KERNEL_VMA + KERNEL_PML4 * 8)
+
+	movl $(pd0 - KERNEL_VMA + 0x03), %eax
+	movl %eax, (pdpt_hi - KERNEL_VMA + KERNEL_PDPT * 8)
+	movl $(pdpt - KERNEL_VMA), %edi
 	xorl %ecx, %ecx
-	movl $0x40000000, %ebx
 
-.Lmap_2m_pd1:
-	movl %ecx, %eax
-	shll $21, %eax
-	addl %ebx, %eax
-	orl %edx, %eax
-	movl %eax, (%edi)
-	movl $0, 4(%edi)
-	addl $8, %edi
-	incl %ecx
-	cmpl $512, %ecx
-	jne .Lmap_2m_pd1
-
-	lea pd2, %edi
-	xorl %ecx, %ecx
-	movl $0x80000000, %ebx
-
-.Lmap_2m_pd2:
-	movl %ecx, %eax
-	shll $21, %eax
-	addl %ebx, %eax
-	orl %edx, %eax
-	movl %eax, (%edi)
-	movl $0, 4(%edi)
-	addl $8, %edi
+.Lmap_pds:
+	movl %eax, (%edi,%ecx,8)
+	addl $4096, %eax            # pd0..pd3 are consecutive
 	incl %ecx
-	cmpl $512, %ecx
-	jne .Lmap_2m_pd2
+	cmpl $4, %ecx
+	jne .Lmap_pds
 
-	lea pd3, %edi
+	movl $(pd0 - KERNEL_VMA), %edi
 	xorl %ecx, %ecx
-	movl $0xC0000000, %ebx
 
-.Lmap_2m_pd3:
+.Lmap_2m:
 	movl %ecx, %eax
-	shll $21, %eax
-	addl %ebx, %eax
-	orl %edx, %eax
-	movl %eax, (%edi)
-	movl $0, 4(%edi)
-	addl $8, %edi
+	shll $21, %eax             # ecx * 2 MiB
+	orl  $0x83, %eax           # present|rw|ps
+	movl %eax, (%edi,%ecx,8)
 	incl %ecx
-	cmpl $512, %ecx
-	jne .Lmap_2m_pd3
+	cmpl $2048, %ecx           # 4 directories of 512 entries
+	jne .Lmap_2m
 
 # Load PML4 and enable PAE.
-	movl $pml4, %eax
+	movl $(pml4 - KERNEL_VMA), %eax
 	movl %eax, %cr3
 
 	movl %cr4, %eax
 	orl  $0x20, %eax
 	movl %eax, %cr4
 
-# Enable long mode in EFER.
+# Enable long mode in EFER, and no-execute pages when the CPU has them.
+	movl $0x80000001, %eax
+	cpuid
+	movl %edx, %edi
 	movl $0xC0000080, %ecx
 	rdmsr
-	orl  $0x100, %eax
-	wrmsr
+	orl  $EFER_LME, %eax
+	testl $CPUID_NX, %edi
+	jz 1f
+	orl  $EFER_NXE, %eax
+1:	wrmsr
 
-# Load GDT and enable paging.
+# Load GDT and enable paging. WP makes read-only pages bind ring 0 too.
 	lgdt gdt64_desc
 	movl %cr0, %eax
-	orl  $0x80000000, %eax
+	orl  $(CR0_PG | CR0_WP), %eax
 	movl %eax, %cr0
 
 # Far jump to 64-bit code segment.
@@ -244,6 +210,13 @@ setup_long_mode:
 
 .code64
 long_mode_entry:
+	movabsq $long_mode_high, %rax
+	jmp *%rax
+
+/* From here on the kernel runs at its link address in the higher half. */
+	.section .text
+
+long_mode_high:
 	movw $0x10, %ax
 	movw %ax, %ds
 	movw %ax, %es
@@ -255,6 +228,19 @@ long_mode_entry:
 	andq $-16, %rsp
 	subq $8, %rsp
 
+# gccgo emits SSE for floats and block copies, so the FPU must be usable
+# before any Go code runs: CR0.EM=0 (no emulation), TS=0, MP=1, NE=1
+# (native x87 errors), CR4.OSFXSR=1 (FXSAVE/SSE) and OSXMMEXCPT=1 (#XM
+# for unmasked SIMD exceptions). XSAVE/AVX are set up later by InitFPU.
+	movq %cr0, %rax
+	andq $~0xC, %rax
+	orq  $0x22, %rax
+	movq %rax, %cr0
+	movq %cr4, %rax
+	orq  $0x600, %rax
+	movq %rax, %cr4
+	fninit
+
 # Clear BSS.
 	movq $__bss_start, %rdi
 	movq $__bss_end, %rcx
@@ -262,7 +248,7 @@ long_mode_entry:
 	xor %eax, %eax
 	rep stosb
 
-	movl multiboot_info_ptr(%rip), %edi
+	movl %esi, %edi
 	call go_0kernel.Main
 
 .Lhang64:
@@ -23,3 +23,46 @@ memcmp:
 .memcmp_diff:
 	subl %ecx, %eax
 	ret
+
+# gcc emits calls to these for struct copies, zeroing and copy().
+.global memset
+.type memset, @function
+memset:
+	movq %rdi, %r8
+	movl %esi, %eax
+	movq %rdx, %rcx
+	cld
+	rep stosb
+	movq %r8, %rax
+	ret
+.size memset, . - memset
+
+.global memcpy
+.type memcpy, @function
+memcpy:
+	movq %rdi, %rax
+	movq %rdx, %rcx
+	cld
+	rep movsb
+	ret
+.size memcpy, . - memcpy
+
+.global memmove
+.type memmove, @function
+memmove:
+	movq %rdi, %rax
+	movq %rdx, %rcx
+	cmpq %rsi, %rdi
+	jbe 1f
+	# destination above source: copy backwards
+	leaq -1(%rsi,%rdx), %rsi
+	leaq -1(%rdi,%rdx), %rdi
+	std
+	rep movsb
+	cld
+	ret
+1:
+	cld
+	rep movsb
+	ret
+.size memmove, . - memmove
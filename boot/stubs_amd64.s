@@ -237,6 +237,30 @@ runtime.memequal64..f:
 	ret
 .size runtime.memequal64..f, . - runtime.memequal64..f
 
+# bool runtime.strequal..f(...)
+.global runtime.strequal..f
+.type   runtime.strequal..f, @function
+runtime.strequal..f:
+	xor %eax, %eax
+	ret
+.size runtime.strequal..f, . - runtime.strequal..f
+
+# The hash functions the type descriptors of map keys point to, and the
+# ones the hashers gccgo generates for struct keys call. heap/maps.go
+# hashes keys itself, so these only have to link.
+.macro HASH_STUB name
+.global runtime.\name
+.type   runtime.\name, @function
+runtime.\name:
+	xor %eax, %eax
+	ret
+.size runtime.\name, . - runtime.\name
+.endm
+
+.irp name, memhash, memhash0..f, memhash8..f, memhash16..f, memhash32..f, memhash64..f, memhash128..f, strhash, strhash..f, f32hash, f32hash..f, f64hash, f64hash..f
+HASH_STUB \name
+.endr
+
 # void go_0kernel.LoadIDT(void *idtr)
 .global go_0kernel.LoadIDT
 .type   go_0kernel.LoadIDT, @function
@@ -251,18 +275,44 @@ go_0kernel.StoreIDT:
 	sidt (%rdi)
 	ret
 
+# void go_0kernel.loadGDT(void *gdtr, uint16 tssSelector)
+.global go_0kernel.loadGDT
+.type   go_0kernel.loadGDT, @function
+go_0kernel.loadGDT:
+	lgdt (%rdi)
+	# Reload CS with a far return, then the data segments
+	pushq $0x08
+	leaq 1f(%rip), %rax
+	pushq %rax
+	lretq
+1:
+	movw $0x10, %ax
+	movw %ax, %ds
+	movw %ax, %es
+	movw %ax, %ss
+	movw %ax, %fs
+	movw %ax, %gs
+	ltr %si
+	ret
+.size go_0kernel.loadGDT, . - go_0kernel.loadGDT
+
 # void go_0kernel.Int80Stub()
 .global go_0kernel.Int80Stub
 .type   go_0kernel.Int80Stub, @function
 go_0kernel.Int80Stub:
+	pushq $0             # no error code
+	pushq $0x80          # vector
 	PUSH_REGS
+	pushq $0             # CR2 is meaningless for syscalls
 	mov %rsp, %rbp
 	andq $-16, %rsp
 	subq $8, %rsp
 	mov %rbp, %rdi
 	call  go_0kernel.Int80Handler
 	mov %rbp, %rsp
+	addq $8, %rsp
 	POP_REGS
+	addq $16, %rsp
 	iretq
 .size go_0kernel.Int80Stub, . - go_0kernel.Int80Stub
 
@@ -274,6 +324,56 @@ go_0kernel.getInt80StubAddr:
 	ret
 .size go_0kernel.getInt80StubAddr, . - go_0kernel.getInt80StubAddr
 
+# Voluntary task switch (scheduler.Yield). Same frame as an IRQ; the
+# handler returns the TrapFrame to resume, which may belong to another task.
+yield_stub:
+	pushq $0
+	pushq $0x81
+	PUSH_REGS
+	pushq $0
+	mov %rsp, %rbp
+	andq $-16, %rsp
+	mov %rbp, %rdi
+	call go_0kernel.YieldDispatch
+	mov %rax, %rsp       # frame to resume
+	addq $8, %rsp
+	POP_REGS
+	addq $16, %rsp
+	iretq
+
+# uint64 go_0kernel.getYieldStubAddr()
+.global go_0kernel.getYieldStubAddr
+.type   go_0kernel.getYieldStubAddr, @function
+go_0kernel.getYieldStubAddr:
+	leaq yield_stub(%rip), %rax
+	ret
+.size go_0kernel.getYieldStubAddr, . - go_0kernel.getYieldStubAddr
+
+# Reschedule IPI (kernel kickCPU). Same frame as an IRQ; ReschedDispatch
+# sends the EOI and returns the TrapFrame to resume.
+resched_stub:
+	pushq $0
+	pushq $0xF0
+	PUSH_REGS
+	pushq $0
+	mov %rsp, %rbp
+	andq $-16, %rsp
+	mov %rbp, %rdi
+	call go_0kernel.ReschedDispatch
+	mov %rax, %rsp       # frame to resume
+	addq $8, %rsp
+	POP_REGS
+	addq $16, %rsp
+	iretq
+
+# uint64 go_0kernel.getReschedStubAddr()
+.global go_0kernel.getReschedStubAddr
+.type   go_0kernel.getReschedStubAddr, @function
+go_0kernel.getReschedStubAddr:
+	leaq resched_stub(%rip), %rax
+	ret
+.size go_0kernel.getReschedStubAddr, . - go_0kernel.getReschedStubAddr
+
 # uint16 go_0kernel.GetCS()
 .global go_0kernel.GetCS
 .type   go_0kernel.GetCS, @function
@@ -290,49 +390,219 @@ go_0kernel.TriggerInt80:
 	ret
 .size go_0kernel.TriggerInt80, . - go_0kernel.TriggerInt80
 
-# void go_0kernel.GPFaultStub()
-.global go_0kernel.GPFaultStub
-.type   go_0kernel.GPFaultStub, @function
-go_0kernel.GPFaultStub:
-	movb $'G', %al
-	cli
-	mov $0xb8000, %rdi
-	movb $'G', (%rdi)
-	movb $0x1f, 1(%rdi)
-1:
-	hlt
-	jmp 1b
-.size go_0kernel.GPFaultStub, . - go_0kernel.GPFaultStub
+# CPU exceptions (vectors 0-31).
+# Every stub leaves the stack in the TrapFrame layout (see kernel/idt.go):
+# the CPU pushes SS, RSP, RFLAGS, CS, RIP (and an error code for some
+# vectors), the stub pushes a dummy error code when the CPU did not, then
+# the vector number, then the common path saves the GPRs and CR2.
+.macro ISR_NOERR vec
+isr_stub_\vec:
+	pushq $0
+	pushq $\vec
+	jmp isr_common
+.endm
 
-# void go_0kernel.DFaultStub()
-.global go_0kernel.DFaultStub
-.type   go_0kernel.DFaultStub, @function
-go_0kernel.DFaultStub:
-	movb $'D', %al
-	cli
-	mov $0xb8000, %rdi
-	movb $'D', (%rdi)
-	movb $0x4f, 1(%rdi)
-1:
-	hlt
-	jmp 1b
-.size go_0kernel.DFaultStub, . - go_0kernel.DFaultStub
+.macro ISR_ERR vec
+isr_stub_\vec:
+	pushq $\vec
+	jmp isr_common
+.endm
+
+ISR_NOERR 0
+ISR_NOERR 1
+ISR_NOERR 2
+ISR_NOERR 3
+ISR_NOERR 4
+ISR_NOERR 5
+ISR_NOERR 6
+ISR_NOERR 7
+ISR_ERR   8
+ISR_NOERR 9
+ISR_ERR   10
+ISR_ERR   11
+ISR_ERR   12
+ISR_ERR   13
+ISR_ERR   14
+ISR_NOERR 15
+ISR_NOERR 16
+ISR_ERR   17
+ISR_NOERR 18
+ISR_NOERR 19
+ISR_NOERR 20
+ISR_ERR   21
+ISR_NOERR 22
+ISR_NOERR 23
+ISR_NOERR 24
+ISR_NOERR 25
+ISR_NOERR 26
+ISR_NOERR 27
+ISR_NOERR 28
+ISR_ERR   29
+ISR_ERR   30
+ISR_NOERR 31
+
+isr_common:
+	PUSH_REGS
+	movq %cr2, %rax
+	pushq %rax
+	mov %rsp, %rbp
+	andq $-16, %rsp
+	mov %rbp, %rdi
+	call go_0kernel.ExceptionHandler
+	mov %rbp, %rsp
+	addq $8, %rsp        # drop CR2
+	POP_REGS
+	addq $16, %rsp       # drop vector + error code
+	iretq
+
+# uint64 go_0kernel.getISRStubAddr(vec uint64)
+.global go_0kernel.getISRStubAddr
+.type   go_0kernel.getISRStubAddr, @function
+go_0kernel.getISRStubAddr:
+	leaq isr_stub_table(%rip), %rax
+	movq (%rax,%rdi,8), %rax
+	ret
+.size go_0kernel.getISRStubAddr, . - go_0kernel.getISRStubAddr
+
+.section .rodata
+.align 8
+isr_stub_table:
+.irp vec, 0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21,22,23,24,25,26,27,28,29,30,31
+	.quad isr_stub_\vec
+.endr
+
+.section .text
+
+# void go_0kernel.cpuid(uint32 leaf, uint32 subleaf, uint32 *out[4])
+.global go_0kernel.cpuid
+.type   go_0kernel.cpuid, @function
+go_0kernel.cpuid:
+	pushq %rbx
+	movq %rdx, %r8
+	movl %edi, %eax
+	movl %esi, %ecx
+	cpuid
+	movl %eax, 0(%r8)
+	movl %ebx, 4(%r8)
+	movl %ecx, 8(%r8)
+	movl %edx, 12(%r8)
+	popq %rbx
+	ret
+.size go_0kernel.cpuid, . - go_0kernel.cpuid
+
+# uint64 go_0kernel.rdmsr(uint32 msr)
+.global go_0kernel.rdmsr
+.type   go_0kernel.rdmsr, @function
+go_0kernel.rdmsr:
+	movl %edi, %ecx
+	rdmsr
+	shlq $32, %rdx
+	movl %eax, %eax
+	orq %rdx, %rax
+	ret
+.size go_0kernel.rdmsr, . - go_0kernel.rdmsr
+
+# void go_0kernel.wrmsr(uint32 msr, uint64 val)
+.global go_0kernel.wrmsr
+.type   go_0kernel.wrmsr, @function
+go_0kernel.wrmsr:
+	movl %edi, %ecx
+	movl %esi, %eax
+	movq %rsi, %rdx
+	shrq $32, %rdx
+	wrmsr
+	ret
+.size go_0kernel.wrmsr, . - go_0kernel.wrmsr
+
+# uint32 go_0kernel.mmioRead32(uintptr addr)
+.global go_0kernel.mmioRead32
+.type   go_0kernel.mmioRead32, @function
+go_0kernel.mmioRead32:
+	movl (%rdi), %eax
+	ret
+.size go_0kernel.mmioRead32, . - go_0kernel.mmioRead32
+
+# void go_0kernel.mmioWrite32(uintptr addr, uint32 val)
+.global go_0kernel.mmioWrite32
+.type   go_0kernel.mmioWrite32, @function
+go_0kernel.mmioWrite32:
+	movl %esi, (%rdi)
+	ret
+.size go_0kernel.mmioWrite32, . - go_0kernel.mmioWrite32
+
+# LAPIC spurious interrupts must not be acknowledged with an EOI
+lapic_spurious_stub:
+	iretq
+
+# uint64 go_0kernel.getSpuriousStubAddr()
+.global go_0kernel.getSpuriousStubAddr
+.type   go_0kernel.getSpuriousStubAddr, @function
+go_0kernel.getSpuriousStubAddr:
+	leaq lapic_spurious_stub(%rip), %rax
+	ret
+.size go_0kernel.getSpuriousStubAddr, . - go_0kernel.getSpuriousStubAddr
+
+# uint64 go_0kernel.getAPTrampolineStart() (boot/ap_trampoline.s)
+.global go_0kernel.getAPTrampolineStart
+.type   go_0kernel.getAPTrampolineStart, @function
+go_0kernel.getAPTrampolineStart:
+	leaq ap_trampoline_start(%rip), %rax
+	ret
+.size go_0kernel.getAPTrampolineStart, . - go_0kernel.getAPTrampolineStart
+
+# uint64 go_0kernel.getAPTrampolineEnd()
+.global go_0kernel.getAPTrampolineEnd
+.type   go_0kernel.getAPTrampolineEnd, @function
+go_0kernel.getAPTrampolineEnd:
+	leaq ap_trampoline_end(%rip), %rax
+	ret
+.size go_0kernel.getAPTrampolineEnd, . - go_0kernel.getAPTrampolineEnd
+
+# uint64 go_0kernel.readCR3()
+.global go_0kernel.readCR3
+.type   go_0kernel.readCR3, @function
+go_0kernel.readCR3:
+	movq %cr3, %rax
+	ret
+.size go_0kernel.readCR3, . - go_0kernel.readCR3
+
+# uint64 go_0kernel.readCR4()
+.global go_0kernel.readCR4
+.type   go_0kernel.readCR4, @function
+go_0kernel.readCR4:
+	movq %cr4, %rax
+	ret
+.size go_0kernel.readCR4, . - go_0kernel.readCR4
+
+# void go_0kernel.writeCR4(v uint64)
+.global go_0kernel.writeCR4
+.type   go_0kernel.writeCR4, @function
+go_0kernel.writeCR4:
+	movq %rdi, %cr4
+	ret
+.size go_0kernel.writeCR4, . - go_0kernel.writeCR4
 
-# uint64 go_0kernel.getGPFaultStubAddr()
-.global go_0kernel.getGPFaultStubAddr
-.type   go_0kernel.getGPFaultStubAddr, @function
-go_0kernel.getGPFaultStubAddr:
-	leaq go_0kernel.GPFaultStub(%rip), %rax
+# void go_0kernel.xsetbv(reg uint32, v uint64)
+.global go_0kernel.xsetbv
+.type   go_0kernel.xsetbv, @function
+go_0kernel.xsetbv:
+	movl %edi, %ecx
+	movq %rsi, %rax
+	movq %rsi, %rdx
+	shrq $32, %rdx
+	xsetbv
 	ret
-.size go_0kernel.getGPFaultStubAddr, . - go_0kernel.getGPFaultStubAddr
+.size go_0kernel.xsetbv, . - go_0kernel.xsetbv
 
-# uint64 go_0kernel.getDFaultStubAddr()
-.global go_0kernel.getDFaultStubAddr
-.type   go_0kernel.getDFaultStubAddr, @function
-go_0kernel.getDFaultStubAddr:
-	leaq go_0kernel.DFaultStub(%rip), %rax
+# uint64 go_0kernel.rdtsc()
+.global go_0kernel.rdtsc
+.type   go_0kernel.rdtsc, @function
+go_0kernel.rdtsc:
+	rdtsc
+	shlq $32, %rdx
+	orq  %rdx, %rax
 	ret
-.size go_0kernel.getDFaultStubAddr, . - go_0kernel.getDFaultStubAddr
+.size go_0kernel.rdtsc, . - go_0kernel.rdtsc
 
 # void go_0kernel.DebugChar(byte)
 .global go_0kernel.DebugChar
@@ -383,45 +653,59 @@ go_0kernel.Halt:
 	ret
 .size go_0kernel.Halt, . - go_0kernel.Halt
 
-.global go_0kernel.IRQ0Stub
-.type   go_0kernel.IRQ0Stub, @function
-go_0kernel.IRQ0Stub:
-	PUSH_REGS
-	mov %rsp, %rbp
-	andq $-16, %rsp
-	subq $8, %rsp
-	call go_0kernel.IRQ0Handler
-	mov %rbp, %rsp
-	POP_REGS
-	iretq
-.size go_0kernel.IRQ0Stub, . - go_0kernel.IRQ0Stub
-
-.global go_0kernel.getIRQ0StubAddr
-.type   go_0kernel.getIRQ0StubAddr, @function
-go_0kernel.getIRQ0StubAddr:
-	leaq go_0kernel.IRQ0Stub(%rip), %rax
+# sti only takes effect after the next instruction, so an interrupt that
+# is already pending wakes the hlt instead of being taken before it.
+.global go_0kernel.idleHalt
+.type   go_0kernel.idleHalt, @function
+go_0kernel.idleHalt:
+	sti
+	hlt
 	ret
-.size go_0kernel.getIRQ0StubAddr, . - go_0kernel.getIRQ0StubAddr
+.size go_0kernel.idleHalt, . - go_0kernel.idleHalt
 
-.global go_0kernel.IRQ1Stub
-.type   go_0kernel.IRQ1Stub, @function
-go_0kernel.IRQ1Stub:
+# Hardware IRQs 0-15 (vectors 0x20-0x2F after the PIC remap).
+# Same TrapFrame layout as the exception stubs; CR2 is not meaningful here.
+.macro IRQ_STUB irq
+irq_stub_\irq:
+	pushq $0
+	pushq $(0x20 + \irq)
+	jmp irq_common
+.endm
+
+.irp irq, 0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15
+IRQ_STUB \irq
+.endr
+
+irq_common:
 	PUSH_REGS
+	pushq $0
 	mov %rsp, %rbp
 	andq $-16, %rsp
-	subq $8, %rsp
-	call go_0kernel.IRQ1Handler
-	mov %rbp, %rsp
+	mov %rbp, %rdi
+	call go_0kernel.IRQDispatch
+	mov %rax, %rsp       # frame to resume, maybe another task's
+	addq $8, %rsp
 	POP_REGS
+	addq $16, %rsp
 	iretq
-.size go_0kernel.IRQ1Stub, . - go_0kernel.IRQ1Stub
 
-.global go_0kernel.getIRQ1StubAddr
-.type   go_0kernel.getIRQ1StubAddr, @function
-go_0kernel.getIRQ1StubAddr:
-	leaq go_0kernel.IRQ1Stub(%rip), %rax
+# uint64 go_0kernel.getIRQStubAddr(irq uint64)
+.global go_0kernel.getIRQStubAddr
+.type   go_0kernel.getIRQStubAddr, @function
+go_0kernel.getIRQStubAddr:
+	leaq irq_stub_table(%rip), %rax
+	movq (%rax,%rdi,8), %rax
 	ret
-.size go_0kernel.getIRQ1StubAddr, . - go_0kernel.getIRQ1StubAddr
+.size go_0kernel.getIRQStubAddr, . - go_0kernel.getIRQStubAddr
+
+.section .rodata
+.align 8
+irq_stub_table:
+.irp irq, 0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15
+	.quad irq_stub_\irq
+.endr
+
+.section .text
 
 # --- Data section: global variable runtime.writeBarrier (bool) ---
 .section .data
@@ -431,6 +715,9 @@ runtime.writeBarrier:
 	.long 0
 	.size runtime.writeBarrier, . - runtime.writeBarrier
 
+# the stubs below are code: .data is mapped no-exec
+.section .text
+
 # github.com/dmarro89/go-dav-os/drivers/ata.inb(port uint16) byte
 .global github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1ata.inb
 .type   github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1ata.inb, @function
@@ -474,3 +761,215 @@ github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1ata.outsw:
 	rep outsw
 	ret
 .size github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1ata.outsw, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1ata.outsw
+
+# github.com/dmarro89/go-dav-os/acpi.inb(port uint16) byte
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inb
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inb, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inb:
+	movw %di, %dx
+	xorl %eax, %eax
+	inb %dx, %al
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inb, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inb
+
+# github.com/dmarro89/go-dav-os/acpi.outb(port uint16, val byte)
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outb
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outb, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outb:
+	movw %di, %dx
+	movb %sil, %al
+	outb %al, %dx
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outb, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outb
+
+# github.com/dmarro89/go-dav-os/acpi.inw(port uint16) uint16
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inw
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inw, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inw:
+	movw %di, %dx
+	xorl %eax, %eax
+	inw %dx, %ax
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inw, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.inw
+
+# github.com/dmarro89/go-dav-os/acpi.outw(port uint16, val uint16)
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outw
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outw, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outw:
+	movw %di, %dx
+	movw %si, %ax
+	outw %ax, %dx
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outw, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.outw
+
+# github.com/dmarro89/go-dav-os/acpi.tripleFault()
+# Loads an empty IDT and raises an exception: the CPU cannot deliver it,
+# nor the resulting #DF, and resets.
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.tripleFault
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.tripleFault, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.tripleFault:
+	cli
+	subq $16, %rsp
+	movq $0, (%rsp)
+	movq $0, 8(%rsp)
+	lidt (%rsp)
+	int3
+1:	hlt
+	jmp 1b
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.tripleFault, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1acpi.tripleFault
+
+# github.com/dmarro89/go-dav-os/kernel/sync.xchg32(addr *uint32, v uint32) uint32
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.xchg32
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.xchg32, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.xchg32:
+	movl %esi, %eax
+	xchgl %eax, (%rdi)         # implicitly locked
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.xchg32, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.xchg32
+
+# github.com/dmarro89/go-dav-os/kernel/sync.pause()
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.pause
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.pause, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.pause:
+	pause
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.pause, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.pause
+
+# github.com/dmarro89/go-dav-os/kernel/sync.saveFlagsCli() uint64
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.saveFlagsCli
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.saveFlagsCli, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.saveFlagsCli:
+	pushfq
+	popq %rax
+	cli
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.saveFlagsCli, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.saveFlagsCli
+
+# github.com/dmarro89/go-dav-os/kernel/sync.restoreFlags(flags uint64)
+# Only IF is restored; sti is skipped if interrupts were off at save time.
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.restoreFlags
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.restoreFlags, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.restoreFlags:
+	testq $0x200, %rdi
+	jz 1f
+	sti
+1:	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.restoreFlags, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1sync.restoreFlags
+
+# github.com/dmarro89/go-dav-os/drivers/rtc.inb(port uint16) byte
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.inb
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.inb, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.inb:
+	movw %di, %dx
+	xorl %eax, %eax
+	inb %dx, %al
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.inb, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.inb
+
+# github.com/dmarro89/go-dav-os/drivers/rtc.outb(port uint16, val byte)
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.outb
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.outb, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.outb:
+	movw %di, %dx
+	movb %sil, %al
+	outb %al, %dx
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.outb, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1drivers_1rtc.outb
+
+# github.com/dmarro89/go-dav-os/vmm.writeCR3(v uint64)
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.writeCR3
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.writeCR3, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.writeCR3:
+	movq %rdi, %cr3
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.writeCR3, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.writeCR3
+
+# github.com/dmarro89/go-dav-os/vmm.invlpg(addr uintptr)
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.invlpg
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.invlpg, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.invlpg:
+	invlpg (%rdi)
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.invlpg, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.invlpg
+
+# github.com/dmarro89/go-dav-os/vmm.kernelLayout(out *[4]uintptr)
+# Section bounds of the kernel image from boot/linker.ld.
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.kernelLayout
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.kernelLayout, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.kernelLayout:
+	leaq __text_start(%rip), %rax
+	movq %rax, 0(%rdi)
+	leaq __rodata_start(%rip), %rax
+	movq %rax, 8(%rdi)
+	leaq __data_start(%rip), %rax
+	movq %rax, 16(%rdi)
+	leaq __kernel_end(%rip), %rax
+	movq %rax, 24(%rdi)
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.kernelLayout, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1vmm.kernelLayout
+
+# github.com/dmarro89/go-dav-os/heap.stop()
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.stop
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.stop, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.stop:
+	cli
+1:
+	hlt
+	jmp 1b
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.stop, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.stop
+
+# The allocation hooks gccgo emits for new, make and append, implemented
+# in heap/runtime.go with the same signatures.
+
+# unsafe.Pointer runtime.newobject(typ *_type)
+.global runtime.newobject
+.type   runtime.newobject, @function
+runtime.newobject:
+	jmp github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.newobject
+.size runtime.newobject, . - runtime.newobject
+
+# unsafe.Pointer runtime.makeslice(et *_type, len, cap int)
+.global runtime.makeslice
+.type   runtime.makeslice, @function
+runtime.makeslice:
+	jmp github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.makeslice
+.size runtime.makeslice, . - runtime.makeslice
+
+# unsafe.Pointer runtime.makeslice64(et *_type, len64, cap64 int64)
+.global runtime.makeslice64
+.type   runtime.makeslice64, @function
+runtime.makeslice64:
+	jmp github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.makeslice64
+.size runtime.makeslice64, . - runtime.makeslice64
+
+# slice runtime.growslice(et *_type, old unsafe.Pointer, oldlen, oldcap, cap int)
+.global runtime.growslice
+.type   runtime.growslice, @function
+runtime.growslice:
+	jmp github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.growslice
+.size runtime.growslice, . - runtime.growslice
+
+# The map hooks, implemented in heap/maps.go with gccgo's signatures.
+.macro MAP_HOOK name
+.global runtime.\name
+.type   runtime.\name, @function
+runtime.\name:
+	jmp github_0com_1dmarro89_1go_x2ddav_x2dos_1heap.\name
+.size runtime.\name, . - runtime.\name
+.endm
+
+.irp name, makemap, makemap64, makemap_small, mapclear, mapiterinit, mapiternext
+MAP_HOOK \name
+.endr
+.irp name, mapaccess1, mapaccess2, mapaccess1_fat, mapaccess2_fat, mapassign, mapdelete
+MAP_HOOK \name
+.endr
+.irp name, mapaccess1_fast32, mapaccess2_fast32, mapassign_fast32, mapassign_fast32ptr, mapdelete_fast32
+MAP_HOOK \name
+.endr
+.irp name, mapaccess1_fast64, mapaccess2_fast64, mapassign_fast64, mapassign_fast64ptr, mapdelete_fast64
+MAP_HOOK \name
+.endr
+.irp name, mapaccess1_faststr, mapaccess2_faststr, mapassign_faststr, mapdelete_faststr
+MAP_HOOK \name
+.endr
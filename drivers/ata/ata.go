@@ -22,21 +22,53 @@ const (
 	CmdFlush = 0xE7
 )
 
-// Timeout constant for ATA operations (iterations)
-const ataTimeout = 100000
+// Timeout for a single ATA status wait, measured on the monotonic clock.
+// The tick cannot be used: it stands still with interrupts off, before
+// the timer starts and while tickless idle has stopped it. maxStatusReads
+// bounds the wait even without a clock; a status read is a port access of
+// roughly a microsecond.
+const (
+	ataTimeoutNs   = 500 * 1000 * 1000
+	maxStatusReads = 2000000
+)
+
+// returns monotonic nanoseconds; nil until the kernel wires its clock
+var nowNs func() uint64
+
+// SetClockSource sets the monotonic nanosecond clock status waits are
+// timed against.
+func SetClockSource(fn func() uint64) { nowNs = fn }
+
+func now() uint64 {
+	if nowNs == nil {
+		return 0
+	}
+	return nowNs()
+}
+
+// timedOut reports whether a status wait that began at start and has
+// polled the status reads times should give up.
+func timedOut(start uint64, reads int) bool {
+	return reads >= maxStatusReads || now()-start >= ataTimeoutNs
+}
 
 func waitBusy() bool {
-	for i := 0; i < ataTimeout; i++ {
+	start := now()
+	for reads := 1; ; reads++ {
 		status := inb(StatusCmd)
 		if (status & 0x80) == 0 {
 			return true
 		}
+		if timedOut(start, reads) {
+			break
+		}
 	}
 	return false // Timeout
 }
 
 func waitDRQ() bool {
-	for i := 0; i < ataTimeout; i++ {
+	start := now()
+	for reads := 1; ; reads++ {
 		status := inb(StatusCmd)
 		if (status & 0x01) != 0 {
 			return false // ERR
@@ -44,6 +76,9 @@ func waitDRQ() bool {
 		if (status & 0x08) != 0 {
 			return true // DRQ ready
 		}
+		if timedOut(start, reads) {
+			break
+		}
 	}
 	return false // Timeout
 }
@@ -86,11 +121,15 @@ func WriteSector(lba uint32, data *[512]byte) bool {
 
 	outsw(Data, (*byte)(unsafe.Pointer(&data[0])), 256)
 
-	// Flush Cache
-	outb(StatusCmd, CmdFlush)
+	return Flush()
+}
+
+// Flush asks the drive to write its volatile cache to the medium
+func Flush() bool {
 	if !waitBusy() {
 		return false
 	}
-
-	return true
+	outb(DriveHead, 0xE0)
+	outb(StatusCmd, CmdFlush)
+	return waitBusy()
 }
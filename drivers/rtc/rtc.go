@@ -0,0 +1,250 @@
+package rtc
+
+func inb(port uint16) byte
+func outb(port uint16, value byte)
+
+const (
+	cmosIndex uint16 = 0x70
+	cmosData  uint16 = 0x71
+
+	// bit 7 of the index port masks NMIs while we talk to the CMOS
+	nmiDisable = 0x80
+
+	regSeconds = 0x00
+	regMinutes = 0x02
+	regHours   = 0x04
+	regDay     = 0x07
+	regMonth   = 0x08
+	regYear    = 0x09
+	regStatusA = 0x0A
+	regStatusB = 0x0B
+	regStatusD = 0x0D
+
+	statusAUpdating = 0x80 // update in progress
+	statusB24Hour   = 0x02
+	statusBBinary   = 0x04
+	hourPM          = 0x80 // PM flag in 12-hour mode
+
+	// Without a FADT century register, two-digit years are taken to be
+	// in [defaultCentury, defaultCentury+100)
+	defaultCentury = 2000
+
+	maxReadAttempts = 16
+
+	// an update takes under 2 ms; each poll of status A is a few port
+	// accesses of about a microsecond, so this waits well past that
+	maxUpdateSpins = 10000
+)
+
+// Time is a calendar date and time of day, in UTC
+type Time struct {
+	Year   int
+	Month  int // 1-12
+	Day    int // 1-31
+	Hour   int
+	Minute int
+	Second int
+}
+
+// raw register snapshot, used to detect a read that straddled an update
+type regs struct {
+	sec, min, hour, day, month, year, century byte
+}
+
+var centuryReg byte
+
+// SetCenturyRegister sets the CMOS index of the century register, as
+// reported by the ACPI FADT. 0 means there is none.
+func SetCenturyRegister(reg byte) { centuryReg = reg }
+
+// readReg reads a CMOS register with NMIs masked, then points the index
+// at status register D with bit 7 clear so NMIs are delivered again.
+func readReg(reg byte) byte {
+	outb(cmosIndex, nmiDisable|reg)
+	v := inb(cmosData)
+	outb(cmosIndex, regStatusD)
+	return v
+}
+
+func updating() bool {
+	return readReg(regStatusA)&statusAUpdating != 0
+}
+
+// readRegs waits for an update in progress to end, though not forever on
+// a CMOS stuck in one; Read's compare loop catches a torn snapshot.
+func readRegs(r *regs) {
+	for i := 0; i < maxUpdateSpins && updating(); i++ {
+	}
+	r.sec = readReg(regSeconds)
+	r.min = readReg(regMinutes)
+	r.hour = readReg(regHours)
+	r.day = readReg(regDay)
+	r.month = readReg(regMonth)
+	r.year = readReg(regYear)
+	r.century = 0
+	if centuryReg != 0 {
+		r.century = readReg(centuryReg)
+	}
+}
+
+// equal compares fieldwise: struct == would call runtime.memequal
+func (r *regs) equal(o *regs) bool {
+	return r.sec == o.sec && r.min == o.min && r.hour == o.hour &&
+		r.day == o.day && r.month == o.month && r.year == o.year &&
+		r.century == o.century
+}
+
+func bcdToBinary(v byte) byte {
+	return (v & 0x0F) + (v>>4)*10
+}
+
+// decode turns a raw snapshot into a Time according to status register B
+func decode(r *regs, statusB byte) Time {
+	binary := statusB&statusBBinary != 0
+	pm := r.hour&hourPM != 0
+	hour := r.hour &^ hourPM
+
+	sec, min, day, month, year, century := r.sec, r.min, r.day, r.month, r.year, r.century
+	if !binary {
+		sec = bcdToBinary(sec)
+		min = bcdToBinary(min)
+		hour = bcdToBinary(hour)
+		day = bcdToBinary(day)
+		month = bcdToBinary(month)
+		year = bcdToBinary(year)
+		century = bcdToBinary(century)
+	}
+
+	// 12-hour mode: 12 AM is 0h, 12 PM is 12h
+	if statusB&statusB24Hour == 0 {
+		if hour == 12 {
+			hour = 0
+		}
+		if pm {
+			hour += 12
+		}
+	}
+
+	t := Time{
+		Month:  int(month),
+		Day:    int(day),
+		Hour:   int(hour),
+		Minute: int(min),
+		Second: int(sec),
+	}
+	if century != 0 {
+		t.Year = int(century)*100 + int(year)
+	} else {
+		t.Year = defaultCentury + int(year)
+	}
+	return t
+}
+
+// Read returns the current RTC date and time. The registers are read
+// until two consecutive snapshots agree, so an update that happens in the
+// middle of a read cannot produce a torn value.
+func Read() Time {
+	var a, b regs
+	readRegs(&a)
+	for i := 0; i < maxReadAttempts; i++ {
+		readRegs(&b)
+		if a.equal(&b) {
+			break
+		}
+		a = b
+	}
+	return decode(&b, readReg(regStatusB))
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// daysFromCivil returns the number of days since 1970-01-01 of the given
+// proleptic Gregorian date (H. Hinnant's algorithm).
+func daysFromCivil(y, m, d int) int64 {
+	if m <= 2 {
+		y--
+	}
+	era := y / 400
+	if y < 0 && y%400 != 0 {
+		era--
+	}
+	yoe := y - era*400
+	mp := (m + 9) % 12
+	doy := (153*mp+2)/5 + d - 1
+	doe := yoe*365 + yoe/4 - yoe/100 + doy
+	return int64(era)*146097 + int64(doe) - 719468
+}
+
+// civilFromDays is the inverse of daysFromCivil.
+func civilFromDays(z int64) (y, m, d int) {
+	z += 719468
+	era := z / 146097
+	if z < 0 && z%146097 != 0 {
+		era--
+	}
+	doe := z - era*146097
+	yoe := (doe - doe/1460 + doe/36524 - doe/146096) / 365
+	doy := doe - (365*yoe + yoe/4 - yoe/100)
+	mp := (5*doy + 2) / 153
+	d = int(doy - (153*mp+2)/5 + 1)
+	if mp < 10 {
+		m = int(mp + 3)
+	} else {
+		m = int(mp - 9)
+	}
+	y = int(yoe + era*400)
+	if m <= 2 {
+		y++
+	}
+	return y, m, d
+}
+
+// Unix converts t to seconds since 1970-01-01 00:00:00 UTC.
+func (t Time) Unix() int64 {
+	days := daysFromCivil(t.Year, t.Month, t.Day)
+	return days*86400 + int64(t.Hour)*3600 + int64(t.Minute)*60 + int64(t.Second)
+}
+
+// FromUnix converts seconds since the Unix epoch to a calendar Time.
+func FromUnix(sec int64) Time {
+	days := sec / 86400
+	rem := sec % 86400
+	if rem < 0 {
+		rem += 86400
+		days--
+	}
+	var t Time
+	t.Year, t.Month, t.Day = civilFromDays(days)
+	t.Hour = int(rem / 3600)
+	t.Minute = int(rem % 3600 / 60)
+	t.Second = int(rem % 60)
+	return t
+}
+
+// DaysInMonth returns the number of days of month m (1-12) in year y.
+func DaysInMonth(y, m int) int {
+	switch m {
+	case 2:
+		if isLeap(y) {
+			return 29
+		}
+		return 28
+	case 4, 6, 9, 11:
+		return 30
+	}
+	return 31
+}
+
+// Valid reports whether t holds a plausible date and time, to reject a
+// CMOS that was never set.
+func (t Time) Valid() bool {
+	if t.Year < 1970 || t.Month < 1 || t.Month > 12 {
+		return false
+	}
+	if t.Day < 1 || t.Day > DaysInMonth(t.Year, t.Month) {
+		return false
+	}
+	return t.Hour < 24 && t.Minute < 60 && t.Second < 60
+}
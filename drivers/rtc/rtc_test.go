@@ -0,0 +1,56 @@
+package rtc
+
+import "testing"
+
+func TestUnixRoundTrip(t *testing.T) {
+	cases := []struct {
+		t    Time
+		unix int64
+	}{
+		{Time{1970, 1, 1, 0, 0, 0}, 0},
+		{Time{2000, 2, 29, 12, 0, 0}, 951825600},
+		{Time{2024, 12, 31, 23, 59, 59}, 1735689599},
+		{Time{2038, 1, 19, 3, 14, 8}, 1 << 31},
+	}
+	for _, c := range cases {
+		if got := c.t.Unix(); got != c.unix {
+			t.Errorf("Expected %+v to be %d, got %d", c.t, c.unix, got)
+		}
+		if got := FromUnix(c.unix); got != c.t {
+			t.Errorf("Expected %d to be %+v, got %+v", c.unix, c.t, got)
+		}
+	}
+}
+
+func TestDecodeBCD12Hour(t *testing.T) {
+	// 2026-10-18 12:05:09 AM in BCD, 12-hour mode
+	r := regs{sec: 0x09, min: 0x05, hour: 0x12, day: 0x18, month: 0x10, year: 0x26, century: 0x20}
+	got := decode(&r, 0)
+	want := Time{2026, 10, 18, 0, 5, 9}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	r.hour = hourPM | 0x03 // 3 PM
+	if got := decode(&r, 0); got.Hour != 15 {
+		t.Errorf("Expected hour 15, got %d", got.Hour)
+	}
+}
+
+func TestDecodeBinary24Hour(t *testing.T) {
+	r := regs{sec: 59, min: 30, hour: 23, day: 1, month: 3, year: 99}
+	got := decode(&r, statusBBinary|statusB24Hour)
+	want := Time{2099, 3, 1, 23, 30, 59}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestValid(t *testing.T) {
+	if !(Time{2024, 2, 29, 0, 0, 0}).Valid() {
+		t.Errorf("Expected 2024-02-29 to be valid")
+	}
+	if (Time{2023, 2, 29, 0, 0, 0}).Valid() {
+		t.Errorf("Expected 2023-02-29 to be invalid")
+	}
+}
@@ -2,6 +2,8 @@ package fat16
 
 import (
 	"github.com/dmarro89/go-dav-os/drivers/ata"
+	"github.com/dmarro89/go-dav-os/drivers/rtc"
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
 	"github.com/dmarro89/go-dav-os/terminal"
 )
 
@@ -24,14 +26,50 @@ var (
 
 	// Global buffer to avoid runtime.newobject (heap allocation)
 	fatBuf [512]byte
+
+	// fatLock serializes every operation on the volume: they all share
+	// fatBuf and the BPB fields above. Disk I/O is polled and slow, so
+	// other tasks wanting the volume sleep instead of spinning.
+	fatLock scheduler.Mutex
+
+	// returns the wall clock in Unix seconds, for directory timestamps
+	getTime func() int64
 )
 
 const (
 	DirEntrySize = 32
+
+	// FAT dates count years from 1980
+	fatEpochYear = 1980
 )
 
+// SetTimeProvider wires the wall clock used to stamp directory entries
+func SetTimeProvider(fn func() int64) { getTime = fn }
+
+// fatTimestamp returns the current time in FAT directory entry format.
+// Both are 0 (no timestamp) without a clock or before 1980.
+func fatTimestamp() (date uint16, tm uint16) {
+	if getTime == nil {
+		return 0, 0
+	}
+	t := rtc.FromUnix(getTime())
+	if t.Year < fatEpochYear {
+		return 0, 0
+	}
+	date = uint16(t.Year-fatEpochYear)<<9 | uint16(t.Month)<<5 | uint16(t.Day)
+	tm = uint16(t.Hour)<<11 | uint16(t.Minute)<<5 | uint16(t.Second/2)
+	return date, tm
+}
+
 // Init reads the MBR/BPB from sector 0 and calculates offsets
 func Init() bool {
+	fatLock.Lock()
+	ok := mount()
+	fatLock.Unlock()
+	return ok
+}
+
+func mount() bool {
 	if !ata.ReadSector(0, &fatBuf) {
 		terminal.Print("FAT16: Read Error\n")
 		return false
@@ -68,8 +106,37 @@ func Init() bool {
 	return true
 }
 
+// Mounted reports whether Init found a valid volume
+func Mounted() bool {
+	return initialized
+}
+
+// Unmount flushes the drive cache and marks the volume as unusable until
+// the next Init. Writes are synchronous, so there is no dirty state here.
+func Unmount() bool {
+	fatLock.Lock()
+	ok := unmount()
+	fatLock.Unlock()
+	return ok
+}
+
+func unmount() bool {
+	if !initialized {
+		return true
+	}
+	initialized = false
+	return ata.Flush()
+}
+
 // Format writes a minimal FAT16 BPB to sector 0
 func Format() bool {
+	fatLock.Lock()
+	ok := format()
+	fatLock.Unlock()
+	return ok
+}
+
+func format() bool {
 	// Clear buffer
 	for i := 0; i < 512; i++ {
 		fatBuf[i] = 0
@@ -150,6 +217,12 @@ func Format() bool {
 }
 
 func Info() {
+	fatLock.Lock()
+	info()
+	fatLock.Unlock()
+}
+
+func info() {
 	if !initialized {
 		terminal.Print("FAT16: Not initialized\n")
 		return
@@ -180,6 +253,12 @@ func printU32(v uint32) {
 
 // ListDir lists files in the root directory
 func ListDir() {
+	fatLock.Lock()
+	listDir()
+	fatLock.Unlock()
+}
+
+func listDir() {
 	if !initialized {
 		terminal.Print("FAT16: Not initialized\n")
 		return
@@ -231,13 +310,27 @@ func ListDir() {
 				uint32(fatBuf[off+30])<<16 | uint32(fatBuf[off+31])<<24
 			terminal.Print("  ")
 			printU32(size)
-			terminal.Print(" bytes\n")
+			terminal.Print(" bytes")
+
+			// Last modification (bytes 22-25), if the entry was stamped
+			if date := get16(off + 24); date != 0 {
+				terminal.Print("  ")
+				printDate(date, get16(off+22))
+			}
+			terminal.PutRune('\n')
 		}
 	}
 }
 
 // CreateFile creates a file in the root directory
 func CreateFile(name *[8]byte, ext *[3]byte, data *[512]byte, dataLen uint32) bool {
+	fatLock.Lock()
+	ok := createFile(name, ext, data, dataLen)
+	fatLock.Unlock()
+	return ok
+}
+
+func createFile(name *[8]byte, ext *[3]byte, data *[512]byte, dataLen uint32) bool {
 	if !initialized {
 		terminal.Print("FAT16: Not initialized\n")
 		return false
@@ -343,10 +436,17 @@ func CreateFile(name *[8]byte, ext *[3]byte, data *[512]byte, dataLen uint32) bo
 	}
 	// Attributes (0x00 = normal file)
 	fatBuf[dirOff+11] = 0x00
-	// Reserved bytes
+	// Reserved bytes and timestamps
 	for i := 12; i < 26; i++ {
 		fatBuf[dirOff+i] = 0
 	}
+	// Creation (14-17), last access date (18-19) and modification (22-25)
+	date, tm := fatTimestamp()
+	put16(dirOff+14, tm)
+	put16(dirOff+16, date)
+	put16(dirOff+18, date)
+	put16(dirOff+22, tm)
+	put16(dirOff+24, date)
 	// First cluster (bytes 26-27, little endian)
 	fatBuf[dirOff+26] = byte(cluster & 0xFF)
 	fatBuf[dirOff+27] = byte((cluster >> 8) & 0xFF)
@@ -379,6 +479,13 @@ func CreateFile(name *[8]byte, ext *[3]byte, data *[512]byte, dataLen uint32) bo
 
 // ReadFile reads a file by name into the provided buffer
 func ReadFile(name *[8]byte, ext *[3]byte, outBuf *[512]byte) (uint32, bool) {
+	fatLock.Lock()
+	n, ok := readFile(name, ext, outBuf)
+	fatLock.Unlock()
+	return n, ok
+}
+
+func readFile(name *[8]byte, ext *[3]byte, outBuf *[512]byte) (uint32, bool) {
 	if !initialized {
 		return 0, false
 	}
@@ -490,3 +597,29 @@ func setFATEntry(cluster uint16, value uint16) bool {
 func clusterToSector(cluster uint16) uint32 {
 	return dataStart + uint32(cluster-2)*uint32(SecPerClust)
 }
+
+func put16(off int, v uint16) {
+	fatBuf[off] = byte(v)
+	fatBuf[off+1] = byte(v >> 8)
+}
+
+func get16(off int) uint16 {
+	return uint16(fatBuf[off]) | uint16(fatBuf[off+1])<<8
+}
+
+func printDate(date, tm uint16) {
+	printU16(date>>9 + fatEpochYear)
+	terminal.PutRune('-')
+	print2(int(date>>5) & 0x0F)
+	terminal.PutRune('-')
+	print2(int(date) & 0x1F)
+	terminal.PutRune(' ')
+	print2(int(tm >> 11))
+	terminal.PutRune(':')
+	print2(int(tm>>5) & 0x3F)
+}
+
+func print2(v int) {
+	terminal.PutRune(rune('0' + v/10%10))
+	terminal.PutRune(rune('0' + v%10))
+}
@@ -3,7 +3,9 @@ package fs
 import (
 	"unsafe"
 
+	"github.com/dmarro89/go-dav-os/kernel/sync"
 	"github.com/dmarro89/go-dav-os/mem"
+	"github.com/dmarro89/go-dav-os/slab"
 )
 
 const (
@@ -17,19 +19,28 @@ type fileEntry struct {
 	nameLen uint8
 	name    [maxName]byte
 	size    uint64
-	page    uint64 // physical address of the page
+	page    uint64 // physical address of the contents
+	small   bool   // page is a slab object rather than a whole page
 }
 
-var files [maxFiles]fileEntry
+var (
+	files [maxFiles]fileEntry
+
+	// filesLock guards the file table and the contents of backing pages
+	filesLock sync.IRQSpinLock
+)
 
 // Init resets the in-memory filesystem table
 func Init() {
+	flags := filesLock.Lock()
 	for i := 0; i < maxFiles; i++ {
 		files[i].used = false
 		files[i].nameLen = 0
 		files[i].size = 0
 		files[i].page = 0
+		files[i].small = false
 	}
+	filesLock.Unlock(flags)
 }
 
 func MaxFiles() int { return maxFiles }
@@ -44,19 +55,30 @@ func Entry(i int) (used bool, name *[maxName]byte, nameLen int, size uint64, pag
 	return e.used, &e.name, int(e.nameLen), e.size, e.page
 }
 
-// Lookup finds a file by name and returns its backing page + size.
+// Lookup finds a file by name and returns the physical address of its
+// contents + size.
 func Lookup(name *[maxName]byte, nameLen int) (page uint64, size uint64, ok bool) {
+	flags := filesLock.Lock()
 	idx := findByName(name, nameLen)
-	if idx < 0 {
-		return 0, 0, false
+	if idx >= 0 {
+		e := &files[idx]
+		page, size, ok = e.page, e.size, true
 	}
-	e := &files[idx]
-	return e.page, e.size, true
+	filesLock.Unlock(flags)
+	return page, size, ok
 }
 
 // Write creates or overwrites a file
-// data is copied into the file backing page
+// data is copied into fresh storage sized to it, so a failed write leaves
+// the old contents in place
 func Write(name *[maxName]byte, nameLen int, data *byte, dataLen uint32) bool {
+	flags := filesLock.Lock()
+	ok := write(name, nameLen, data, dataLen)
+	filesLock.Unlock(flags)
+	return ok
+}
+
+func write(name *[maxName]byte, nameLen int, data *byte, dataLen uint32) bool {
 	if nameLen <= 0 || nameLen > maxName {
 		return false
 	}
@@ -72,24 +94,26 @@ func Write(name *[maxName]byte, nameLen int, data *byte, dataLen uint32) bool {
 		}
 	}
 
-	e := &files[idx]
+	if !mem.PFAReady() {
+		return false
+	}
+	p, small := allocData(dataLen)
+	if p == 0 {
+		return false
+	}
 
-	// allocate a page if this is a new file
-	if !e.used {
-		if !mem.PFAReady() {
-			return false
-		}
-		p := mem.AllocPage()
-		if p == 0 {
-			return false
-		}
+	e := &files[idx]
+	if e.used {
+		freeData(e)
+	} else {
 		e.used = true
-		e.page = p
 		copyName(e, name, nameLen)
 	}
+	e.page = p
+	e.small = small
 
-	// copy data into the backing page (physical memory)
-	dstBase := uintptr(e.page)
+	// copy data into the new storage, through the direct map
+	dstBase := mem.PhysToVirt(e.page)
 	srcBase := uintptr(unsafe.Pointer(data))
 	for i := uint32(0); i < dataLen; i++ {
 		*(*byte)(unsafe.Pointer(dstBase + uintptr(i))) =
@@ -99,8 +123,15 @@ func Write(name *[maxName]byte, nameLen int, data *byte, dataLen uint32) bool {
 	return true
 }
 
-// Remove deletes a file and frees its backing page
+// Remove deletes a file and frees its contents
 func Remove(name *[maxName]byte, nameLen int) bool {
+	flags := filesLock.Lock()
+	ok := remove(name, nameLen)
+	filesLock.Unlock(flags)
+	return ok
+}
+
+func remove(name *[maxName]byte, nameLen int) bool {
 	idx := findByName(name, nameLen)
 	if idx < 0 {
 		return false
@@ -108,16 +139,41 @@ func Remove(name *[maxName]byte, nameLen int) bool {
 
 	e := &files[idx]
 	if e.used && e.page != 0 {
-		mem.FreePage(e.page)
+		freeData(e)
 	}
 
 	e.used = false
 	e.nameLen = 0
 	e.size = 0
 	e.page = 0
+	e.small = false
 	return true
 }
 
+// allocData returns the physical address of storage for n bytes: a slab
+// object for small files, a whole page otherwise or when the slab caches
+// are out of memory.
+func allocData(n uint32) (page uint64, small bool) {
+	if n <= slab.MaxSize {
+		size := uintptr(n)
+		if size == 0 {
+			size = 1
+		}
+		if p := slab.Alloc(size); p != nil {
+			return mem.VirtToPhys(uintptr(p)), true
+		}
+	}
+	return mem.AllocPage(), false
+}
+
+func freeData(e *fileEntry) {
+	if e.small {
+		slab.Free(unsafe.Pointer(mem.PhysToVirt(e.page)))
+	} else {
+		mem.FreePage(e.page)
+	}
+}
+
 func findFreeSlot() int {
 	for i := 0; i < maxFiles; i++ {
 		if !files[i].used {
@@ -10,6 +10,7 @@ func MockInit() {
 		files[i].nameLen = 0
 		files[i].size = 0
 		files[i].page = 0
+		files[i].small = false
 	}
 }
 
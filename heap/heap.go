@@ -0,0 +1,287 @@
+// Package heap is the kernel heap: a first-fit free-list allocator over a
+// virtual region of its own that grows one PFA page at a time, mapped
+// through the vmm. It also implements the runtime hooks gccgo emits for
+// new, make and append (runtime.newobject, runtime.makeslice and
+// runtime.growslice) and for maps (see maps.go); boot/stubs_amd64.s jumps
+// from those names here.
+//
+// Memory comes back zeroed. There is no garbage collector: a block stays
+// allocated until it is handed to Free, and the array append leaves
+// behind when it grows a slice is never freed, since other slices may
+// still share it. A map gives its old arrays back as it grows.
+package heap
+
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+	"github.com/dmarro89/go-dav-os/mem"
+	"github.com/dmarro89/go-dav-os/terminal"
+	"github.com/dmarro89/go-dav-os/vmm"
+)
+
+// Assembly hook (boot/stubs_amd64.s): disables interrupts and halts.
+func stop()
+
+const (
+	// Region is the virtual region the heap grows into (see the vmm
+	// package doc for the whole layout).
+	Region     = 0xFFFFD00000000000
+	RegionSize = 1 << 32
+
+	pageSize = 4096
+
+	// every block starts with a header and is a multiple of blockAlign,
+	// so payloads are blockAlign aligned
+	headerSize = 16
+	blockAlign = 16
+	minBlock   = headerSize + blockAlign
+
+	// header.next of a block that is handed out is its own address xor
+	// usedMagic: never a free-list link (0 or an address in the region),
+	// and not what a stray pointer into a payload finds before it
+	usedMagic = 0x6865617055534544
+)
+
+// header precedes every block, free or in use. Free blocks are linked in
+// address order so Free can merge neighbours.
+type header struct {
+	size uintptr // whole block, header included
+	next uintptr // next free block, or the used mark
+}
+
+// Stats is a snapshot of the heap for the heap shell command.
+type Stats struct {
+	Mapped uintptr // bytes mapped into the region
+	Used   uintptr // bytes in allocated blocks, headers included
+	Allocs uint64  // successful Alloc calls
+	Frees  uint64  // successful Free calls
+}
+
+var (
+	ready bool
+	base  uintptr = Region
+	limit uintptr = Region + RegionSize
+	top   uintptr // end of the mapped part of the region
+	free  uintptr // first free block
+
+	used   uintptr
+	allocs uint64
+	frees  uint64
+
+	lock sync.IRQSpinLock
+
+	// maps a fresh zero page at virt; nil means a PFA page through the
+	// vmm. Tests back the region with ordinary memory.
+	mapPage func(virt uintptr) bool
+
+	// what zero-sized allocations point to
+	zerobase uintptr
+
+	// runs before a failed request stops the CPU
+	stopHook func()
+)
+
+// Init opens the heap. The vmm must be running: heap pages are mapped
+// into its page tables, which every CPU shares.
+func Init() bool {
+	if ready || !vmm.Ready() {
+		return false
+	}
+	top = base
+	free = 0
+	ready = true
+	return true
+}
+
+// SetStopHook installs a function that runs on the CPU a failed runtime
+// request is about to stop, before it halts.
+func SetStopHook(fn func()) { stopHook = fn }
+
+// Ready reports whether Init succeeded.
+func Ready() bool { return ready }
+
+// Alloc returns size zeroed bytes, 16 byte aligned, or nil if the heap is
+// not ready or out of memory. A zero size returns a shared non-nil
+// pointer that must not be written.
+func Alloc(size uintptr) unsafe.Pointer {
+	if size == 0 {
+		return unsafe.Pointer(&zerobase)
+	}
+	if !ready || size > limit-base {
+		return nil
+	}
+	need := (size + headerSize + blockAlign - 1) &^ (blockAlign - 1)
+	f := lock.Lock()
+	b := take(need)
+	if b == 0 && grow(need) {
+		b = take(need)
+	}
+	if b != 0 {
+		used += hdr(b).size
+		allocs++
+	}
+	lock.Unlock(f)
+	if b == 0 {
+		return nil
+	}
+	p := b + headerSize
+	zero(p, hdr(b).size-headerSize)
+	return unsafe.Pointer(p)
+}
+
+// Free returns a block obtained from Alloc (or new, make and append) to
+// the heap and merges it with free neighbours. It reports false for
+// pointers the heap did not hand out and for blocks already free.
+func Free(p unsafe.Pointer) bool {
+	addr := uintptr(p)
+	if !ready || addr < base+headerSize || addr >= top || addr%blockAlign != 0 {
+		return false
+	}
+	b := addr - headerSize
+	f := lock.Lock()
+	ok := isUsed(b)
+	if ok {
+		used -= hdr(b).size
+		frees++
+		insert(b)
+	}
+	lock.Unlock(f)
+	return ok
+}
+
+// ReadStats fills s with the current heap statistics.
+func ReadStats(s *Stats) {
+	f := lock.Lock()
+	s.Mapped = top - base
+	s.Used = used
+	s.Allocs = allocs
+	s.Frees = frees
+	lock.Unlock(f)
+}
+
+// isUsed reports whether b starts a block that is handed out: its header
+// carries the used mark and a size that fits the region. Called with lock
+// held.
+func isUsed(b uintptr) bool {
+	h := hdr(b)
+	return h.next == b^usedMagic && h.size >= minBlock &&
+		h.size%blockAlign == 0 && h.size <= top-b
+}
+
+func hdr(b uintptr) *header {
+	return (*header)(unsafe.Pointer(b))
+}
+
+// take unlinks the first free block of at least need bytes, splitting off
+// the rest when it is large enough to be a block. Called with lock held.
+func take(need uintptr) uintptr {
+	prev := uintptr(0)
+	for b := free; b != 0; b = hdr(b).next {
+		h := hdr(b)
+		if h.size < need {
+			prev = b
+			continue
+		}
+		next := h.next
+		if h.size-need >= minBlock {
+			rest := b + need
+			hdr(rest).size = h.size - need
+			hdr(rest).next = next
+			next = rest
+			h.size = need
+		}
+		if prev == 0 {
+			free = next
+		} else {
+			hdr(prev).next = next
+		}
+		h.next = b ^ usedMagic
+		return b
+	}
+	return 0
+}
+
+// insert links the block b into the free list, merging it with the blocks
+// right before and after it. Called with lock held.
+func insert(b uintptr) {
+	prev := uintptr(0)
+	next := free
+	for next != 0 && next < b {
+		prev = next
+		next = hdr(next).next
+	}
+	h := hdr(b)
+	h.next = next
+	if next != 0 && b+h.size == next {
+		h.size += hdr(next).size
+		h.next = hdr(next).next
+	}
+	if prev == 0 {
+		free = b
+		return
+	}
+	p := hdr(prev)
+	if prev+p.size == b {
+		p.size += h.size
+		p.next = h.next
+		return
+	}
+	p.next = b
+}
+
+// grow maps enough pages at the top of the region for a block of need
+// bytes and frees them into the list, where they join a free block that
+// ends at the old top. Called with lock held.
+func grow(need uintptr) bool {
+	size := (need + pageSize - 1) &^ (pageSize - 1)
+	if size > limit-top {
+		return false
+	}
+	start := top
+	for top < start+size {
+		if !mapOne(top) {
+			break
+		}
+		top += pageSize
+	}
+	if top == start {
+		return false
+	}
+	hdr(start).size = top - start
+	insert(start)
+	return top-start == size
+}
+
+func mapOne(virt uintptr) bool {
+	if mapPage != nil {
+		return mapPage(virt)
+	}
+	phys := mem.AllocPage()
+	if phys == 0 {
+		return false
+	}
+	if !vmm.Map(virt, uintptr(phys), vmm.FlagWrite|vmm.FlagNoExec) {
+		mem.FreePage(phys)
+		return false
+	}
+	return true
+}
+
+func zero(p, n uintptr) {
+	for i := uintptr(0); i < n; i += 8 {
+		*(*uint64)(unsafe.Pointer(p + i)) = 0
+	}
+}
+
+// fail reports a heap request the runtime cannot return from and stops
+// the CPU; gccgo code never checks new or make for nil.
+func fail(msg string) {
+	terminal.Print("\nheap: ")
+	terminal.Print(msg)
+	terminal.PutRune('\n')
+	if stopHook != nil {
+		stopHook()
+	}
+	stop()
+}
@@ -0,0 +1,338 @@
+package heap
+
+import (
+	"testing"
+	"unsafe"
+)
+
+const testPages = 16
+
+// testRegion backs the heap in tests; mockInit points the region at its
+// first page-aligned address and testMapPage "maps" pages inside it.
+var testRegion [(testPages + 1) * pageSize]byte
+
+func testMapPage(virt uintptr) bool {
+	return virt+pageSize <= limit
+}
+
+func mockInit(t *testing.T) {
+	base = (uintptr(unsafe.Pointer(&testRegion[0])) + pageSize - 1) &^ (pageSize - 1)
+	limit = base + testPages*pageSize
+	for i := range testRegion {
+		testRegion[i] = 0xAA
+	}
+	top = base
+	free = 0
+	used, allocs, frees = 0, 0, 0
+	mapPage = testMapPage
+	ready = true
+}
+
+func TestAllocZeroedAndAligned(t *testing.T) {
+	mockInit(t)
+
+	p := Alloc(10)
+	if p == nil {
+		t.Fatalf("Expected Alloc to succeed")
+	}
+	if uintptr(p)%blockAlign != 0 {
+		t.Errorf("Expected %d byte alignment, got %#x", blockAlign, uintptr(p))
+	}
+	b := (*[16]byte)(p)
+	for i, v := range b {
+		if v != 0 {
+			t.Errorf("Expected byte %d to be zeroed, got %#x", i, v)
+		}
+	}
+	q := Alloc(10)
+	if uintptr(q) != uintptr(p)+32 {
+		t.Errorf("Expected the next block right after the first, got %#x and %#x", uintptr(p), uintptr(q))
+	}
+
+	var st Stats
+	ReadStats(&st)
+	if st.Mapped != pageSize || st.Used != 64 || st.Allocs != 2 {
+		t.Errorf("Expected 1 page mapped, 64 bytes used and 2 allocs, got %+v", st)
+	}
+}
+
+func TestAllocZeroSize(t *testing.T) {
+	mockInit(t)
+
+	if p := Alloc(0); p != unsafe.Pointer(&zerobase) {
+		t.Errorf("Expected zero-size allocations to share zerobase, got %#x", uintptr(p))
+	}
+	if Free(unsafe.Pointer(&zerobase)) {
+		t.Errorf("Expected Free of zerobase to fail")
+	}
+	if top != base {
+		t.Errorf("Expected nothing mapped for a zero-size allocation")
+	}
+}
+
+func TestAllocNotReady(t *testing.T) {
+	mockInit(t)
+	ready = false
+	defer func() { ready = true }()
+
+	if Alloc(8) != nil {
+		t.Errorf("Expected Alloc to fail before Init")
+	}
+}
+
+func TestFreeReusesAndMerges(t *testing.T) {
+	mockInit(t)
+
+	a := Alloc(100)
+	b := Alloc(100)
+	c := Alloc(100)
+	if a == nil || b == nil || c == nil {
+		t.Fatalf("Expected three allocations")
+	}
+	if !Free(b) {
+		t.Fatalf("Expected Free to succeed")
+	}
+	if Free(b) {
+		t.Errorf("Expected a double Free to fail")
+	}
+	if Free(unsafe.Pointer(uintptr(b) + 16)) {
+		t.Errorf("Expected Free of an interior pointer to fail")
+	}
+	// a header-like pair of words inside a block lacks the used mark
+	forged := (*header)(unsafe.Pointer(uintptr(c) + 16))
+	forged.size, forged.next = 32, 1
+	if Free(unsafe.Pointer(uintptr(c) + 32)) {
+		t.Errorf("Expected Free past a forged header to fail")
+	}
+	if d := Alloc(50); d != b {
+		t.Errorf("Expected the freed block to be reused, got %#x want %#x", uintptr(d), uintptr(b))
+	}
+
+	Free(a)
+	Free(b)
+	Free(c)
+	if free != base || hdr(base).size != pageSize || hdr(base).next != 0 {
+		t.Errorf("Expected one free block spanning the page, got %#x size %d", free, hdr(free).size)
+	}
+	var st Stats
+	ReadStats(&st)
+	if st.Used != 0 || st.Frees != 4 {
+		t.Errorf("Expected nothing used after 4 frees, got %+v", st)
+	}
+}
+
+func TestGrowAcrossPages(t *testing.T) {
+	mockInit(t)
+
+	p := Alloc(3 * pageSize)
+	if p == nil {
+		t.Fatalf("Expected a multi-page allocation to succeed")
+	}
+	if top-base != 4*pageSize {
+		t.Errorf("Expected 4 pages mapped, got %d bytes", top-base)
+	}
+	// the tail of the last page joins the free list
+	q := Alloc(pageSize / 2)
+	if q == nil || uintptr(q) >= top {
+		t.Errorf("Expected the tail of the mapped pages to be used, got %#x", uintptr(q))
+	}
+	if Alloc(testPages*pageSize) != nil {
+		t.Errorf("Expected an allocation larger than the region to fail")
+	}
+}
+
+func TestNewObjectAndMakeSlice(t *testing.T) {
+	mockInit(t)
+
+	typ := rtype{size: 24, align: 8}
+	p := newobject(&typ)
+	if p == nil || uintptr(p) < base || uintptr(p) >= top {
+		t.Fatalf("Expected newobject to allocate from the heap, got %#x", uintptr(p))
+	}
+
+	et := rtype{size: 8, align: 8}
+	arr := makeslice(&et, 3, 10)
+	if arr == nil {
+		t.Fatalf("Expected makeslice to succeed")
+	}
+	if size := hdr(uintptr(arr) - headerSize).size; size < 80+headerSize {
+		t.Errorf("Expected room for 10 elements, got a %d byte block", size)
+	}
+	if makeslice64(&et, 2, 4) == nil {
+		t.Errorf("Expected makeslice64 to succeed")
+	}
+}
+
+func TestGrowSlice(t *testing.T) {
+	mockInit(t)
+
+	et := rtype{size: 4, align: 4}
+	old := [4]uint32{1, 2, 3, 4}
+	s := growslice(&et, unsafe.Pointer(&old[0]), 4, 4, 5)
+	if s.len != 4 || s.cap != 8 {
+		t.Errorf("Expected len 4 cap 8, got len %d cap %d", s.len, s.cap)
+	}
+	got := (*[8]uint32)(s.array)
+	for i := 0; i < 4; i++ {
+		if got[i] != old[i] {
+			t.Errorf("Expected element %d to be copied, got %d want %d", i, got[i], old[i])
+		}
+	}
+	if got[4] != 0 {
+		t.Errorf("Expected new elements to be zeroed, got %d", got[4])
+	}
+
+	s = growslice(&et, s.array, 8, 8, 20)
+	if s.cap != 20 {
+		t.Errorf("Expected cap 20 when more than double is needed, got %d", s.cap)
+	}
+	s = growslice(&et, nil, 0, 512, 513)
+	if s.cap != 512+(512+3*256)/4 {
+		t.Errorf("Expected large slices to grow by about a quarter, got cap %d", s.cap)
+	}
+
+	zero := rtype{}
+	if s := growslice(&zero, nil, 1, 1, 2); s.array != unsafe.Pointer(&zerobase) || s.cap != 2 {
+		t.Errorf("Expected zero-size elements to use zerobase, got %#x cap %d", uintptr(s.array), s.cap)
+	}
+}
+
+func testMapType(key, elem uintptr, kind uint8) *maptype {
+	return &maptype{
+		key:  &rtype{size: key, align: uint8(key), kind: kind},
+		elem: &rtype{size: elem, align: uint8(elem)},
+	}
+}
+
+func TestMapAssignAccessDelete(t *testing.T) {
+	mockInit(t)
+
+	mt := testMapType(8, 8, 0)
+	h := makemap_small()
+	for k := uint64(0); k < 100; k++ {
+		*(*uint64)(mapassign_fast64(mt, h, k)) = k * 10
+	}
+	if h.count != 100 {
+		t.Errorf("Expected 100 entries, got %d", h.count)
+	}
+	for k := uint64(0); k < 100; k++ {
+		p, ok := mapaccess2_fast64(mt, h, k)
+		if !ok || *(*uint64)(p) != k*10 {
+			t.Errorf("Expected key %d to hold %d, got %d (found %v)", k, k*10, *(*uint64)(p), ok)
+		}
+	}
+	if p, ok := mapaccess2_fast64(mt, h, 100); ok || *(*uint64)(p) != 0 {
+		t.Errorf("Expected a missing key to return the zero value")
+	}
+
+	*(*uint64)(mapassign_fast64(mt, h, 7)) = 1
+	if h.count != 100 || *(*uint64)(mapaccess1_fast64(mt, h, 7)) != 1 {
+		t.Errorf("Expected assigning an existing key to overwrite it")
+	}
+
+	for k := uint64(0); k < 100; k += 2 {
+		mapdelete_fast64(mt, h, k)
+	}
+	mapdelete_fast64(mt, h, 0)
+	if h.count != 50 {
+		t.Errorf("Expected 50 entries after deleting the even keys, got %d", h.count)
+	}
+	if _, ok := mapaccess2_fast64(mt, h, 4); ok {
+		t.Errorf("Expected a deleted key to be gone")
+	}
+	used := h.used
+	*(*uint64)(mapassign_fast64(mt, h, 4)) = 44
+	if h.used != used || *(*uint64)(mapaccess1_fast64(mt, h, 4)) != 44 {
+		t.Errorf("Expected a deleted entry to be reused")
+	}
+
+	mapclear(mt, h)
+	if h.count != 0 {
+		t.Errorf("Expected mapclear to empty the map, got %d entries", h.count)
+	}
+	if _, ok := mapaccess2_fast64(mt, h, 1); ok {
+		t.Errorf("Expected no key after mapclear")
+	}
+}
+
+func TestMapStringKeys(t *testing.T) {
+	mockInit(t)
+
+	mt := testMapType(16, 8, kindString)
+	var stack hmap
+	h := makemap(mt, 4, &stack)
+	if h != &stack {
+		t.Errorf("Expected makemap to use the header it is given")
+	}
+	*(*int)(mapassign_faststr(mt, h, "ping")) = 1
+	*(*int)(mapassign_faststr(mt, h, "pong")) = 2
+
+	// same contents, different backing array
+	key := string([]byte{'p', 'o', 'n', 'g'})
+	if p, ok := mapaccess2_faststr(mt, h, key); !ok || *(*int)(p) != 2 {
+		t.Errorf("Expected string keys to match by contents")
+	}
+	if _, ok := mapaccess2_faststr(mt, h, "pon"); ok {
+		t.Errorf("Expected a prefix not to match")
+	}
+	mapdelete_faststr(mt, h, key)
+	if h.count != 1 {
+		t.Errorf("Expected 1 entry after delete, got %d", h.count)
+	}
+}
+
+func TestMapIterate(t *testing.T) {
+	mockInit(t)
+
+	mt := testMapType(4, 2, 0)
+	h := makemap(mt, 0, nil)
+	for k := uint32(1); k <= 20; k++ {
+		*(*uint16)(mapassign_fast32(mt, h, k)) = uint16(k)
+	}
+	mapdelete_fast32(mt, h, 5)
+
+	var it hiter
+	n, sum := 0, uint32(0)
+	for mapiterinit(mt, h, &it); it.key != nil; mapiternext(&it) {
+		k := *(*uint32)(it.key)
+		if v := *(*uint16)(it.elem); uint32(v) != k {
+			t.Errorf("Expected key %d to hold %d, got %d", k, k, v)
+		}
+		if k == 10 {
+			mapdelete_fast32(mt, h, 15)
+		}
+		n++
+		sum += k
+	}
+	if n != 18 || sum != 210-5-15 {
+		t.Errorf("Expected 18 keys summing to %d, got %d summing to %d", 210-5-15, n, sum)
+	}
+
+	mapiterinit(mt, nil, &it)
+	if it.key != nil {
+		t.Errorf("Expected a nil map to have no keys")
+	}
+}
+
+func TestMapGrowFreesOldArrays(t *testing.T) {
+	mockInit(t)
+
+	mt := testMapType(8, 8, 0)
+	h := makemap_small()
+	for k := uint64(0); k < minEntries; k++ {
+		mapassign_fast64(mt, h, k)
+	}
+	var before Stats
+	ReadStats(&before)
+	mapassign_fast64(mt, h, minEntries)
+	var after Stats
+	ReadStats(&after)
+	if h.nentry != 2*minEntries || after.Frees != before.Frees+2 {
+		t.Errorf("Expected growth to %d entries freeing both old arrays, got %d and %d frees", 2*minEntries, h.nentry, after.Frees-before.Frees)
+	}
+	for k := uint64(0); k <= minEntries; k++ {
+		if _, ok := mapaccess2_fast64(mt, h, k); !ok {
+			t.Errorf("Expected key %d to survive growth", k)
+		}
+	}
+}
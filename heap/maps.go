@@ -0,0 +1,437 @@
+package heap
+
+import "unsafe"
+
+// Maps. gccgo lowers make, index, assignment, delete, clear and range on
+// maps to runtime calls, implemented here with gccgo's signatures.
+//
+// A map keeps its entries in one array that only grows: freed entries are
+// reused, never moved down, so a range loop (a walk over the array) is
+// not thrown off by inserts and deletes in its body. Entries are chained
+// from a power-of-two bucket table by hash. Both arrays come from Alloc
+// and go back to Free when they are outgrown; a map header allocated by
+// make is never freed.
+//
+// Keys are hashed and compared byte for byte, strings by their contents.
+// That is right for integers, pointers, channels and structs or arrays of
+// those without padding; +0 and -0 are different float keys and NaN finds
+// itself. Interface keys are not supported.
+
+// maptype mirrors gccgo's runtime.maptype up to the key and element
+// types: a full _type, then the two type pointers.
+type maptype struct {
+	typ  rtype
+	_    [5]uintptr // equal, gcdata, _string, uncommontype, ptrToThis
+	key  *rtype
+	elem *rtype
+}
+
+// hmap is the map header. The compiler reads count for len(m), and places
+// the header of a map that does not escape on the stack, sized for
+// gccgo's own hmap (48 bytes), so this one must not grow past that.
+type hmap struct {
+	count   int
+	buckets uintptr // chain heads: entry index + 1, 0 ends a chain
+	entries uintptr
+	nbucket uint32 // power of two, as many as entries
+	nentry  uint32 // entries allocated
+	used    uint32 // entries handed out so far, live or freed
+	free    uint32 // first freed entry + 1
+}
+
+// entry heads every slot of the entry array; the key and the element
+// follow it.
+type entry struct {
+	hash uintptr
+	next uint32 // next entry + 1 in the bucket chain or the free list
+	live bool
+}
+
+// hiter mirrors the head of the iterator the compiler reserves for a
+// range loop (12 words in gccgo). It reads key and elem after every
+// mapiternext; a nil key ends the loop.
+type hiter struct {
+	key  unsafe.Pointer
+	elem unsafe.Pointer
+	t    *maptype
+	h    *hmap
+	next uint32 // entry to look at next
+}
+
+type stringHeader struct {
+	data uintptr
+	len  int
+}
+
+const (
+	entryHead = unsafe.Sizeof(entry{})
+
+	kindMask      = 1<<5 - 1
+	kindInterface = 20
+	kindString    = 24
+
+	// largest element mapaccess1 and mapaccess2 return a zero value
+	// for; the compiler passes its own for bigger ones (the _fat calls)
+	maxZero = 1024
+
+	minEntries = 8
+
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+var zeroVal [maxZero]byte
+
+// makemap implements runtime.makemap. h is the header the compiler put on
+// the stack, or nil.
+func makemap(t *maptype, hint int, h *hmap) *hmap {
+	if h == nil {
+		h = (*hmap)(mustAlloc(unsafe.Sizeof(hmap{})))
+	} else {
+		*h = hmap{}
+	}
+	if hint > 0 && !fits(t.entrySize(), hint) {
+		fail("makemap: size out of range")
+		return nil
+	}
+	if hint > 0 {
+		h.grow(t, uint32(hint))
+	}
+	return h
+}
+
+// makemap64 implements runtime.makemap64, used when the hint has a
+// 64-bit type.
+func makemap64(t *maptype, hint int64, h *hmap) *hmap {
+	if int64(int(hint)) != hint {
+		fail("makemap: size out of range")
+		return nil
+	}
+	return makemap(t, int(hint), h)
+}
+
+// makemap_small implements runtime.makemap_small, for make(map[K]V) and
+// small map literals.
+func makemap_small() *hmap {
+	return (*hmap)(mustAlloc(unsafe.Sizeof(hmap{})))
+}
+
+// mapaccess1 implements runtime.mapaccess1 for v := m[k]: it returns the
+// element, or a zero value if k is missing.
+func mapaccess1(t *maptype, h *hmap, key unsafe.Pointer) unsafe.Pointer {
+	p, _ := mapaccess2(t, h, key)
+	return p
+}
+
+// mapaccess2 implements runtime.mapaccess2 for v, ok := m[k].
+func mapaccess2(t *maptype, h *hmap, key unsafe.Pointer) (unsafe.Pointer, bool) {
+	if e := h.find(t, key, hashKey(t.key, key)); e != 0 {
+		return unsafe.Pointer(e + t.elemOff()), true
+	}
+	return unsafe.Pointer(&zeroVal[0]), false
+}
+
+// mapaccess1_fat implements runtime.mapaccess1_fat, for elements larger
+// than maxZero.
+func mapaccess1_fat(t *maptype, h *hmap, key, zero unsafe.Pointer) unsafe.Pointer {
+	p, _ := mapaccess2_fat(t, h, key, zero)
+	return p
+}
+
+// mapaccess2_fat implements runtime.mapaccess2_fat.
+func mapaccess2_fat(t *maptype, h *hmap, key, zero unsafe.Pointer) (unsafe.Pointer, bool) {
+	if e := h.find(t, key, hashKey(t.key, key)); e != 0 {
+		return unsafe.Pointer(e + t.elemOff()), true
+	}
+	return zero, false
+}
+
+// mapassign implements runtime.mapassign for m[k] = v: it returns the
+// element of k, added zeroed if k was missing, for the caller to store v.
+func mapassign(t *maptype, h *hmap, key unsafe.Pointer) unsafe.Pointer {
+	if h == nil {
+		fail("assignment to entry in nil map")
+		return nil
+	}
+	hash := hashKey(t.key, key)
+	if e := h.find(t, key, hash); e != 0 {
+		return unsafe.Pointer(e + t.elemOff())
+	}
+
+	i := h.take(t)
+	e := h.entry(t, i)
+	en := (*entry)(unsafe.Pointer(e))
+	en.hash = hash
+	en.live = true
+	copyBytes(e+entryHead, uintptr(key), t.key.size)
+	head := h.head(hash)
+	en.next = *head
+	*head = i + 1
+	h.count++
+	return unsafe.Pointer(e + t.elemOff())
+}
+
+// mapdelete implements runtime.mapdelete for delete(m, k).
+func mapdelete(t *maptype, h *hmap, key unsafe.Pointer) {
+	if h == nil || h.count == 0 {
+		return
+	}
+	hash := hashKey(t.key, key)
+	for link := h.head(hash); *link != 0; {
+		i := *link - 1
+		e := h.entry(t, i)
+		en := (*entry)(unsafe.Pointer(e))
+		if en.hash != hash || !keyEqual(t.key, unsafe.Pointer(e+entryHead), key) {
+			link = &en.next
+			continue
+		}
+		*link = en.next
+		zero(e+entryHead, t.entrySize()-entryHead)
+		en.hash = 0
+		en.live = false
+		en.next = h.free
+		h.free = i + 1
+		h.count--
+		return
+	}
+}
+
+// mapclear implements runtime.mapclear, which a loop deleting every key
+// of a map is turned into.
+func mapclear(t *maptype, h *hmap) {
+	if h == nil || h.used == 0 {
+		return
+	}
+	zero(h.entries, uintptr(h.used)*t.entrySize())
+	zero(h.buckets, uintptr(h.nbucket)*4)
+	h.count = 0
+	h.used = 0
+	h.free = 0
+}
+
+// mapiterinit implements runtime.mapiterinit: it starts a range loop over
+// h and moves it to the first entry. Entries come in the order they were
+// added.
+func mapiterinit(t *maptype, h *hmap, it *hiter) {
+	it.t = t
+	it.h = h
+	it.next = 0
+	mapiternext(it)
+}
+
+// mapiternext implements runtime.mapiternext.
+func mapiternext(it *hiter) {
+	h := it.h
+	for h != nil && it.next < h.used {
+		e := h.entry(it.t, it.next)
+		it.next++
+		if (*entry)(unsafe.Pointer(e)).live {
+			it.key = unsafe.Pointer(e + entryHead)
+			it.elem = unsafe.Pointer(e + it.t.elemOff())
+			return
+		}
+	}
+	it.key = nil
+	it.elem = nil
+}
+
+// The variants gccgo calls for 4 byte, 8 byte and string keys, which pass
+// the key by value.
+
+func mapaccess1_fast32(t *maptype, h *hmap, key uint32) unsafe.Pointer {
+	return mapaccess1(t, h, unsafe.Pointer(&key))
+}
+
+func mapaccess2_fast32(t *maptype, h *hmap, key uint32) (unsafe.Pointer, bool) {
+	return mapaccess2(t, h, unsafe.Pointer(&key))
+}
+
+func mapassign_fast32(t *maptype, h *hmap, key uint32) unsafe.Pointer {
+	return mapassign(t, h, unsafe.Pointer(&key))
+}
+
+func mapassign_fast32ptr(t *maptype, h *hmap, key unsafe.Pointer) unsafe.Pointer {
+	return mapassign(t, h, unsafe.Pointer(&key))
+}
+
+func mapdelete_fast32(t *maptype, h *hmap, key uint32) {
+	mapdelete(t, h, unsafe.Pointer(&key))
+}
+
+func mapaccess1_fast64(t *maptype, h *hmap, key uint64) unsafe.Pointer {
+	return mapaccess1(t, h, unsafe.Pointer(&key))
+}
+
+func mapaccess2_fast64(t *maptype, h *hmap, key uint64) (unsafe.Pointer, bool) {
+	return mapaccess2(t, h, unsafe.Pointer(&key))
+}
+
+func mapassign_fast64(t *maptype, h *hmap, key uint64) unsafe.Pointer {
+	return mapassign(t, h, unsafe.Pointer(&key))
+}
+
+func mapassign_fast64ptr(t *maptype, h *hmap, key unsafe.Pointer) unsafe.Pointer {
+	return mapassign(t, h, unsafe.Pointer(&key))
+}
+
+func mapdelete_fast64(t *maptype, h *hmap, key uint64) {
+	mapdelete(t, h, unsafe.Pointer(&key))
+}
+
+func mapaccess1_faststr(t *maptype, h *hmap, key string) unsafe.Pointer {
+	return mapaccess1(t, h, unsafe.Pointer(&key))
+}
+
+func mapaccess2_faststr(t *maptype, h *hmap, key string) (unsafe.Pointer, bool) {
+	return mapaccess2(t, h, unsafe.Pointer(&key))
+}
+
+func mapassign_faststr(t *maptype, h *hmap, key string) unsafe.Pointer {
+	return mapassign(t, h, unsafe.Pointer(&key))
+}
+
+func mapdelete_faststr(t *maptype, h *hmap, key string) {
+	mapdelete(t, h, unsafe.Pointer(&key))
+}
+
+// elemOff is the offset of the element in an entry.
+func (t *maptype) elemOff() uintptr {
+	return alignUp(entryHead+t.key.size, uintptr(t.elem.align))
+}
+
+// entrySize is the size of an entry, a multiple of 8 and of the key and
+// element alignment.
+func (t *maptype) entrySize() uintptr {
+	a := uintptr(8)
+	if uintptr(t.key.align) > a {
+		a = uintptr(t.key.align)
+	}
+	if uintptr(t.elem.align) > a {
+		a = uintptr(t.elem.align)
+	}
+	return alignUp(t.elemOff()+t.elem.size, a)
+}
+
+func (h *hmap) entry(t *maptype, i uint32) uintptr {
+	return h.entries + uintptr(i)*t.entrySize()
+}
+
+func (h *hmap) head(hash uintptr) *uint32 {
+	return (*uint32)(unsafe.Pointer(h.buckets + (hash&uintptr(h.nbucket-1))*4))
+}
+
+// find returns the live entry holding key, or 0.
+func (h *hmap) find(t *maptype, key unsafe.Pointer, hash uintptr) uintptr {
+	if h == nil || h.count == 0 {
+		return 0
+	}
+	for i := *h.head(hash); i != 0; {
+		e := h.entry(t, i-1)
+		en := (*entry)(unsafe.Pointer(e))
+		if en.hash == hash && keyEqual(t.key, unsafe.Pointer(e+entryHead), key) {
+			return e
+		}
+		i = en.next
+	}
+	return 0
+}
+
+// take returns the index of an unused entry, a freed one if there is one,
+// growing the map when all are handed out.
+func (h *hmap) take(t *maptype) uint32 {
+	if h.free != 0 {
+		i := h.free - 1
+		h.free = (*entry)(unsafe.Pointer(h.entry(t, i))).next
+		return i
+	}
+	if h.used == h.nentry {
+		n := 2 * h.nentry
+		if n < minEntries {
+			n = minEntries
+		}
+		if !fits(t.entrySize(), int(n)) {
+			fail("map: too many entries")
+		}
+		h.grow(t, n)
+	}
+	i := h.used
+	h.used++
+	return i
+}
+
+// grow moves the entries to an array of at least n and rebuilds the
+// bucket table to match. Entries keep their index.
+func (h *hmap) grow(t *maptype, n uint32) {
+	size := uint32(minEntries)
+	for size < n {
+		size *= 2
+	}
+	if size <= h.nentry {
+		return
+	}
+	entries := uintptr(mustAlloc(uintptr(size) * t.entrySize()))
+	buckets := uintptr(mustAlloc(uintptr(size) * 4))
+	if h.entries != 0 {
+		copyBytes(entries, h.entries, uintptr(h.used)*t.entrySize())
+		Free(unsafe.Pointer(h.entries))
+		Free(unsafe.Pointer(h.buckets))
+	}
+	h.entries = entries
+	h.buckets = buckets
+	h.nentry = size
+	h.nbucket = size
+
+	for i := uint32(0); i < h.used; i++ {
+		en := (*entry)(unsafe.Pointer(h.entry(t, i)))
+		if !en.live {
+			continue
+		}
+		head := h.head(en.hash)
+		en.next = *head
+		*head = i + 1
+	}
+}
+
+// keyBytes returns the bytes of key that make up its value.
+func keyBytes(k *rtype, key unsafe.Pointer) (uintptr, uintptr) {
+	switch k.kind & kindMask {
+	case kindString:
+		s := (*stringHeader)(key)
+		return s.data, uintptr(s.len)
+	case kindInterface:
+		fail("map: interface keys are not supported")
+	}
+	return uintptr(key), k.size
+}
+
+// hashKey is FNV-1a over the bytes of key.
+func hashKey(k *rtype, key unsafe.Pointer) uintptr {
+	p, n := keyBytes(k, key)
+	h := uintptr(fnvOffset)
+	for i := uintptr(0); i < n; i++ {
+		h ^= uintptr(*(*byte)(unsafe.Pointer(p + i)))
+		h *= fnvPrime
+	}
+	return h
+}
+
+func keyEqual(k *rtype, a, b unsafe.Pointer) bool {
+	pa, na := keyBytes(k, a)
+	pb, nb := keyBytes(k, b)
+	if na != nb {
+		return false
+	}
+	for i := uintptr(0); i < na; i++ {
+		if *(*byte)(unsafe.Pointer(pa + i)) != *(*byte)(unsafe.Pointer(pb + i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func alignUp(n, a uintptr) uintptr {
+	if a == 0 {
+		return n
+	}
+	return (n + a - 1) &^ (a - 1)
+}
@@ -0,0 +1,111 @@
+package heap
+
+import "unsafe"
+
+// rtype mirrors the head of gccgo's runtime._type, which the compiler
+// passes to the allocation hooks.
+type rtype struct {
+	size       uintptr
+	ptrdata    uintptr
+	hash       uint32
+	tflag      uint8
+	align      uint8
+	fieldAlign uint8
+	kind       uint8
+}
+
+// slice is the layout of a slice header, as growslice returns it.
+type slice struct {
+	array unsafe.Pointer
+	len   int
+	cap   int
+}
+
+// maxAlloc bounds a single allocation: the size of the region.
+const maxAlloc = RegionSize
+
+// newobject implements runtime.newobject, used for new(T), &T{} and
+// anything else that escapes to the heap.
+func newobject(typ *rtype) unsafe.Pointer {
+	return mustAlloc(typ.size)
+}
+
+// makeslice implements runtime.makeslice for make([]T, len, cap) and
+// returns the backing array.
+func makeslice(et *rtype, len, cap int) unsafe.Pointer {
+	if len < 0 || len > cap || !fits(et.size, cap) {
+		fail("makeslice: len out of range")
+		return nil
+	}
+	return mustAlloc(et.size * uintptr(cap))
+}
+
+// makeslice64 implements runtime.makeslice64, used when len or cap has a
+// 64-bit type.
+func makeslice64(et *rtype, len64, cap64 int64) unsafe.Pointer {
+	len := int(len64)
+	cap := int(cap64)
+	if int64(len) != len64 || int64(cap) != cap64 {
+		fail("makeslice: len out of range")
+		return nil
+	}
+	return makeslice(et, len, cap)
+}
+
+// growslice implements runtime.growslice with gccgo's signature: append
+// calls it when the old array is too small for cap elements. The old
+// elements are copied to a new array; the caller sets the new length.
+// Growth follows the Go runtime: double small slices, grow large ones by
+// about a quarter.
+func growslice(et *rtype, oldArray unsafe.Pointer, oldLen, oldCap, cap int) slice {
+	if cap < oldCap || !fits(et.size, cap) {
+		fail("growslice: cap out of range")
+		return slice{}
+	}
+	if et.size == 0 {
+		return slice{unsafe.Pointer(&zerobase), oldLen, cap}
+	}
+
+	newCap := oldCap
+	if double := oldCap + oldCap; cap > double {
+		newCap = cap
+	} else if oldCap < 256 {
+		newCap = double
+	} else {
+		for 0 < newCap && newCap < cap {
+			newCap += (newCap + 3*256) / 4
+		}
+		if newCap <= 0 {
+			newCap = cap
+		}
+	}
+	if !fits(et.size, newCap) {
+		newCap = cap
+	}
+
+	p := mustAlloc(et.size * uintptr(newCap))
+	copyBytes(uintptr(p), uintptr(oldArray), et.size*uintptr(oldLen))
+	return slice{p, oldLen, newCap}
+}
+
+// fits reports whether n elements of size bytes make a valid allocation.
+func fits(size uintptr, n int) bool {
+	if n < 0 {
+		return false
+	}
+	return size == 0 || uintptr(n) <= maxAlloc/size
+}
+
+func mustAlloc(size uintptr) unsafe.Pointer {
+	p := Alloc(size)
+	if p == nil {
+		fail("out of memory")
+	}
+	return p
+}
+
+func copyBytes(dst, src, n uintptr) {
+	for i := uintptr(0); i < n; i++ {
+		*(*byte)(unsafe.Pointer(dst + i)) = *(*byte)(unsafe.Pointer(src + i))
+	}
+}
@@ -0,0 +1,199 @@
+package kernel
+
+import "github.com/dmarro89/go-dav-os/mem"
+
+// Assembly hooks (boot/stubs_amd64.s)
+func cpuid(leaf, subleaf uint32, out *[4]uint32)
+func rdmsr(msr uint32) uint64
+func wrmsr(msr uint32, val uint64)
+func mmioRead32(addr uintptr) uint32
+func mmioWrite32(addr uintptr, val uint32)
+func getSpuriousStubAddr() uint64
+func getReschedStubAddr() uint64
+
+const (
+	msrAPICBase      = 0x1B
+	apicBaseEnable   = 1 << 11
+	apicBaseAddrMask = 0xFFFFFF000
+
+	cpuidFeatAPIC = 1 << 9 // CPUID.01h:EDX
+
+	// Local APIC register offsets
+	lapicRegID          = 0x020
+	lapicRegTPR         = 0x080
+	lapicRegEOI         = 0x0B0
+	lapicRegSVR         = 0x0F0
+	lapicRegICRLow      = 0x300
+	lapicRegICRHigh     = 0x310
+	lapicRegLVTTimer    = 0x320
+	lapicRegLVTLINT0    = 0x350
+	lapicRegLVTLINT1    = 0x360
+	lapicRegLVTError    = 0x370
+	lapicRegTimerInit   = 0x380
+	lapicRegTimerCount  = 0x390
+	lapicRegTimerDivide = 0x3E0
+
+	lapicSVREnable    = 1 << 8
+	lvtMasked         = 1 << 16
+	lvtTimerPeriodic  = 1 << 17
+	lvtDeliveryNMI    = 0x4 << 8
+	timerDivideBy16   = 0x3
+	spuriousVector    = 0xFF
+	reschedVector     = 0xF0 // kickCPU
+	lapicCalibrateUs  = 10000
+	lapicTimerVector  = irqBase + IRQTimer
+	lapicMaxTimerInit = 0xFFFFFFFF
+)
+
+var (
+	useAPIC   bool
+	lapicBase uintptr
+
+	// LAPIC timer counts (divide by 16) per calibration interval
+	lapicCountsPerCal uint32
+
+	// tick rate of the LAPIC timer, shared by every CPU, and the initial
+	// count that produces it
+	timerHz        uint32
+	lapicTickCount uint32
+
+	// local APIC input wired to NMI, from the MADT
+	nmiLINT uint8 = 1
+)
+
+// APICSupported reports whether CPUID advertises a local APIC.
+func APICSupported() bool {
+	var r [4]uint32
+	cpuid(1, 0, &r)
+	return r[3]&cpuidFeatAPIC != 0
+}
+
+// APICEnabled reports whether interrupts are routed through LAPIC/IOAPIC
+// instead of the legacy 8259 pair.
+func APICEnabled() bool { return useAPIC }
+
+func lapicRead(reg uintptr) uint32 {
+	return mmioRead32(lapicBase + reg)
+}
+
+func lapicWrite(reg uintptr, v uint32) {
+	mmioWrite32(lapicBase+reg, v)
+}
+
+// LAPICID returns the APIC ID of the executing CPU.
+func LAPICID() uint8 {
+	if lapicBase == 0 {
+		return 0
+	}
+	return uint8(lapicRead(lapicRegID) >> 24)
+}
+
+// InitAPIC switches interrupt delivery from the 8259s to the local APIC
+// and IOAPIC. It returns false (and leaves the PIC in charge) if the CPU
+// has no APIC or no IOAPIC is usable.
+func InitAPIC() bool {
+	if !APICSupported() {
+		return false
+	}
+
+	base := rdmsr(msrAPICBase)
+	lapicBase = mem.PhysToVirt(base & apicBaseAddrMask)
+	wrmsr(msrAPICBase, base|apicBaseEnable)
+
+	if !ioapicInit() {
+		return false
+	}
+
+	// The 8259s stay remapped to 0x20-0x2F, fully masked, so a stray
+	// interrupt from them can never collide with CPU exception vectors.
+	PICSetMask(0xFF, 0xFF)
+
+	setIDTEntry(spuriousVector, getSpuriousStubAddr(), GetCS(), intGateKernelFlags, 0)
+	setIDTEntry(reschedVector, getReschedStubAddr(), GetCS(), intGateKernelFlags, 0)
+	lapicEnable()
+
+	useAPIC = true
+	return true
+}
+
+// lapicEnable programs the local APIC of the executing CPU.
+func lapicEnable() {
+	lapicWrite(lapicRegTPR, 0)
+	// the other input (ExtINT from the 8259s on PCs) stays masked
+	if nmiLINT == 0 {
+		lapicWrite(lapicRegLVTLINT0, lvtDeliveryNMI)
+		lapicWrite(lapicRegLVTLINT1, lvtMasked)
+	} else {
+		lapicWrite(lapicRegLVTLINT0, lvtMasked)
+		lapicWrite(lapicRegLVTLINT1, lvtDeliveryNMI)
+	}
+	lapicWrite(lapicRegLVTError, lvtMasked)
+	lapicWrite(lapicRegSVR, lapicSVREnable|spuriousVector)
+	lapicWrite(lapicRegEOI, 0)
+}
+
+// LAPICEOI acknowledges the interrupt currently in service.
+func LAPICEOI() {
+	lapicWrite(lapicRegEOI, 0)
+}
+
+// lapicCalibrate measures how fast the LAPIC timer counts, using PIT
+// channel 2 as the reference so channel 0 is not disturbed.
+func lapicCalibrate() {
+	lapicWrite(lapicRegTimerDivide, timerDivideBy16)
+	lapicWrite(lapicRegLVTTimer, lvtMasked)
+	lapicWrite(lapicRegTimerInit, lapicMaxTimerInit)
+
+	pitWait(lapicCalibrateUs)
+
+	lapicCountsPerCal = lapicMaxTimerInit - lapicRead(lapicRegTimerCount)
+	lapicWrite(lapicRegTimerInit, 0)
+}
+
+// LAPICTimerStart replaces the PIT as the scheduler tick: the LAPIC timer
+// fires hz times per second on the IRQ0 vector, so timerIRQ keeps working.
+func LAPICTimerStart(hz uint32) {
+	if hz == 0 {
+		hz = 100
+	}
+	timerHz = hz
+	if lapicCountsPerCal == 0 {
+		lapicCalibrate()
+	}
+
+	count := uint64(lapicCountsPerCal) * (1000000 / lapicCalibrateUs) / uint64(hz)
+	if count == 0 {
+		count = 1
+	}
+
+	lapicTickCount = uint32(count)
+
+	lapicWrite(lapicRegTimerDivide, timerDivideBy16)
+	lapicWrite(lapicRegLVTTimer, lvtTimerPeriodic|lapicTimerVector)
+	lapicWrite(lapicRegTimerInit, lapicTickCount)
+}
+
+// irqEOI acknowledges an IRQ on whichever controller delivered it.
+func irqEOI(irq uint8) {
+	if useAPIC {
+		LAPICEOI()
+		return
+	}
+	PICEOI(irq)
+}
+
+func irqUnmask(irq uint8) {
+	if useAPIC {
+		ioapicRouteIRQ(irq, irqBase+irq, LAPICID(), false)
+		return
+	}
+	PICUnmask(irq)
+}
+
+func irqMask(irq uint8) {
+	if useAPIC {
+		ioapicRouteIRQ(irq, irqBase+irq, LAPICID(), true)
+		return
+	}
+	PICMask(irq)
+}
@@ -0,0 +1,260 @@
+// Package channel provides Go-style channels between kernel tasks. The
+// freestanding build has no runtime to implement `chan`, so Chan carries
+// uint64 words (pointers travel as uintptr) and blocks tasks on scheduler
+// wait queues instead of parking goroutines.
+package channel
+
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+)
+
+// MaxCap is the largest buffer a channel can have.
+const MaxCap = 16
+
+// Chan is a FIFO channel. With capacity 0 (the zero value) it is
+// unbuffered: Send returns only once a receiver took the value. Every
+// operation runs with interrupts off for its short critical section, so
+// interrupt handlers may use the non-blocking TrySend/TryRecv.
+type Chan struct {
+	lock   sync.SpinLock
+	buf    [MaxCap]uint64
+	size   int // capacity, 0 for unbuffered
+	head   int
+	n      int
+	closed bool
+
+	// sent and recvd count values in and out; an unbuffered sender
+	// waits until recvd passes the sequence number of its value
+	sent  uint64
+	recvd uint64
+
+	// tasks blocked in Recv; an unbuffered channel only accepts a value
+	// without blocking when one is waiting or a blocked Select receiving
+	// from it can be claimed
+	receivers int
+
+	recvq scheduler.WaitQueue // receivers waiting for a value
+	sendq scheduler.WaitQueue // senders waiting for room or a receiver
+}
+
+var (
+	// Every state change wakes all selecting tasks: a task cannot sit on
+	// the queues of several channels at once.
+	selectq scheduler.WaitQueue
+
+	// sets the current task's exit hook; tests replace it to run the
+	// hooks of Recv and Select as a Kill would
+	setExitHook = scheduler.SetExitHook
+)
+
+// Init empties the channel and sets its capacity, clamped to
+// [0, MaxCap]. It must not race with other operations on c.
+func (c *Chan) Init(capacity int) {
+	if capacity < 0 {
+		capacity = 0
+	}
+	if capacity > MaxCap {
+		capacity = MaxCap
+	}
+	flags := c.lockIRQ()
+	c.size = capacity
+	c.head = 0
+	c.n = 0
+	c.closed = false
+	c.sent = 0
+	c.recvd = 0
+	c.receivers = 0
+	c.unlockIRQ(flags)
+}
+
+// Cap returns the buffer capacity.
+func (c *Chan) Cap() int { return c.size }
+
+// Len returns the number of buffered values.
+func (c *Chan) Len() int { return c.n }
+
+// Send blocks until v is buffered, or for an unbuffered channel until a
+// receiver took it. It returns false if the channel is closed.
+func (c *Chan) Send(v uint64) bool {
+	for {
+		flags := c.sendq.Prepare()
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			c.sendq.Finish(flags)
+			return false
+		}
+		if c.n < c.slots() {
+			seq := c.put(v)
+			c.lock.Unlock()
+			c.sendq.Finish(flags)
+			c.notify(&c.recvq)
+			if c.size == 0 {
+				c.waitTaken(seq)
+			}
+			return true
+		}
+		c.lock.Unlock()
+		c.sendq.Block(flags)
+	}
+}
+
+// waitTaken blocks an unbuffered sender until value seq was received or
+// the channel was closed.
+func (c *Chan) waitTaken(seq uint64) {
+	for {
+		flags := c.sendq.Prepare()
+		c.lock.Lock()
+		done := c.recvd > seq || c.closed
+		c.lock.Unlock()
+		if done {
+			c.sendq.Finish(flags)
+			return
+		}
+		c.sendq.Block(flags)
+	}
+}
+
+// Recv blocks until a value is available and returns it. ok is false if
+// the channel is closed and drained.
+func (c *Chan) Recv() (v uint64, ok bool) {
+	for {
+		flags := c.recvq.Prepare()
+		c.lock.Lock()
+		if c.n > 0 {
+			v = c.take()
+			c.lock.Unlock()
+			c.recvq.Finish(flags)
+			c.notify(&c.sendq)
+			return v, true
+		}
+		if c.closed {
+			c.lock.Unlock()
+			c.recvq.Finish(flags)
+			return 0, false
+		}
+		c.receivers++
+		// interrupts are off until Block, so the task cannot be killed
+		// before the hook is set
+		setExitHook(dropReceiver, uint64(uintptr(unsafe.Pointer(c))))
+		c.lock.Unlock()
+		// a selecting sender on an unbuffered channel can go ahead now
+		c.notify(&c.sendq)
+		c.recvq.Block(flags)
+
+		flags = c.lockIRQ()
+		c.receivers--
+		setExitHook(nil, 0)
+		c.unlockIRQ(flags)
+	}
+}
+
+// dropReceiver is the exit hook of a task blocked in Recv: a task killed
+// there never returns to stop counting as a receiver.
+func dropReceiver(arg uint64) {
+	c := (*Chan)(unsafe.Pointer(uintptr(arg)))
+	flags := c.lockIRQ()
+	c.receivers--
+	c.unlockIRQ(flags)
+}
+
+// TrySend sends v if that does not block: there is room in the buffer, or
+// for an unbuffered channel a receiver is waiting (the value is handed
+// over without waiting for the receiver to run).
+func (c *Chan) TrySend(v uint64) bool {
+	flags := c.lockIRQ()
+	ok := c.canSend()
+	if ok {
+		c.put(v)
+	}
+	c.unlockIRQ(flags)
+	if ok {
+		c.notify(&c.recvq)
+	}
+	return ok
+}
+
+// TryRecv receives a value if one is available. ready is false if Recv
+// would block; ok is as for Recv.
+func (c *Chan) TryRecv() (v uint64, ok bool, ready bool) {
+	flags := c.lockIRQ()
+	if c.n > 0 {
+		v = c.take()
+		c.unlockIRQ(flags)
+		c.notify(&c.sendq)
+		return v, true, true
+	}
+	closed := c.closed
+	c.unlockIRQ(flags)
+	return 0, false, closed
+}
+
+// Close marks the channel closed and wakes everyone blocked on it.
+// Buffered values can still be received; further sends fail.
+func (c *Chan) Close() {
+	flags := c.lockIRQ()
+	c.closed = true
+	c.unlockIRQ(flags)
+	c.notify(&c.recvq)
+	c.notify(&c.sendq)
+}
+
+// slots is the number of values the channel holds before senders block:
+// an unbuffered channel parks one value until a receiver takes it.
+func (c *Chan) slots() int {
+	if c.size == 0 {
+		return 1
+	}
+	return c.size
+}
+
+// canSend reports whether a value can be put without blocking, claiming
+// a blocked Select as its receiver if needed. Called with c.lock held and
+// interrupts off.
+func (c *Chan) canSend() bool {
+	if c.closed {
+		return false
+	}
+	if c.size == 0 {
+		return c.n == 0 && (c.receivers > 0 || claimSelector(c))
+	}
+	return c.n < c.size
+}
+
+// put appends v and returns its sequence number. Called with c.lock held.
+func (c *Chan) put(v uint64) uint64 {
+	c.buf[(c.head+c.n)%MaxCap] = v
+	c.n++
+	seq := c.sent
+	c.sent++
+	return seq
+}
+
+// take pops the oldest value. Called with c.lock held and c.n > 0.
+func (c *Chan) take() uint64 {
+	v := c.buf[c.head]
+	c.head = (c.head + 1) % MaxCap
+	c.n--
+	c.recvd++
+	return v
+}
+
+// notify wakes the tasks on q and every selecting task.
+func (c *Chan) notify(q *scheduler.WaitQueue) {
+	q.WakeAll()
+	selectq.WakeAll()
+}
+
+func (c *Chan) lockIRQ() uint64 {
+	flags := sync.SaveIRQ()
+	c.lock.Lock()
+	return flags
+}
+
+func (c *Chan) unlockIRQ(flags uint64) {
+	c.lock.Unlock()
+	sync.RestoreIRQ(flags)
+}
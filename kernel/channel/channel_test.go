@@ -0,0 +1,187 @@
+package channel
+
+import (
+	"testing"
+
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+)
+
+// setup runs the boot task alone; fn stands in for other tasks or
+// interrupt handlers and runs whenever the boot task blocks.
+func setup(fn func()) {
+	scheduler.Init()
+	scheduler.SetIdleHook(fn)
+}
+
+func TestBuffered(t *testing.T) {
+	setup(nil)
+	var c Chan
+	c.Init(2)
+	if !c.TrySend(1) || !c.TrySend(2) {
+		t.Fatalf("Expected two sends to fit in the buffer")
+	}
+	if c.TrySend(3) {
+		t.Errorf("Expected TrySend on a full channel to fail")
+	}
+	if v, ok := c.Recv(); !ok || v != 1 {
+		t.Errorf("Expected to receive 1 first, got %d", v)
+	}
+	if v, ok, ready := c.TryRecv(); !ready || !ok || v != 2 {
+		t.Errorf("Expected to receive 2 second, got %d", v)
+	}
+	if _, _, ready := c.TryRecv(); ready {
+		t.Errorf("Expected TryRecv on an empty channel not to be ready")
+	}
+}
+
+func TestRecvBlocks(t *testing.T) {
+	var c Chan
+	c.Init(1)
+	idles := 0
+	setup(func() {
+		idles++
+		c.TrySend(42)
+	})
+	if v, ok := c.Recv(); !ok || v != 42 || idles != 1 {
+		t.Errorf("Expected Recv to block once and get 42, got %d after %d idles", v, idles)
+	}
+}
+
+func TestUnbuffered(t *testing.T) {
+	var c Chan
+	setup(nil)
+	if c.TrySend(1) {
+		t.Errorf("Expected TrySend without a receiver to fail")
+	}
+
+	// the sender must wait until the value was taken
+	var got uint64
+	setup(func() { got, _, _ = c.TryRecv() })
+	if !c.Send(7) || got != 7 {
+		t.Errorf("Expected Send to return once 7 was received, got %d", got)
+	}
+	if c.Len() != 0 {
+		t.Errorf("Expected nothing left in an unbuffered channel")
+	}
+}
+
+func TestClose(t *testing.T) {
+	setup(nil)
+	var c Chan
+	c.Init(2)
+	c.TrySend(5)
+	c.Close()
+	if c.Send(6) {
+		t.Errorf("Expected Send on a closed channel to fail")
+	}
+	if v, ok := c.Recv(); !ok || v != 5 {
+		t.Errorf("Expected buffered value 5 after Close, got %d", v)
+	}
+	if _, ok := c.Recv(); ok {
+		t.Errorf("Expected Recv on a drained closed channel to report !ok")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	setup(nil)
+	var a, b Chan
+	a.Init(1)
+	b.Init(1)
+
+	cases := []Case{{Ch: &a}, {Ch: &b}}
+	if i := Select(cases, false); i != -1 {
+		t.Errorf("Expected a non-blocking Select to find nothing, got %d", i)
+	}
+
+	b.TrySend(9)
+	if i := Select(cases, false); i != 1 || cases[1].Value != 9 || !cases[1].OK {
+		t.Errorf("Expected case 1 to receive 9, got case %d", i)
+	}
+
+	// blocks until "another task" sends on a
+	setup(func() { a.TrySend(3) })
+	if i := Select(cases, true); i != 0 || cases[0].Value != 3 {
+		t.Errorf("Expected blocking Select to receive 3 on case 0, got case %d", i)
+	}
+
+	// a full channel's send case is not ready, the other one is
+	a.TrySend(1)
+	send := []Case{{Ch: &a, Send: true, Value: 2}, {Ch: &b, Send: true, Value: 4}}
+	if i := Select(send, false); i != 1 {
+		t.Errorf("Expected the send on b to be picked, got %d", i)
+	}
+	if v, _, _ := b.TryRecv(); v != 4 {
+		t.Errorf("Expected b to hold 4, got %d", v)
+	}
+}
+
+func TestSelectClaimedOnce(t *testing.T) {
+	var a, b Chan
+	sentA, sentB := false, false
+	setup(func() {
+		if !sentA {
+			sentA = a.TrySend(1)
+			sentB = b.TrySend(2)
+		}
+	})
+
+	// one blocked Select counts as a receiver on a and b, but only the
+	// first handoff may count on it
+	cases := []Case{{Ch: &a}, {Ch: &b}}
+	if i := Select(cases, true); i != 0 || cases[0].Value != 1 {
+		t.Errorf("Expected Select to receive 1 on case 0, got case %d", i)
+	}
+	if !sentA || sentB {
+		t.Errorf("Expected only the first TrySend to find a receiver, got %v and %v", sentA, sentB)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Expected no value left behind on b")
+	}
+}
+
+// killHook replaces setExitHook and returns a function that runs the
+// hook last set, as Kill would for a task blocked in the call.
+func killHook(t *testing.T) func() {
+	var fn func(uint64)
+	var arg uint64
+	setExitHook = func(f func(uint64), a uint64) { fn, arg = f, a }
+	return func() {
+		if fn == nil {
+			t.Fatalf("Expected an exit hook while blocked")
+		}
+		fn(arg)
+	}
+}
+
+func TestKilledWaitersCleanUp(t *testing.T) {
+	kill := killHook(t)
+	defer func() { setExitHook = scheduler.SetExitHook }()
+
+	// a Recv killed while blocked stops counting as a receiver, so an
+	// unbuffered TrySend finds no one to hand its value to
+	var c Chan
+	setup(func() {
+		kill()
+		if c.receivers != 0 || c.TrySend(1) {
+			t.Errorf("Expected no receiver left after the kill, got %d", c.receivers)
+		}
+		c.Close()
+	})
+	c.Recv()
+
+	// a Select killed while blocked leaves no selector behind
+	var a Chan
+	setup(func() {
+		kill()
+		for i, s := range selectors {
+			if s != nil {
+				t.Errorf("Expected no blocked Select after the kill, slot %d is taken", i)
+			}
+		}
+		if a.TrySend(1) {
+			t.Errorf("Expected TrySend not to claim a killed Select")
+		}
+		a.Close()
+	})
+	Select([]Case{{Ch: &a}}, true)
+}
@@ -0,0 +1,236 @@
+package channel
+
+import (
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+)
+
+// Case is one operation of a Select.
+type Case struct {
+	Ch    *Chan
+	Send  bool   // send Value, else receive into Value
+	Value uint64 // value to send, or the value received
+	OK    bool   // false if the channel was closed (and drained, for a receive)
+}
+
+// selector is a blocked Select. It stands as a receiver on every
+// unbuffered channel it receives from, but a sender handing it a value
+// must claim it first, so only one of those channels can count on it.
+type selector struct {
+	cases   []Case
+	claimed *Chan // channel a sender put a value in for this Select
+	busy    bool  // trying its cases, cannot be claimed meanwhile
+	refused bool  // a claim failed while busy
+}
+
+var (
+	// rotates the first case tried, so a busy channel cannot starve the
+	// others; races on it are harmless
+	selectStart int
+
+	// blocked Selects, at most one per task
+	selectors    [scheduler.MaxTasks]*selector
+	selectorLock sync.SpinLock // always taken with interrupts off
+)
+
+// Select performs one ready case and returns its index. If none is ready
+// it blocks until one is, or returns -1 at once if block is false (a Go
+// select with a default branch). A closed channel is always ready, with
+// OK false. Cases with a nil Ch are ignored, as in Go.
+//
+// A send case on an unbuffered channel completes when a receiver is
+// waiting, without waiting for that receiver to run.
+func Select(cases []Case, block bool) int {
+	if len(cases) == 0 {
+		return -1
+	}
+	if i := trySelect(cases); i >= 0 || !block {
+		return i
+	}
+	// Registered before queueing on selectq: the wake-up this sends to
+	// other selecting tasks would otherwise wake this one too.
+	sel := selector{cases: cases}
+	slot := register(&sel)
+	for {
+		flags := selectq.Prepare()
+		if i := sel.try(); i >= 0 {
+			unregister(slot)
+			selectq.Finish(flags)
+			return i
+		}
+		selectq.Block(flags)
+	}
+}
+
+// try runs the cases once with s closed to claims. A value a sender
+// handed over is taken first; if another receiver got to it, s goes on
+// as if it had never been claimed.
+func (s *selector) try() int {
+	flags := sync.SaveIRQ()
+	selectorLock.Lock()
+	s.busy = true
+	claimed := s.claimed
+	s.claimed = nil
+	selectorLock.Unlock()
+	sync.RestoreIRQ(flags)
+
+	i := -1
+	if claimed != nil {
+		i = s.recvFrom(claimed)
+	}
+	if i < 0 {
+		i = trySelect(s.cases)
+	}
+	if i >= 0 {
+		return i
+	}
+
+	flags = sync.SaveIRQ()
+	selectorLock.Lock()
+	s.busy = false
+	refused := s.refused
+	s.refused = false
+	selectorLock.Unlock()
+	sync.RestoreIRQ(flags)
+	if refused {
+		// a selecting sender gave up on s in the meantime
+		selectq.WakeAll()
+	}
+	return -1
+}
+
+// recvFrom performs the receive case on c, if it is ready.
+func (s *selector) recvFrom(c *Chan) int {
+	for i := 0; i < len(s.cases); i++ {
+		cs := &s.cases[i]
+		if cs.Ch != c || cs.Send {
+			continue
+		}
+		if v, ok, ready := c.TryRecv(); ready {
+			cs.Value = v
+			cs.OK = ok
+			return i
+		}
+		break
+	}
+	return -1
+}
+
+// receives reports whether s has a receive case on c.
+func (s *selector) receives(c *Chan) bool {
+	for i := 0; i < len(s.cases); i++ {
+		if s.cases[i].Ch == c && !s.cases[i].Send {
+			return true
+		}
+	}
+	return false
+}
+
+// claimSelector claims a blocked Select that receives from c, for a
+// sender about to hand it a value. Called with c.lock held and interrupts
+// off.
+func claimSelector(c *Chan) bool {
+	selectorLock.Lock()
+	ok := false
+	for i := 0; i < len(selectors); i++ {
+		s := selectors[i]
+		if s == nil || s.claimed != nil || !s.receives(c) {
+			continue
+		}
+		if s.busy {
+			s.refused = true
+			continue
+		}
+		s.claimed = c
+		ok = true
+		break
+	}
+	selectorLock.Unlock()
+	return ok
+}
+
+// trySelect tries every case once, starting at a rotating offset.
+func trySelect(cases []Case) int {
+	n := len(cases)
+	start := selectStart % n
+	selectStart++
+	for k := 0; k < n; k++ {
+		i := (start + k) % n
+		cs := &cases[i]
+		if cs.Ch == nil {
+			continue
+		}
+		if cs.Send {
+			if cs.Ch.TrySend(cs.Value) {
+				cs.OK = true
+				return i
+			}
+			flags := cs.Ch.lockIRQ()
+			closed := cs.Ch.closed
+			cs.Ch.unlockIRQ(flags)
+			if closed {
+				cs.OK = false
+				return i
+			}
+			continue
+		}
+		if v, ok, ready := cs.Ch.TryRecv(); ready {
+			cs.Value = v
+			cs.OK = ok
+			return i
+		}
+	}
+	return -1
+}
+
+// register adds s to the blocked Selects and returns its slot, or -1 if
+// the table is full; s then only gets values that senders park without
+// waiting for a receiver. Selecting senders on its channels are woken,
+// as they may go ahead now. s lives on the task's stack, so an exit hook
+// takes it out of the table if the task is killed while it selects.
+func register(s *selector) int {
+	flags := sync.SaveIRQ()
+	selectorLock.Lock()
+	slot := -1
+	for i := 0; i < len(selectors); i++ {
+		if selectors[i] == nil {
+			selectors[i] = s
+			slot = i
+			break
+		}
+	}
+	selectorLock.Unlock()
+	if slot >= 0 {
+		setExitHook(unregisterHook, uint64(slot))
+	}
+	sync.RestoreIRQ(flags)
+
+	for i := 0; i < len(s.cases); i++ {
+		cs := &s.cases[i]
+		if cs.Ch != nil && !cs.Send {
+			cs.Ch.notify(&cs.Ch.sendq)
+		}
+	}
+	return slot
+}
+
+func unregister(slot int) {
+	if slot < 0 {
+		return
+	}
+	flags := sync.SaveIRQ()
+	selectorLock.Lock()
+	selectors[slot] = nil
+	selectorLock.Unlock()
+	setExitHook(nil, 0)
+	sync.RestoreIRQ(flags)
+}
+
+// unregisterHook is the exit hook of a task blocked in Select.
+func unregisterHook(slot uint64) {
+	flags := sync.SaveIRQ()
+	selectorLock.Lock()
+	selectors[slot] = nil
+	selectorLock.Unlock()
+	sync.RestoreIRQ(flags)
+}
@@ -0,0 +1,199 @@
+package kernel
+
+import (
+	"github.com/dmarro89/go-dav-os/acpi"
+	"github.com/dmarro89/go-dav-os/mem"
+)
+
+// Assembly hook (boot/stubs_amd64.s)
+func rdtsc() uint64
+
+const (
+	cpuidExtMax      = 0x80000000
+	cpuidExtPower    = 0x80000007
+	cpuidFeatTSC     = 1 << 4 // CPUID.01h:EDX
+	cpuidInvariantTS = 1 << 8 // CPUID.80000007h:EDX
+
+	// HPET register offsets
+	hpetRegCaps    = 0x000
+	hpetRegConfig  = 0x010
+	hpetRegCounter = 0x0F0
+
+	hpetCfgEnable  = 1 << 0
+	hpetCaps64Bit  = 1 << 13
+	hpetMaxPeriod  = 100000000 // fs, per spec (10 ns)
+	fsPerNs        = 1000000
+	nsPerSec       = 1000000000
+	clockCalibrate = 10000 // us
+)
+
+// Clock sources, from worst to best; the zero value is the tick count
+const (
+	clockTicks = iota
+	clockHPET
+	clockTSC
+)
+
+var (
+	clockSource  int
+	clockFreq    uint64 // Hz of the selected counter
+	clockBase    uint64 // counter value at InitClock
+	tscHz        uint64
+	tscInvariant bool
+
+	hpetBase     uintptr
+	hpetPeriodFs uint64
+	hpet64       bool
+)
+
+// TSCInvariant reports whether CPUID says the TSC runs at a constant
+// rate regardless of P/C-states, which makes it safe as a clocksource.
+func TSCInvariant() bool {
+	var r [4]uint32
+	cpuid(1, 0, &r)
+	if r[3]&cpuidFeatTSC == 0 {
+		return false
+	}
+	cpuid(cpuidExtMax, 0, &r)
+	if r[0] < cpuidExtPower {
+		return false
+	}
+	cpuid(cpuidExtPower, 0, &r)
+	return r[3]&cpuidInvariantTS != 0
+}
+
+func hpetInit() bool {
+	h := acpi.HPET()
+	if !h.Present {
+		return false
+	}
+	hpetBase = mem.PhysToVirt(h.Address)
+	caps := mmioRead32(hpetBase + hpetRegCaps)
+	hpetPeriodFs = uint64(mmioRead32(hpetBase + hpetRegCaps + 4))
+	if hpetPeriodFs == 0 || hpetPeriodFs > hpetMaxPeriod {
+		hpetBase = 0
+		return false
+	}
+	hpet64 = caps&hpetCaps64Bit != 0
+
+	cfg := mmioRead32(hpetBase + hpetRegConfig)
+	mmioWrite32(hpetBase+hpetRegConfig, cfg|hpetCfgEnable)
+	return true
+}
+
+// hpetRead returns the main counter. A 64-bit counter is read as two
+// halves, retrying if the high half changed in between.
+func hpetRead() uint64 {
+	if !hpet64 {
+		return uint64(mmioRead32(hpetBase + hpetRegCounter))
+	}
+	for {
+		hi := mmioRead32(hpetBase + hpetRegCounter + 4)
+		lo := mmioRead32(hpetBase + hpetRegCounter)
+		if mmioRead32(hpetBase+hpetRegCounter+4) == hi {
+			return uint64(hi)<<32 | uint64(lo)
+		}
+	}
+}
+
+// hpetElapsed returns b-a in counter ticks, honouring a 32-bit wrap.
+func hpetElapsed(a, b uint64) uint64 {
+	if !hpet64 {
+		return uint64(uint32(b) - uint32(a))
+	}
+	return b - a
+}
+
+// calibrateTSC measures the TSC frequency against the HPET when there is
+// one, else against PIT channel 2.
+func calibrateTSC() uint64 {
+	if hpetBase != 0 {
+		wait := uint64(clockCalibrate) * 1000 * fsPerNs / hpetPeriodFs
+		h0 := hpetRead()
+		t0 := rdtsc()
+		for hpetElapsed(h0, hpetRead()) < wait {
+		}
+		t1 := rdtsc()
+		elapsedNs := hpetElapsed(h0, hpetRead()) * hpetPeriodFs / fsPerNs
+		if elapsedNs == 0 {
+			return 0
+		}
+		return (t1 - t0) * nsPerSec / elapsedNs
+	}
+
+	t0 := rdtsc()
+	pitWait(clockCalibrate)
+	t1 := rdtsc()
+	return (t1 - t0) * (1000000 / clockCalibrate)
+}
+
+// InitClock picks the clocksource behind Now: an invariant TSC, then a
+// 64-bit HPET main counter, then a TSC that may drift with power states,
+// and as a last resort the scheduler tick. A 32-bit HPET wraps within
+// minutes, so it is only used for calibration.
+func InitClock() {
+	haveHPET := hpetInit()
+
+	var r [4]uint32
+	cpuid(1, 0, &r)
+	if r[3]&cpuidFeatTSC != 0 {
+		tscHz = calibrateTSC()
+		tscInvariant = TSCInvariant()
+	}
+
+	switch {
+	case tscHz != 0 && (tscInvariant || !haveHPET || !hpet64):
+		clockSource = clockTSC
+		clockFreq = tscHz
+	case haveHPET:
+		clockSource = clockHPET
+		clockFreq = fsPerNs * nsPerSec / hpetPeriodFs
+	default:
+		clockSource = clockTicks
+		clockFreq = tickHz
+	}
+	clockBase = clockRead()
+}
+
+func clockRead() uint64 {
+	switch clockSource {
+	case clockTSC:
+		return rdtsc()
+	case clockHPET:
+		return hpetRead()
+	}
+	return ticks
+}
+
+// Now returns nanoseconds since InitClock. It is monotonic on a given
+// CPU; resolution depends on the clocksource (see ClockSourceName).
+func Now() uint64 {
+	if clockFreq == 0 {
+		return 0
+	}
+	c := clockRead() - clockBase
+	// split to avoid overflowing c * 1e9
+	return c/clockFreq*nsPerSec + c%clockFreq*nsPerSec/clockFreq
+}
+
+// Since returns the nanoseconds elapsed since t, a value returned by Now.
+func Since(t uint64) uint64 {
+	return Now() - t
+}
+
+// ClockSourceName names the counter behind Now.
+func ClockSourceName() string {
+	switch clockSource {
+	case clockTSC:
+		if tscInvariant {
+			return "tsc (invariant)"
+		}
+		return "tsc"
+	case clockHPET:
+		return "hpet"
+	}
+	return "ticks"
+}
+
+// TSCFrequency returns the calibrated TSC rate in Hz, 0 if unknown.
+func TSCFrequency() uint64 { return tscHz }
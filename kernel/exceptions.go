@@ -0,0 +1,150 @@
+package kernel
+
+import (
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/terminal"
+)
+
+const numExceptions = 32
+
+var exceptionNames = [numExceptions]string{
+	"#DE Divide Error",
+	"#DB Debug",
+	"NMI Non-Maskable Interrupt",
+	"#BP Breakpoint",
+	"#OF Overflow",
+	"#BR Bound Range Exceeded",
+	"#UD Invalid Opcode",
+	"#NM Device Not Available",
+	"#DF Double Fault",
+	"Coprocessor Segment Overrun",
+	"#TS Invalid TSS",
+	"#NP Segment Not Present",
+	"#SS Stack-Segment Fault",
+	"#GP General Protection Fault",
+	"#PF Page Fault",
+	"Reserved",
+	"#MF x87 Floating-Point Error",
+	"#AC Alignment Check",
+	"#MC Machine Check",
+	"#XM SIMD Floating-Point Exception",
+	"#VE Virtualization Exception",
+	"#CP Control Protection Exception",
+	"Reserved",
+	"Reserved",
+	"Reserved",
+	"Reserved",
+	"Reserved",
+	"Reserved",
+	"#HV Hypervisor Injection Exception",
+	"#VC VMM Communication Exception",
+	"#SX Security Exception",
+	"Reserved",
+}
+
+// ExceptionHandler is called by isr_common (boot/stubs_amd64.s) for every
+// CPU exception. Page faults may be claimed by a registered handler, any
+// other exception is fatal: dump state and halt. Handlers run with the
+// FPU trapped as in an interrupt, so they cannot clobber the state of the
+// interrupted task.
+func ExceptionHandler(tf *TrapFrame) {
+	if tf.Vector == vecDeviceNotAvailable && scheduler.FPUTrap() {
+		return
+	}
+	entered := scheduler.ExceptionEnter()
+	if tf.Vector == vecPageFault && handlePageFault(tf) {
+		scheduler.ExceptionLeave(entered)
+		return
+	}
+
+	DisableInterrupts()
+	reportStackOverflow(tf)
+	dumpTrapFrame(tf)
+	haltForever()
+}
+
+func dumpTrapFrame(tf *TrapFrame) {
+	faultPrint("\n*** CPU EXCEPTION 0x")
+	faultHex8(byte(tf.Vector))
+	faultPrint(" ")
+	if tf.Vector < numExceptions {
+		faultPrint(exceptionNames[tf.Vector])
+	} else {
+		faultPrint("Unknown")
+	}
+	faultPrint(" ***\n")
+
+	faultReg("ERR", tf.ErrorCode)
+	faultReg("CR2", tf.CR2)
+	faultPrint("\n")
+
+	faultReg("RIP", tf.RIP)
+	faultReg("CS ", tf.CS)
+	faultReg("RFL", tf.RFLAGS)
+	faultPrint("\n")
+	faultReg("RSP", tf.RSP)
+	faultReg("SS ", tf.SS)
+	faultPrint("\n")
+
+	faultReg("RAX", tf.RAX)
+	faultReg("RBX", tf.RBX)
+	faultReg("RCX", tf.RCX)
+	faultPrint("\n")
+	faultReg("RDX", tf.RDX)
+	faultReg("RSI", tf.RSI)
+	faultReg("RDI", tf.RDI)
+	faultPrint("\n")
+	faultReg("RBP", tf.RBP)
+	faultReg("R8 ", tf.R8)
+	faultReg("R9 ", tf.R9)
+	faultPrint("\n")
+	faultReg("R10", tf.R10)
+	faultReg("R11", tf.R11)
+	faultReg("R12", tf.R12)
+	faultPrint("\n")
+	faultReg("R13", tf.R13)
+	faultReg("R14", tf.R14)
+	faultReg("R15", tf.R15)
+	faultPrint("\n")
+
+	faultPrint("System halted.\n")
+}
+
+func haltForever() {
+	cpuStopped()
+	for {
+		DisableInterrupts()
+		Halt()
+	}
+}
+
+// faultPrint writes to the VGA terminal, which already mirrors printable
+// characters to the 0xE9 debug port. Newlines are not mirrored there, so
+// add them here to keep one register line per row in the debugcon log.
+func faultPrint(s string) {
+	terminal.Print(s)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			DebugChar('\n')
+		}
+	}
+}
+
+func faultReg(name string, v uint64) {
+	faultPrint(name)
+	faultPrint("=0x")
+	faultHex64(v)
+	faultPrint(" ")
+}
+
+func faultHex64(v uint64) {
+	for i := 7; i >= 0; i-- {
+		faultHex8(byte(v >> (uint(i) * 8)))
+	}
+}
+
+func faultHex8(b byte) {
+	const hexDigits = "0123456789ABCDEF"
+	terminal.PutRune(rune(hexDigits[(b>>4)&0xF]))
+	terminal.PutRune(rune(hexDigits[b&0xF]))
+}
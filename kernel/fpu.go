@@ -0,0 +1,61 @@
+package kernel
+
+import "github.com/dmarro89/go-dav-os/kernel/scheduler"
+
+// Assembly hooks (boot/stubs_amd64.s)
+func readCR4() uint64
+func writeCR4(v uint64)
+func xsetbv(reg uint32, v uint64)
+
+const (
+	vecDeviceNotAvailable = 7
+
+	cpuidFeatXSAVE = 1 << 26 // CPUID.01h:ECX
+	cpuidFeatAVX   = 1 << 28 // CPUID.01h:ECX
+	cpuidXSAVE     = 0x0D
+
+	cr4OSXSAVE = 1 << 18
+
+	xcr0X87 = 1 << 0
+	xcr0SSE = 1 << 1
+	xcr0AVX = 1 << 2
+)
+
+// XCR0 value programmed on every CPU, 0 when XSAVE is not used
+var fpuXCR0 uint64
+
+// InitFPU picks how task FPU state is saved and enables lazy switching.
+// boot.s already made x87/SSE usable (CR0, CR4.OSFXSR); if the CPU has
+// XSAVE, CR4.OSXSAVE is set and XCR0 enables x87, SSE and, when present,
+// AVX, as long as the resulting save area fits in a task.
+func InitFPU() {
+	var r [4]uint32
+	cpuid(1, 0, &r)
+	if r[2]&cpuidFeatXSAVE != 0 {
+		mask := uint64(xcr0X87 | xcr0SSE)
+		if r[2]&cpuidFeatAVX != 0 {
+			mask |= xcr0AVX
+		}
+		writeCR4(readCR4() | cr4OSXSAVE)
+		xsetbv(0, mask)
+
+		// EBX: save area size for the components enabled in XCR0
+		cpuid(cpuidXSAVE, 0, &r)
+		if r[1] > scheduler.FPUAreaSize {
+			mask = xcr0X87 | xcr0SSE
+			xsetbv(0, mask)
+		}
+		fpuXCR0 = mask
+	}
+	scheduler.SetFPUMode(fpuXCR0)
+}
+
+// initCPUFPU gives an application processor the same XSAVE setup as the
+// bootstrap processor; CR4 and XCR0 are per CPU.
+func initCPUFPU() {
+	if fpuXCR0 == 0 {
+		return
+	}
+	writeCR4(readCR4() | cr4OSXSAVE)
+	xsetbv(0, fpuXCR0)
+}
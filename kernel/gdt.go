@@ -0,0 +1,101 @@
+package kernel
+
+import "unsafe"
+
+// Segment selectors. The code/data layout matches the boot GDT in
+// boot/boot.s so CS/SS stay valid across the switch to this table.
+const (
+	kernelCodeSel = 0x08
+	kernelDataSel = 0x10
+	tssSel        = 0x18
+)
+
+// Interrupt Stack Table slots (1-based, 0 means "no IST")
+const (
+	istDoubleFault  = 1
+	istNMI          = 2
+	istMachineCheck = 3
+
+	istCount     = 3
+	istStackSize = 8192
+)
+
+// tss is the 64-bit Task State Segment. 64-bit fields are only 4-byte
+// aligned in hardware, so they are stored as lo/hi uint32 pairs.
+type tss struct {
+	reserved0 uint32
+	rsp       [3][2]uint32
+	reserved1 [2]uint32
+	ist       [7][2]uint32
+	reserved2 [2]uint32
+	reserved3 uint16
+	iomapBase uint16
+}
+
+const tssSize = 104
+
+// cpuTables is the GDT, TSS and IST stacks of one CPU. Every CPU needs
+// its own TSS (the busy bit lives in its descriptor), hence its own GDT.
+type cpuTables struct {
+	// null, kernel code, kernel data, TSS (16 bytes = 2 slots)
+	gdt  [5]uint64
+	gdtr [10]byte
+
+	tss       tss
+	istStacks [istCount][istStackSize]byte
+}
+
+var cpuGDT [maxCPUs]cpuTables
+
+// Assembly hook (boot/stubs_amd64.s): lgdt, reload segment registers, ltr
+func loadGDT(p *[10]byte, tssSelector uint16)
+
+func (c *cpuTables) setTSSDescriptor(slot int, base uint64) {
+	limit := uint64(tssSize - 1)
+	lo := limit & 0xFFFF
+	lo |= (base & 0xFFFFFF) << 16
+	lo |= uint64(0x89) << 40 // P=1, DPL=0, type=available 64-bit TSS
+	lo |= ((limit >> 16) & 0xF) << 48
+	lo |= ((base >> 24) & 0xFF) << 56
+	c.gdt[slot] = lo
+	c.gdt[slot+1] = base >> 32
+}
+
+func (t *tss) setIST(index int, top uint64) {
+	t.ist[index-1][0] = uint32(top)
+	t.ist[index-1][1] = uint32(top >> 32)
+}
+
+func (c *cpuTables) istStackTop(index int) uint64 {
+	s := &c.istStacks[index-1]
+	top := uint64(uintptr(unsafe.Pointer(&s[istStackSize-1])))
+	return top &^ 15
+}
+
+// InitGDT replaces the boot GDT with one that also carries a TSS, so the
+// CPU can switch to a known-good stack (IST) for faults that usually mean
+// the current stack is unusable: #DF, NMI and #MC.
+func InitGDT() {
+	initCPUGDT(0)
+}
+
+// initCPUGDT builds and loads the GDT and TSS of the given CPU.
+// It must run on that CPU.
+func initCPUGDT(cpu int) {
+	c := &cpuGDT[cpu]
+	c.gdt[0] = 0
+	c.gdt[1] = 0x00AF9A000000FFFF // kernel code, 64-bit
+	c.gdt[2] = 0x00CF92000000FFFF // kernel data
+
+	c.tss.iomapBase = tssSize // no I/O permission bitmap
+	for i := 1; i <= istCount; i++ {
+		c.tss.setIST(i, c.istStackTop(i))
+	}
+	c.setTSSDescriptor(tssSel/8, uint64(uintptr(unsafe.Pointer(&c.tss))))
+
+	base := uint64(uintptr(unsafe.Pointer(&c.gdt[0])))
+	limit := uint16(len(c.gdt)*8 - 1)
+	packIDTR(limit, base, &c.gdtr) // same 10-byte pseudo-descriptor as the IDTR
+
+	loadGDT(&c.gdtr, tssSel)
+}
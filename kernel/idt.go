@@ -18,26 +18,10 @@ const (
 	SYS_EXIT  = 2
 )
 
-type TrapFrame struct {
-	R15    uint64
-	R14    uint64
-	R13    uint64
-	R12    uint64
-	R11    uint64
-	R10    uint64
-	R9     uint64
-	R8     uint64
-	RDI    uint64
-	RSI    uint64
-	RBP    uint64
-	RBX    uint64
-	RDX    uint64
-	RCX    uint64
-	RAX    uint64
-	RIP    uint64
-	CS     uint64
-	RFLAGS uint64
-}
+// TrapFrame is the register snapshot built on the stack by the interrupt
+// stubs. It is defined by the scheduler, which switches tasks by resuming
+// a different frame.
+type TrapFrame = scheduler.TrapFrame
 
 // 16 bytes (x86_64 IDT entry)
 type idtEntry struct {
@@ -58,13 +42,12 @@ func LoadIDT(p *[10]byte)
 func StoreIDT(p *[10]byte)
 
 func getInt80StubAddr() uint64
-func getGPFaultStubAddr() uint64
-func getDFaultStubAddr() uint64
+func getISRStubAddr(vec uint64) uint64
 func Int80Stub()
 func TriggerInt80()
 func GetCS() uint16
-func getIRQ0StubAddr() uint64
-func getIRQ1StubAddr() uint64
+func getIRQStubAddr(irq uint64) uint64
+func getYieldStubAddr() uint64
 
 // syscalls
 func TriggerSysWrite(buf *byte, n uint32)
@@ -81,7 +64,7 @@ func Int80Handler(tf *TrapFrame) {
 		terminal.Print("Process exited with status ")
 		terminal.PrintInt(status)
 		terminal.Print("\n")
-		scheduler.Exit()
+		scheduler.Exit(status)
 	default:
 		terminal.Print("unknown syscall\n")
 		tf.RAX = ^uint64(0) // return -1
@@ -122,11 +105,13 @@ func packIDTR(limit uint16, base uint64, out *[10]byte) {
 // 	return
 // }
 
-func setIDTEntry(vec uint8, handler uint64, selector uint16, flags uint8) {
+// setIDTEntry installs a gate for vec. ist selects an Interrupt Stack Table
+// slot from the TSS (1-7), or 0 to keep running on the current stack.
+func setIDTEntry(vec uint8, handler uint64, selector uint16, flags uint8, ist uint8) {
 	e := &idt[vec]
 	e.offsetLow = uint16(handler & 0xFFFF)
 	e.selector = selector
-	e.ist = 0
+	e.ist = ist & 0x7
 	e.flags = flags
 	e.offsetMid = uint16((handler >> 16) & 0xFFFF)
 	e.offsetHigh = uint32((handler >> 32) & 0xFFFFFFFF)
@@ -137,16 +122,27 @@ func setIDTEntry(vec uint8, handler uint64, selector uint16, flags uint8) {
 func InitIDT() {
 	cs := GetCS()
 
-	// Install emergency handlers first
-	setIDTEntry(0x08, getDFaultStubAddr(), cs, intGateKernelFlags)  // #DF
-	setIDTEntry(0x0D, getGPFaultStubAddr(), cs, intGateKernelFlags) // #GP
+	// Install CPU exception handlers first (vectors 0-31)
+	for vec := uint64(0); vec < numExceptions; vec++ {
+		setIDTEntry(uint8(vec), getISRStubAddr(vec), cs, intGateKernelFlags, 0)
+	}
 
-	// Install IRQ handlers
-	setIDTEntry(0x20, getIRQ0StubAddr(), cs, intGateKernelFlags) // IRQ0
-	setIDTEntry(0x21, getIRQ1StubAddr(), cs, intGateKernelFlags) // IRQ1
+	// Faults that usually mean the current stack is gone run on their own
+	// IST stacks, so a kernel stack overflow still gives a readable report
+	setIDTEntry(0x02, getISRStubAddr(0x02), cs, intGateKernelFlags, istNMI)          // NMI
+	setIDTEntry(0x08, getISRStubAddr(0x08), cs, intGateKernelFlags, istDoubleFault)  // #DF
+	setIDTEntry(0x12, getISRStubAddr(0x12), cs, intGateKernelFlags, istMachineCheck) // #MC
+
+	// Install IRQ stubs; handlers are attached later with RegisterIRQ
+	for irq := uint64(0); irq < numIRQs; irq++ {
+		setIDTEntry(uint8(irqBase+irq), getIRQStubAddr(irq), cs, intGateKernelFlags, 0)
+	}
 
 	// Install 0x80 syscall handler
-	setIDTEntry(0x80, getInt80StubAddr(), cs, intGateUserFlags)
+	setIDTEntry(0x80, getInt80StubAddr(), cs, intGateUserFlags, 0)
+
+	// Voluntary task switches trap here (scheduler.Yield)
+	setIDTEntry(scheduler.YieldVector, getYieldStubAddr(), cs, intGateKernelFlags, 0)
 
 	// Build IDTR (packed 10 bytes)
 	base := uint64(uintptr(unsafe.Pointer(&idt[0])))
@@ -0,0 +1,173 @@
+package kernel
+
+import (
+	"github.com/dmarro89/go-dav-os/acpi"
+	"github.com/dmarro89/go-dav-os/mem"
+)
+
+const (
+	ioapicDefaultBase = 0xFEC00000
+	maxIOAPICs        = 4
+
+	ioapicRegSel   = 0x00
+	ioapicRegWin   = 0x10
+	ioapicVer      = 0x01
+	ioapicRedirTbl = 0x10
+
+	// MADT interrupt source override flags (MPS INTI flags)
+	intiPolarityMask = 0x3
+	intiPolarityLow  = 0x3
+	intiTriggerMask  = 0xC
+	intiTriggerLevel = 0xC
+
+	redirPolarityLow = 1 << 13
+	redirTriggerLvl  = 1 << 15
+	redirMasked      = 1 << 16
+)
+
+type ioapicInfo struct {
+	id      uint8
+	base    uintptr
+	gsiBase uint32
+	count   uint32 // number of redirection entries
+}
+
+type irqOverride struct {
+	gsi   uint32
+	flags uint16
+}
+
+var (
+	ioapics     [maxIOAPICs]ioapicInfo
+	ioapicCount int
+
+	// ISA IRQ -> GSI routing; identity unless the firmware says otherwise
+	irqOverrides    [numIRQs]irqOverride
+	irqOverridesSet bool
+)
+
+// AddIOAPIC registers an IOAPIC described by the ACPI MADT, at physical
+// address addr. Must be called before InitAPIC.
+func AddIOAPIC(id uint8, addr uint64, gsiBase uint32) bool {
+	if ioapicCount >= maxIOAPICs {
+		return false
+	}
+	ioapics[ioapicCount] = ioapicInfo{id: id, base: mem.PhysToVirt(addr), gsiBase: gsiBase}
+	ioapicCount++
+	return true
+}
+
+// SetIRQOverride records a MADT interrupt source override for an ISA IRQ.
+// Must be called before InitAPIC.
+func SetIRQOverride(irq uint8, gsi uint32, flags uint16) {
+	if irq >= numIRQs {
+		return
+	}
+	resetIRQOverrides()
+	irqOverrides[irq] = irqOverride{gsi: gsi, flags: flags}
+}
+
+// configureFromMADT feeds the IOAPICs, ISA overrides and the NMI input
+// found by the ACPI MADT into the interrupt routing, before InitAPIC runs.
+func configureFromMADT() {
+	nmiLINT = acpi.NMILINT()
+	for i := 0; i < acpi.IOAPICCount(); i++ {
+		a := acpi.IOAPICEntry(i)
+		AddIOAPIC(a.ID, uint64(a.Address), a.GSIBase)
+	}
+	for i := 0; i < acpi.OverrideCount(); i++ {
+		o := acpi.OverrideEntry(i)
+		if o.Bus == 0 { // ISA
+			SetIRQOverride(o.Source, o.GSI, o.Flags)
+		}
+	}
+}
+
+func resetIRQOverrides() {
+	if irqOverridesSet {
+		return
+	}
+	for i := 0; i < numIRQs; i++ {
+		irqOverrides[i] = irqOverride{gsi: uint32(i)}
+	}
+	irqOverridesSet = true
+}
+
+func ioapicRead(a *ioapicInfo, reg uint32) uint32 {
+	mmioWrite32(a.base+ioapicRegSel, reg)
+	return mmioRead32(a.base + ioapicRegWin)
+}
+
+func ioapicWrite(a *ioapicInfo, reg uint32, v uint32) {
+	mmioWrite32(a.base+ioapicRegSel, reg)
+	mmioWrite32(a.base+ioapicRegWin, v)
+}
+
+// ioapicInit masks every redirection entry. Without MADT data the
+// conventional single IOAPIC at 0xFEC00000 with identity ISA routing and
+// the usual IRQ0 -> GSI2 override is assumed (what PC chipsets and QEMU do).
+func ioapicInit() bool {
+	if ioapicCount == 0 {
+		AddIOAPIC(0, ioapicDefaultBase, 0)
+		if !irqOverridesSet {
+			SetIRQOverride(0, 2, 0)
+		}
+	}
+	resetIRQOverrides()
+
+	for i := 0; i < ioapicCount; i++ {
+		a := &ioapics[i]
+		ver := ioapicRead(a, ioapicVer)
+		a.count = ((ver >> 16) & 0xFF) + 1
+		for n := uint32(0); n < a.count; n++ {
+			ioapicWrite(a, ioapicRedirTbl+2*n, redirMasked)
+			ioapicWrite(a, ioapicRedirTbl+2*n+1, 0)
+		}
+	}
+	return ioapicCount > 0
+}
+
+func ioapicForGSI(gsi uint32) *ioapicInfo {
+	for i := 0; i < ioapicCount; i++ {
+		a := &ioapics[i]
+		if gsi >= a.gsiBase && gsi < a.gsiBase+a.count {
+			return a
+		}
+	}
+	return nil
+}
+
+// ioapicRouteIRQ programs the redirection entry of an ISA IRQ to deliver
+// vector to the LAPIC with the given ID, honouring MADT overrides.
+func ioapicRouteIRQ(irq uint8, vector uint8, apicID uint8, masked bool) bool {
+	if irq >= numIRQs {
+		return false
+	}
+	ov := irqOverrides[irq]
+	return ioapicRouteGSI(ov.gsi, vector, apicID, ov.flags, masked)
+}
+
+// ioapicRouteGSI programs a redirection entry: fixed delivery, physical
+// destination mode.
+func ioapicRouteGSI(gsi uint32, vector uint8, apicID uint8, flags uint16, masked bool) bool {
+	a := ioapicForGSI(gsi)
+	if a == nil {
+		return false
+	}
+
+	lo := uint32(vector)
+	if flags&intiPolarityMask == intiPolarityLow {
+		lo |= redirPolarityLow
+	}
+	if flags&intiTriggerMask == intiTriggerLevel {
+		lo |= redirTriggerLvl
+	}
+	if masked {
+		lo |= redirMasked
+	}
+
+	n := gsi - a.gsiBase
+	ioapicWrite(a, ioapicRedirTbl+2*n+1, uint32(apicID)<<24)
+	ioapicWrite(a, ioapicRedirTbl+2*n, lo)
+	return true
+}
@@ -2,23 +2,134 @@ package kernel
 
 import (
 	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/timer"
 	"github.com/dmarro89/go-dav-os/keyboard"
 )
 
-var ticks uint64
+const (
+	irqBase = 0x20 // vector of IRQ0 after PICRemap
+	numIRQs = 16
 
-func IRQ0Handler() {
-	ticks++
-	PICEOI(0)
-	scheduler.Schedule()
+	IRQTimer    = 0
+	IRQKeyboard = 1
+)
+
+// IRQHandlerFunc services one hardware interrupt line.
+// The dispatcher sends the EOI, handlers must not do it themselves.
+type IRQHandlerFunc func(tf *TrapFrame)
+
+var (
+	ticks uint64
+
+	irqHandlers  [numIRQs]IRQHandlerFunc
+	irqCounts    [numIRQs]uint64
+	spuriousIRQs uint64
+)
+
+// RegisterIRQ attaches h to the given IRQ line and unmasks it.
+// Registering again replaces the previous handler.
+func RegisterIRQ(irq uint8, h IRQHandlerFunc) bool {
+	if irq >= numIRQs || h == nil {
+		return false
+	}
+	irqHandlers[irq] = h
+	irqUnmask(irq)
+	return true
+}
+
+// UnregisterIRQ masks the line and detaches its handler.
+func UnregisterIRQ(irq uint8) {
+	if irq >= numIRQs {
+		return
+	}
+	irqMask(irq)
+	irqHandlers[irq] = nil
+}
+
+// IRQDispatch is called by irq_common (boot/stubs_amd64.s) for IRQ0-15.
+// It returns the frame irq_common resumes: tf, or another task's frame if
+// a handler asked for a reschedule.
+func IRQDispatch(tf *TrapFrame) *TrapFrame {
+	scheduler.TrapEnter()
+	tlbService()
+
+	irq := uint8(tf.Vector - irqBase)
+	if irq >= numIRQs {
+		return scheduler.Switch(tf)
+	}
+
+	// IRQ7/IRQ15 can be raised by the PIC itself when a request goes away
+	// before it is acknowledged. Those must not get a (full) EOI.
+	if !useAPIC && (irq == 7 || irq == 15) && PICIsSpurious(irq) {
+		spuriousIRQs++
+		return scheduler.Switch(tf)
+	}
+
+	irqCounts[irq]++
+
+	// EOI before the handlers: the switch to another task happens on the
+	// way out and that task may not return here for a while. Interrupts
+	// stay off until iretq, so no nesting.
+	irqEOI(irq)
+	tickWake()
+
+	if h := irqHandlers[irq]; h != nil {
+		h(tf)
+	}
+	return scheduler.Switch(tf)
+}
+
+// YieldDispatch is called by yield_stub for scheduler.Yield.
+func YieldDispatch(tf *TrapFrame) *TrapFrame {
+	scheduler.TrapEnter()
+	return scheduler.YieldSwitch(tf)
 }
 
-func IRQ1Handler() {
+// ReschedDispatch is called by resched_stub for the IPI another CPU sends
+// through kickCPU. It only services a pending TLB flush and switches
+// tasks; time and runtime are left to the timer interrupt.
+func ReschedDispatch(tf *TrapFrame) *TrapFrame {
+	scheduler.TrapEnter()
+	tlbService()
+	LAPICEOI()
+	tickWake()
+	scheduler.Resched()
+	return scheduler.Switch(tf)
+}
+
+// IRQCount returns how many interrupts were serviced on the given line.
+func IRQCount(irq uint8) uint64 {
+	if irq >= numIRQs {
+		return 0
+	}
+	return irqCounts[irq]
+}
+
+// SpuriousIRQCount returns how many spurious IRQ7/IRQ15 were dropped.
+func SpuriousIRQCount() uint64 {
+	return spuriousIRQs
+}
+
+// timerIRQ runs on every CPU (each has its own LAPIC timer); only the
+// bootstrap processor advances the global tick count and runs expired
+// timers.
+func timerIRQ(tf *TrapFrame) {
+	cpu := CPUIndex()
+	cpus[cpu].timerTicks++
+	if cpu == 0 {
+		if ticklessReady() {
+			syncTicks()
+		} else {
+			ticks++
+		}
+		timer.Tick(ticks)
+	}
+	scheduler.Preempt()
+}
+
+func keyboardIRQ(tf *TrapFrame) {
 	// Read & buffer scancode -> rune (no terminal printing here!)
 	keyboard.IRQHandler()
-
-	// Tell PIC we're done with IRQ1, otherwise it won't fire again
-	PICEOI(1)
 }
 
 func GetTicks() uint64 {
@@ -1,11 +1,17 @@
 package kernel
 
 import (
+	"github.com/dmarro89/go-dav-os/acpi"
+	"github.com/dmarro89/go-dav-os/drivers/ata"
 	"github.com/dmarro89/go-dav-os/fs"
+	"github.com/dmarro89/go-dav-os/fs/fat16"
+	"github.com/dmarro89/go-dav-os/heap"
 	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/timer"
 	"github.com/dmarro89/go-dav-os/keyboard"
 	"github.com/dmarro89/go-dav-os/mem"
 	"github.com/dmarro89/go-dav-os/shell"
+	"github.com/dmarro89/go-dav-os/slab"
 	"github.com/dmarro89/go-dav-os/terminal"
 )
 
@@ -29,21 +35,63 @@ func Main(multibootInfoAddr uint64) {
 	terminal.Init()
 	terminal.Clear()
 
+	InitGDT()
 	InitIDT()
 
 	SyscallTest()
 
+	if mem.InitMultiboot(multibootInfoAddr) {
+		mem.InitPFA()
+	}
+	slab.Init()
+	if !InitPaging() {
+		terminal.Print("vmm: no page tables, staying on the boot map\n")
+	}
+	if !heap.Init() {
+		terminal.Print("heap: no vmm, new and make are unavailable\n")
+	}
+	heap.SetStopHook(cpuStopped)
+
+	if acpi.Init(mem.ACPIRSDP()) {
+		configureFromMADT()
+	}
+	InitClock()
+	ata.SetClockSource(Now)
+
+	timer.Init(tickHz)
+
 	PICRemap(0x20, 0x28)
-	PICSetMask(0xFC, 0xFF)
-	PITInit(100)
+	PICSetMask(0xFF, 0xFF) // everything masked until a handler is registered
+
+	if InitAPIC() {
+		// The LAPIC timer raises the IRQ0 vector itself, the PIT line
+		// stays masked on the IOAPIC.
+		irqHandlers[IRQTimer] = timerIRQ
+		LAPICTimerStart(tickHz)
+	} else {
+		PITInit(tickHz)
+		RegisterIRQ(IRQTimer, timerIRQ)
+	}
+	RegisterIRQ(IRQKeyboard, keyboardIRQ)
+
+	initWallClock()
+	fat16.SetTimeProvider(UnixTime)
 
 	shell.SetTickProvider(GetTicks)
+	shell.SetClockProvider(UnixTime, UptimeMillis)
+	shell.SetClockSource(Now, ClockSourceName)
+	shell.SetCPUProvider(CPUCount, CPUInfo)
+	shell.SetKeyProvider(keyboard.TryRead)
 
-	if mem.InitMultiboot(multibootInfoAddr) {
-		mem.InitPFA()
+	InitFPU()
+	if !InitStacks() {
+		terminal.Print("stacks: no vmm for task stacks, tasks disabled\n")
 	}
-
+	scheduler.SetCPUProvider(CPUIndex)
+	scheduler.SetIdleHook(idleWait)
+	scheduler.SetKickHook(kickCPU)
 	scheduler.Init()
+	StartAPs()
 
 	fs.Init()
 
@@ -51,13 +99,6 @@ func Main(multibootInfoAddr uint64) {
 	shell.Init()
 
 	for {
-		DisableInterrupts()
-		r, ok := keyboard.TryRead()
-		EnableInterrupts()
-		if !ok {
-			Halt()
-			continue
-		}
-		shell.FeedRune(r)
+		shell.FeedRune(keyboard.Read())
 	}
 }
@@ -0,0 +1,85 @@
+package kernel
+
+const vecPageFault = 14
+
+// Page-fault error code bits (Intel SDM Vol. 3, 4.7)
+const (
+	PFPresent       = 1 << 0 // 0: non-present page, 1: protection violation
+	PFWrite         = 1 << 1 // 0: read access, 1: write access
+	PFUser          = 1 << 2 // 0: supervisor mode, 1: user mode
+	PFReserved      = 1 << 3 // reserved bit set in a paging-structure entry
+	PFInstruction   = 1 << 4 // caused by an instruction fetch
+	PFProtectionKey = 1 << 5 // protection-key violation
+	PFShadowStack   = 1 << 6 // shadow-stack access
+)
+
+// PageFaultHandler lets a subsystem claim a page fault.
+// addr is the faulting linear address (CR2), errCode the #PF error code and
+// rip the faulting instruction. It returns true when the fault has been
+// resolved and the faulting instruction can simply be retried.
+type PageFaultHandler func(addr, errCode, rip uint64) bool
+
+const maxPageFaultHandlers = 8
+
+var (
+	pfHandlers     [maxPageFaultHandlers]PageFaultHandler
+	pfHandlerCount int
+)
+
+// RegisterPageFaultHandler adds h to the chain consulted on every #PF,
+// in registration order. Returns false if the table is full.
+func RegisterPageFaultHandler(h PageFaultHandler) bool {
+	if h == nil || pfHandlerCount >= maxPageFaultHandlers {
+		return false
+	}
+	pfHandlers[pfHandlerCount] = h
+	pfHandlerCount++
+	return true
+}
+
+// handlePageFault gives registered handlers a chance to resolve the fault.
+// If nobody claims it, print a decoded report; the caller dumps and halts.
+func handlePageFault(tf *TrapFrame) bool {
+	for i := 0; i < pfHandlerCount; i++ {
+		if pfHandlers[i](tf.CR2, tf.ErrorCode, tf.RIP) {
+			return true
+		}
+	}
+
+	reportPageFault(tf.CR2, tf.ErrorCode)
+	return false
+}
+
+func reportPageFault(addr, errCode uint64) {
+	faultPrint("\nPage fault at 0x")
+	faultHex64(addr)
+	faultPrint(":\n  ")
+
+	if errCode&PFPresent != 0 {
+		faultPrint("protection violation")
+	} else {
+		faultPrint("page not present")
+	}
+	if errCode&PFInstruction != 0 {
+		faultPrint(", instruction fetch")
+	} else if errCode&PFWrite != 0 {
+		faultPrint(", write")
+	} else {
+		faultPrint(", read")
+	}
+	if errCode&PFUser != 0 {
+		faultPrint(", user mode")
+	} else {
+		faultPrint(", kernel mode")
+	}
+	if errCode&PFReserved != 0 {
+		faultPrint(", reserved bit set")
+	}
+	if errCode&PFProtectionKey != 0 {
+		faultPrint(", protection key")
+	}
+	if errCode&PFShadowStack != 0 {
+		faultPrint(", shadow stack")
+	}
+	faultPrint("\n")
+}
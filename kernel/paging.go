@@ -0,0 +1,21 @@
+package kernel
+
+import "github.com/dmarro89/go-dav-os/vmm"
+
+const (
+	msrEFER = 0xC0000080
+	eferNXE = 1 << 11
+)
+
+// InitPaging hands the page tables over to the vmm. boot.s starts the
+// higher-half kernel on tables that also identity-map the first 4 GiB; the
+// vmm keeps only the direct map and the kernel image, .text executable and
+// everything else no-exec when boot.s could turn on EFER.NXE. CR0.WP is
+// set too, so read-only pages bind the kernel as well.
+func InitPaging() bool {
+	if !vmm.Init(rdmsr(msrEFER)&eferNXE != 0) {
+		return false
+	}
+	vmm.SetShootdownHook(tlbShootdown)
+	return true
+}
@@ -10,8 +10,13 @@ const (
 	icw4_8086 = 0x01
 
 	eoi = 0x20
+
+	ocw3ReadISR = 0x0B
 )
 
+// picMasks mirrors the IMR of the master [0] and slave [1] PIC
+var picMasks [2]byte
+
 func PICRemap(offset1, offset2 byte) {
 	// start init
 	outb(pic1Cmd, icw1Init)
@@ -31,10 +36,52 @@ func PICRemap(offset1, offset2 byte) {
 }
 
 func PICSetMask(masterMask, slaveMask byte) {
+	picMasks[0] = masterMask
+	picMasks[1] = slaveMask
 	outb(pic1Data, masterMask)
 	outb(pic2Data, slaveMask)
 }
 
+// PICUnmask enables a single IRQ line. Slave lines also need the
+// cascade (IRQ2) open on the master.
+func PICUnmask(irq byte) {
+	if irq >= 8 {
+		picMasks[1] &^= 1 << (irq - 8)
+		picMasks[0] &^= 1 << 2
+	} else {
+		picMasks[0] &^= 1 << irq
+	}
+	PICSetMask(picMasks[0], picMasks[1])
+}
+
+// PICMask disables a single IRQ line.
+func PICMask(irq byte) {
+	if irq >= 8 {
+		picMasks[1] |= 1 << (irq - 8)
+	} else {
+		picMasks[0] |= 1 << irq
+	}
+	PICSetMask(picMasks[0], picMasks[1])
+}
+
+// PICIsSpurious checks the In-Service Register for IRQ7/IRQ15. A spurious
+// IRQ15 still has to be acknowledged on the master, since the master did
+// see a real request on the cascade line.
+func PICIsSpurious(irq byte) bool {
+	if irq == 7 {
+		outb(pic1Cmd, ocw3ReadISR)
+		return inb(pic1Cmd)&0x80 == 0
+	}
+	if irq == 15 {
+		outb(pic2Cmd, ocw3ReadISR)
+		if inb(pic2Cmd)&0x80 == 0 {
+			outb(pic1Cmd, eoi)
+			return true
+		}
+	}
+	return false
+}
+
 func PICEOI(irq byte) {
 	// If the IRQ came from the slave PIC, we need to notify it first
 	if irq >= 8 {
@@ -13,3 +13,30 @@ func PITInit(hz uint32) {
 	outb(0x40, byte(div&0xFF))
 	outb(0x40, byte(div>>8))
 }
+
+// pitWait busy-waits for roughly us microseconds (max ~54 ms) using PIT
+// channel 2, which is not wired to an IRQ, so the tick on channel 0 keeps
+// running undisturbed. Used to calibrate other timers.
+func pitWait(us uint32) {
+	count := uint64(pitFreq) * uint64(us) / 1000000
+	if count > 0xFFFF {
+		count = 0xFFFF
+	}
+	if count == 0 {
+		count = 1
+	}
+
+	// port 0x61: bit 0 = channel 2 gate, bit 1 = speaker, bit 5 = OUT2
+	ctrl := inb(0x61) &^ 0x03
+	outb(0x61, ctrl)
+
+	// channel 2, lobyte/hibyte, mode 0 (interrupt on terminal count)
+	outb(0x43, 0xB0)
+	outb(0x42, byte(count&0xFF))
+	outb(0x42, byte(count>>8))
+
+	outb(0x61, ctrl|0x01)
+	for inb(0x61)&0x20 == 0 {
+	}
+	outb(0x61, ctrl)
+}
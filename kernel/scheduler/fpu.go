@@ -0,0 +1,159 @@
+package scheduler
+
+import "unsafe"
+
+// Assembly hooks (switch.s)
+func setTS()
+func clearTS()
+func fxsave(area uintptr)
+func fxrstor(area uintptr)
+func xsave(area uintptr, mask uint64)
+func xrstor(area uintptr, mask uint64)
+
+const (
+	// Big enough for x87, SSE and AVX (832 bytes in the standard XSAVE
+	// layout). The kernel only enables components that fit.
+	FPUAreaSize = 1024
+	fpuAlign    = 64
+
+	// Reset values, as after FNINIT and power-on
+	fpuInitFCW   = 0x037F
+	fpuInitMXCSR = 0x1F80
+	fpuOffMXCSR  = 24
+)
+
+var (
+	fpuReady bool
+	fpuXSAVE bool
+	fpuMask  uint64
+
+	// clean state handed to interrupt handlers that touch the FPU
+	scratchFPU [FPUAreaSize + fpuAlign]byte
+)
+
+// SetFPUMode enables lazy FPU switching. With xsaveMask == 0 state is
+// saved with FXSAVE (x87 and SSE), otherwise with XSAVE for the given
+// XCR0 components. Called once by the kernel after it set up CR4/XCR0.
+func SetFPUMode(xsaveMask uint64) {
+	fpuXSAVE = xsaveMask != 0
+	fpuMask = xsaveMask
+	fpuReset(fpuAlignArea(&scratchFPU))
+	fpuReady = true
+}
+
+func fpuAlignArea(buf *[FPUAreaSize + fpuAlign]byte) uintptr {
+	return (uintptr(unsafe.Pointer(&buf[0])) + fpuAlign - 1) &^ (fpuAlign - 1)
+}
+
+// fpuReset fills an area with the initial state: default control words,
+// everything else zero. An all-zero XSAVE header marks the extended
+// components as being in their init state.
+func fpuReset(area uintptr) {
+	for i := uintptr(0); i < FPUAreaSize; i++ {
+		*(*byte)(unsafe.Pointer(area + i)) = 0
+	}
+	*(*uint16)(unsafe.Pointer(area)) = fpuInitFCW
+	*(*uint32)(unsafe.Pointer(area + fpuOffMXCSR)) = fpuInitMXCSR
+}
+
+func fpuSave(area uintptr) {
+	if fpuXSAVE {
+		xsave(area, fpuMask)
+	} else {
+		fxsave(area)
+	}
+}
+
+func fpuRestore(area uintptr) {
+	if fpuXSAVE {
+		xrstor(area, fpuMask)
+	} else {
+		fxrstor(area)
+	}
+}
+
+// TrapEnter is called on entry to an interrupt that may switch tasks. It
+// sets CR0.TS so handler code that touches the FPU traps instead of
+// silently clobbering the interrupted task's registers.
+func TrapEnter() {
+	if !fpuReady {
+		return
+	}
+	runQueues[thisCPU()].inTrap = true
+	setTS()
+}
+
+// ExceptionEnter is TrapEnter for CPU exceptions the kernel handles and
+// returns from, such as page faults. It reports whether ExceptionLeave
+// has work to do: inside an interrupt the trap state is already set up.
+func ExceptionEnter() bool {
+	if !fpuReady {
+		return false
+	}
+	q := &runQueues[thisCPU()]
+	if q.inTrap {
+		return false
+	}
+	q.inTrap = true
+	setTS()
+	return true
+}
+
+// ExceptionLeave undoes ExceptionEnter before the handler returns to the
+// code it interrupted, as Switch does for interrupts.
+func ExceptionLeave(entered bool) {
+	if entered {
+		runQueues[thisCPU()].trapLeave()
+	}
+}
+
+// trapLeave runs at the end of Switch: the FPU is only left accessible if
+// it already holds the state of the task being resumed.
+func (q *runQueue) trapLeave() {
+	if !fpuReady {
+		return
+	}
+	q.inTrap = false
+	if q.fpuOwner == q.current {
+		clearTS()
+	} else {
+		setTS()
+	}
+}
+
+// FPUTrap handles #NM (device not available), raised by the first FPU
+// instruction after CR0.TS was set. The registers still hold the state of
+// the last task that used them; it is saved and the current task's state
+// is loaded. Inside an interrupt handler the FPU gets a clean scratch
+// state instead, and the owner reloads its own on next use.
+func FPUTrap() bool {
+	if !fpuReady {
+		return false
+	}
+	clearTS()
+	q := &runQueues[thisCPU()]
+
+	if q.inTrap {
+		if q.fpuOwner != nil {
+			fpuSave(q.fpuOwner.fpuArea())
+			q.fpuOwner = nil
+		}
+		fpuRestore(fpuAlignArea(&scratchFPU))
+		return true
+	}
+
+	cur := q.current
+	if q.fpuOwner == cur {
+		return true
+	}
+	if q.fpuOwner != nil {
+		fpuSave(q.fpuOwner.fpuArea())
+	}
+	fpuRestore(cur.fpuArea())
+	q.fpuOwner = cur
+	return true
+}
+
+func (t *Task) fpuArea() uintptr {
+	return fpuAlignArea(&t.fpu)
+}
@@ -0,0 +1,95 @@
+package scheduler
+
+import "unsafe"
+
+// TrapFrame is the register snapshot built on the stack by the interrupt
+// stubs in boot/stubs_amd64.s. Field order must match the push order there:
+// CR2 is pushed last (lowest address), the CPU-pushed frame sits on top.
+//
+// A task that is not running is fully described by its saved TrapFrame,
+// which lives on the task's own stack: every general purpose register,
+// RIP, RFLAGS and the CS/SS selectors, restored by iretq. DS, ES, FS and
+// GS are not used by the kernel in long mode.
+type TrapFrame struct {
+	CR2       uint64
+	R15       uint64
+	R14       uint64
+	R13       uint64
+	R12       uint64
+	R11       uint64
+	R10       uint64
+	R9        uint64
+	R8        uint64
+	RDI       uint64
+	RSI       uint64
+	RBP       uint64
+	RBX       uint64
+	RDX       uint64
+	RCX       uint64
+	RAX       uint64
+	Vector    uint64
+	ErrorCode uint64
+	RIP       uint64
+	CS        uint64
+	RFLAGS    uint64
+	RSP       uint64
+	SS        uint64
+}
+
+const (
+	// Must match kernelCodeSel/kernelDataSel in kernel/gdt.go
+	kernelCS = 0x08
+	kernelSS = 0x10
+
+	rflagsReserved = 1 << 1
+	rflagsIF       = 1 << 9
+)
+
+// funcPC returns the code address of fn. A gccgo func value points to a
+// descriptor whose first word is the code pointer.
+func funcPC(fn func()) uintptr {
+	return **(**uintptr)(unsafe.Pointer(&fn))
+}
+
+// taskExitAddr returns the address of the stub (switch.s) an entry
+// function returns to. The ret leaves RSP 16-byte aligned, so the stub
+// calls taskReturn rather than having the ret land in it directly.
+func taskExitAddr() uintptr
+
+// exitPC stands in for taskExitAddr in tests, which run without switch.s;
+// 0 means the stub.
+var exitPC uintptr
+
+// taskReturn is where a task lands if its entry function returns.
+func taskReturn() {
+	Exit(0)
+}
+
+// initFrame builds the TrapFrame a new task starts from: entry runs on
+// the task's stack with interrupts enabled, as if it had been called
+// from the task exit stub.
+func initFrame(t *Task, entry func()) *TrapFrame {
+	top := t.stackTop &^ 15
+
+	// After a call, RSP+8 is 16-byte aligned.
+	sp := top - 8
+	ret := exitPC
+	if ret == 0 {
+		ret = taskExitAddr()
+	}
+	*(*uintptr)(unsafe.Pointer(sp)) = ret
+
+	addr := sp - unsafe.Sizeof(TrapFrame{})
+	for i := uintptr(0); i < unsafe.Sizeof(TrapFrame{}); i++ {
+		*(*byte)(unsafe.Pointer(addr + i)) = 0
+	}
+	tf := (*TrapFrame)(unsafe.Pointer(addr))
+	tf.RIP = uint64(funcPC(entry))
+	// closures find their captured variables through the static chain
+	tf.R10 = uint64(*(*uintptr)(unsafe.Pointer(&entry)))
+	tf.CS = kernelCS
+	tf.RFLAGS = rflagsReserved | rflagsIF
+	tf.RSP = uint64(sp)
+	tf.SS = kernelSS
+	return tf
+}
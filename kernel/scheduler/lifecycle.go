@@ -0,0 +1,236 @@
+package scheduler
+
+import "github.com/dmarro89/go-dav-os/kernel/timer"
+
+// exitRecord keeps the status of a reaped task until its parent collects
+// it with Wait.
+type exitRecord struct {
+	valid  bool
+	id     int
+	parent int
+	status int
+}
+
+var (
+	// Ring of recent exits: once full, the oldest record is overwritten,
+	// so a parent that never calls Wait does not pin anything.
+	exits    [MaxTasks]exitRecord
+	exitNext int
+)
+
+func resetExits() {
+	for i := 0; i < MaxTasks; i++ {
+		exits[i].valid = false
+	}
+	exitNext = 0
+}
+
+// findTask returns the live (possibly dead, not yet reaped) task with the
+// given ID. Callers hold tasksLock.
+func findTask(id int) *Task {
+	if id < 0 {
+		return nil
+	}
+	for i := 0; i < MaxTasks; i++ {
+		if t := tasks[i]; t != nil && t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// exitTask runs t's exit hook, marks t dead, hands its children to task
+// 0 and wakes its parent if it is waiting for t.
+func exitTask(t *Task, status int) {
+	if fn := t.exitHook; fn != nil {
+		t.exitHook = nil
+		fn(t.exitArg)
+	}
+	flags := tasksLock.Lock()
+	t.ExitStatus = status
+	t.State = TaskDead
+	for i := 0; i < MaxTasks; i++ {
+		if c := tasks[i]; c != nil && c.Parent == t.ID {
+			c.Parent = 0
+		}
+	}
+	parent := findTask(t.Parent)
+	if parent != nil && parent.waitFor == t.ID && parent.State == TaskWaiting {
+		parent.State = TaskRunnable
+	} else {
+		parent = nil
+	}
+	tasksLock.Unlock(flags)
+
+	if parent != nil {
+		kick(parent.CPU)
+	}
+}
+
+// reap drops dead tasks from the queue and frees their pool slots. The
+// current task is skipped even if dead: Switch is still running on its
+// stack. Called with q.lock held and interrupts off.
+func (q *runQueue) reap() {
+	for i := 1; i < q.count; {
+		t := q.tasks[i]
+		if t.State != TaskDead || t == q.current {
+			i++
+			continue
+		}
+		for j := i; j < q.count-1; j++ {
+			q.tasks[j] = q.tasks[j+1]
+		}
+		q.count--
+		q.tasks[q.count] = nil
+		if q.fpuOwner == t {
+			q.fpuOwner = nil
+		}
+		release(t)
+	}
+}
+
+// release returns t's slot (and stack) to the pool, keeping its exit
+// status for the parent unless that was already collected.
+func release(t *Task) {
+	flags := tasksLock.Lock()
+	if t.Parent >= 0 {
+		r := &exits[exitNext]
+		r.valid = true
+		r.id = t.ID
+		r.parent = t.Parent
+		r.status = t.ExitStatus
+		exitNext = (exitNext + 1) % MaxTasks
+	}
+	freeSlotLocked(t)
+	tasksLock.Unlock(flags)
+}
+
+// Wait blocks until the child task id has exited and returns the status
+// it passed to Exit (or SYS_EXIT). It fails if id is not a child of the
+// calling task or its status was already collected. Only the last
+// MaxTasks exits are remembered after their tasks are reaped.
+func Wait(id int) (int, bool) {
+	cur := current()
+	if cur == nil {
+		return 0, false
+	}
+	for {
+		flags := tasksLock.Lock()
+		t := findTask(id)
+		if t != nil && t.Parent == cur.ID {
+			if t.State != TaskDead {
+				cur.waitFor = id
+				cur.State = TaskWaiting
+				tasksLock.Unlock(flags)
+				block(cur)
+				cur.waitFor = -1
+				continue
+			}
+			// dead but not reaped yet: collect it here
+			status := t.ExitStatus
+			t.Parent = -1
+			tasksLock.Unlock(flags)
+			return status, true
+		}
+		if t == nil {
+			for i := 0; i < MaxTasks; i++ {
+				r := &exits[i]
+				if r.valid && r.id == id && r.parent == cur.ID {
+					r.valid = false
+					tasksLock.Unlock(flags)
+					return r.status, true
+				}
+			}
+		}
+		tasksLock.Unlock(flags)
+		return 0, false
+	}
+}
+
+// SetExitHook arranges for fn(arg) to run if the current task exits, or
+// is killed, before it sets another hook; nil clears it. A task blocked
+// in a primitive that keeps state about its waiters may be killed and
+// never return from the wait, so the primitive sets a hook that undoes
+// that state. Set and clear it with interrupts off, together with the
+// state it undoes. fn may run on another task's switch with interrupts
+// off and the run queue locked: it may only take spinlocks.
+func SetExitHook(fn func(arg uint64), arg uint64) {
+	if cur := current(); cur != nil {
+		cur.exitHook = fn
+		cur.exitArg = arg
+	}
+}
+
+// KillStatus is the exit status of a task ended by Kill.
+const KillStatus = -1
+
+// Kill ends task id with KillStatus. A blocked task is woken to die; in
+// every case the task is marked dead by the next switch on its CPU, so it
+// runs at most until the end of its current tick. Locks the task holds
+// are not released. The boot and idle tasks cannot be killed.
+func Kill(id int) bool {
+	flags := tasksLock.Lock()
+	t := findTask(id)
+	ok := t != nil && t.State != TaskDead && !t.pinned
+	self := ok && t == current()
+	cpu := -1
+	if ok {
+		t.killed = true
+	}
+	if ok && !self {
+		// all under tasksLock, so t cannot be reaped and its slot reused
+		// meanwhile
+		if t.sleepTimer >= 0 {
+			// may be too late if the timer already expired; wakeTask
+			// then finds the task gone or past this Sleep
+			timer.Cancel(t.sleepTimer)
+		}
+		if wq := t.waitQ; wq != nil {
+			wq.cancel(t)
+		}
+		if t.State == TaskWaiting {
+			// blocked in Sleep or Wait
+			t.State = TaskRunnable
+		}
+		cpu = t.CPU
+	}
+	tasksLock.Unlock(flags)
+
+	if self {
+		Exit(KillStatus)
+	}
+	if cpu >= 0 {
+		kick(cpu)
+	}
+	return ok
+}
+
+// killPending marks killed tasks dead: the current task, which is being
+// switched out, and runnable ones, so they never run again. Waiting tasks
+// are left alone until Kill's wake-up makes them runnable. Called with
+// q.lock held and interrupts off.
+func (q *runQueue) killPending() {
+	for i := 1; i < q.count; i++ {
+		t := q.tasks[i]
+		if !t.killed || t.State == TaskDead {
+			continue
+		}
+		if t == q.current || t.State == TaskRunnable {
+			exitTask(t, KillStatus)
+		}
+	}
+}
+
+// block runs other tasks, or idles in place, until cur is made runnable
+// again. A task killed while blocked exits here. The idle hook checks
+// the state again with interrupts off before it halts.
+func block(cur *Task) {
+	for cur.State == TaskWaiting {
+		Yield()
+		idle()
+	}
+	if cur.killed {
+		Exit(KillStatus)
+	}
+	cur.State = TaskRunning
+}
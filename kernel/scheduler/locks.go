@@ -0,0 +1,146 @@
+package scheduler
+
+import "github.com/dmarro89/go-dav-os/kernel/sync"
+
+// Mutex is a sleeping lock for kernel tasks: a task that finds it held
+// waits in TaskWaiting instead of spinning. It must not be taken from
+// interrupt handlers; use a sync.IRQSpinLock there. The zero value is
+// unlocked.
+type Mutex struct {
+	wq     WaitQueue
+	locked bool
+	owner  int // task ID of the holder, -1 before a task scheduler exists
+}
+
+// Lock acquires the mutex, blocking while another task holds it.
+func (m *Mutex) Lock() {
+	for {
+		flags := sync.SaveIRQ()
+		m.wq.lock.Lock()
+		if !m.locked {
+			m.locked = true
+			m.owner = CurrentTaskID()
+			m.wq.lock.Unlock()
+			sync.RestoreIRQ(flags)
+			return
+		}
+		m.wq.sleepLocked(flags)
+	}
+}
+
+// TryLock acquires the mutex if it is free and reports whether it did.
+func (m *Mutex) TryLock() bool {
+	flags := sync.SaveIRQ()
+	m.wq.lock.Lock()
+	ok := !m.locked
+	if ok {
+		m.locked = true
+		m.owner = CurrentTaskID()
+	}
+	m.wq.lock.Unlock()
+	sync.RestoreIRQ(flags)
+	return ok
+}
+
+// Unlock releases the mutex and wakes the longest waiting task, which
+// then competes for it again.
+func (m *Mutex) Unlock() {
+	flags := sync.SaveIRQ()
+	m.wq.lock.Lock()
+	m.locked = false
+	m.wq.wakeLocked()
+	m.wq.lock.Unlock()
+	sync.RestoreIRQ(flags)
+}
+
+// Owner returns the ID of the task holding the mutex and whether it is
+// held at all.
+func (m *Mutex) Owner() (int, bool) {
+	return m.owner, m.locked
+}
+
+// Semaphore is a counting semaphore. Release may be called from interrupt
+// handlers, so a driver can hand out one unit per completed event.
+type Semaphore struct {
+	wq    WaitQueue
+	count int
+}
+
+// Init sets the number of available units. The zero value has none.
+func (s *Semaphore) Init(count int) {
+	flags := sync.SaveIRQ()
+	s.wq.lock.Lock()
+	s.count = count
+	s.wq.lock.Unlock()
+	sync.RestoreIRQ(flags)
+}
+
+// Acquire takes one unit, blocking until one is available.
+func (s *Semaphore) Acquire() {
+	for {
+		flags := sync.SaveIRQ()
+		s.wq.lock.Lock()
+		if s.count > 0 {
+			s.count--
+			s.wq.lock.Unlock()
+			sync.RestoreIRQ(flags)
+			return
+		}
+		s.wq.sleepLocked(flags)
+	}
+}
+
+// TryAcquire takes one unit if available and reports whether it did.
+func (s *Semaphore) TryAcquire() bool {
+	flags := sync.SaveIRQ()
+	s.wq.lock.Lock()
+	ok := s.count > 0
+	if ok {
+		s.count--
+	}
+	s.wq.lock.Unlock()
+	sync.RestoreIRQ(flags)
+	return ok
+}
+
+// Release returns one unit and wakes a waiter.
+func (s *Semaphore) Release() {
+	flags := sync.SaveIRQ()
+	s.wq.lock.Lock()
+	s.count++
+	s.wq.wakeLocked()
+	s.wq.lock.Unlock()
+	sync.RestoreIRQ(flags)
+}
+
+// Count returns the number of available units.
+func (s *Semaphore) Count() int {
+	return s.count
+}
+
+// Cond is a condition variable: tasks wait for a state change guarded by
+// a Mutex, and whoever changes it calls Signal or Broadcast. As with any
+// condition variable, waiters must re-check their condition in a loop.
+type Cond struct {
+	wq WaitQueue
+}
+
+// Wait unlocks m, blocks until signalled and locks m again. The task is
+// queued before m is released, so a Signal sent right after cannot be
+// missed.
+func (c *Cond) Wait(m *Mutex) {
+	flags := c.wq.Prepare()
+	m.Unlock()
+	c.wq.Block(flags)
+	m.Lock()
+}
+
+// Signal wakes one waiting task, if any.
+func (c *Cond) Signal() {
+	c.wq.Wake()
+}
+
+// Broadcast wakes every waiting task.
+func (c *Cond) Broadcast() {
+	c.wq.WakeAll()
+}
@@ -0,0 +1,245 @@
+package scheduler
+
+import "github.com/dmarro89/go-dav-os/kernel/sync"
+
+// Policy decides which task a CPU runs next. Its methods are called with
+// the CPU's run queue locked and interrupts off, so they must not block.
+// queue is the run queue of one CPU; entry 0 is its boot or idle task.
+type Policy interface {
+	Name() string
+
+	// Enqueue is called when t joins queue (t is already in it).
+	Enqueue(t *Task, queue []*Task)
+
+	// Tick charges one timer tick to the running task t.
+	Tick(t *Task)
+
+	// Pick returns the index in queue of the task to run next, or -1 if
+	// there is none. cur is the index of the running task: it competes
+	// while it is still TaskRunning, unless it yielded.
+	Pick(queue []*Task, cur int, yield bool) int
+}
+
+const (
+	MinNice = -20
+	MaxNice = 19
+
+	// aging: a passed-over task gains one priority level per switch, so
+	// even a nice 19 task runs after at most 39 decisions
+	maxAge = MaxNice - MinNice
+
+	// load weight of a nice 0 task (fair policy)
+	niceZeroWeight = 1024
+
+	// A task waking up from a long sleep may not be more than this many
+	// nice-0 ticks behind the running task, or it would hold the CPU
+	// until it caught up.
+	sleeperCredit = 3 * niceZeroWeight
+)
+
+// Relative CPU share per nice level (Linux sched_prio_to_weight): each
+// step is about 10% of CPU time.
+var niceWeights = [MaxNice - MinNice + 1]uint64{
+	88761, 71755, 56483, 46273, 36291,
+	29154, 23254, 18705, 14949, 11916,
+	9548, 7620, 6100, 4904, 3906,
+	3121, 2501, 1991, 1586, 1277,
+	1024, 820, 655, 526, 423,
+	335, 272, 215, 172, 137,
+	110, 87, 70, 56, 45,
+	36, 29, 23, 18, 15,
+}
+
+var (
+	rrPolicy   roundRobin
+	prioPolicy priorityAging
+	fairPolicy fair
+
+	// index for PolicyAt; a single word, so every CPU reads it whole
+	activePolicy int
+)
+
+// candidate reports whether queue[i] may be picked.
+func candidate(queue []*Task, i, cur int, yield bool) bool {
+	t := queue[i]
+	if i == cur {
+		return t.State == TaskRunning && !yield
+	}
+	return t.State == TaskRunnable
+}
+
+// roundRobin gives every runnable task one tick in turn, ignoring nice.
+type roundRobin struct{}
+
+func (*roundRobin) Name() string                   { return "rr" }
+func (*roundRobin) Enqueue(t *Task, queue []*Task) {}
+func (*roundRobin) Tick(t *Task)                   {}
+
+func (*roundRobin) Pick(queue []*Task, cur int, yield bool) int {
+	n := len(queue)
+	for i := 1; i <= n; i++ {
+		idx := (cur + i) % n
+		if candidate(queue, idx, cur, yield) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// priorityAging runs the task with the best effective priority, its nice
+// value minus the number of times it was passed over. Ties go round-robin.
+type priorityAging struct{}
+
+func (*priorityAging) Name() string { return "prio" }
+
+func (*priorityAging) Enqueue(t *Task, queue []*Task) { t.age = 0 }
+func (*priorityAging) Tick(t *Task)                   {}
+
+func (*priorityAging) Pick(queue []*Task, cur int, yield bool) int {
+	n := len(queue)
+	best := -1
+	bestPrio := 0
+	for i := 1; i <= n; i++ {
+		idx := (cur + i) % n
+		if !candidate(queue, idx, cur, yield) {
+			continue
+		}
+		t := queue[idx]
+		p := t.Priority - t.age
+		if best < 0 || p < bestPrio {
+			best, bestPrio = idx, p
+		}
+	}
+	for i := 0; i < n; i++ {
+		t := queue[i]
+		if i == best {
+			t.age = 0
+		} else if t.State == TaskRunnable && t.age < maxAge {
+			t.age++
+		}
+	}
+	return best
+}
+
+// fair is a CFS-like policy: every task accumulates virtual runtime, real
+// ticks scaled down by its weight, and the task that is furthest behind
+// runs next.
+type fair struct{}
+
+func (*fair) Name() string { return "fair" }
+
+// New tasks start level with the queue instead of at 0, which would let
+// them monopolise the CPU.
+func (*fair) Enqueue(t *Task, queue []*Task) {
+	t.vruntime = minVruntime(queue, t)
+}
+
+func (*fair) Tick(t *Task) {
+	t.vruntime += niceZeroWeight * niceZeroWeight / niceWeight(t.Priority)
+}
+
+func (*fair) Pick(queue []*Task, cur int, yield bool) int {
+	n := len(queue)
+	var floor uint64
+	if cur >= 0 && queue[cur].vruntime > sleeperCredit {
+		floor = queue[cur].vruntime - sleeperCredit
+	}
+	best := -1
+	for i := 1; i <= n; i++ {
+		idx := (cur + i) % n
+		if !candidate(queue, idx, cur, yield) {
+			continue
+		}
+		t := queue[idx]
+		if t.vruntime < floor {
+			t.vruntime = floor
+		}
+		if best < 0 || t.vruntime < queue[best].vruntime {
+			best = idx
+		}
+	}
+	return best
+}
+
+func minVruntime(queue []*Task, skip *Task) uint64 {
+	var least uint64
+	found := false
+	for _, t := range queue {
+		if t == skip || t.State == TaskDead {
+			continue
+		}
+		if !found || t.vruntime < least {
+			least = t.vruntime
+			found = true
+		}
+	}
+	return least
+}
+
+func niceWeight(nice int) uint64 {
+	return niceWeights[clampNice(nice)-MinNice]
+}
+
+func clampNice(nice int) int {
+	if nice < MinNice {
+		return MinNice
+	}
+	if nice > MaxNice {
+		return MaxNice
+	}
+	return nice
+}
+
+// PolicyCount returns the number of built-in policies.
+func PolicyCount() int { return 3 }
+
+// PolicyAt returns the i-th built-in policy, nil if out of range.
+func PolicyAt(i int) Policy {
+	switch i {
+	case 0:
+		return &rrPolicy
+	case 1:
+		return &prioPolicy
+	case 2:
+		return &fairPolicy
+	}
+	return nil
+}
+
+// ActivePolicy returns the policy in use.
+func ActivePolicy() Policy { return PolicyAt(activePolicy) }
+
+// SetPolicy switches every CPU to the i-th built-in policy. Accounting of
+// the previous policy is dropped so no task starts with an advantage.
+func SetPolicy(i int) bool {
+	if PolicyAt(i) == nil {
+		return false
+	}
+	activePolicy = i
+	for c := 0; c < MaxCPUs; c++ {
+		q := &runQueues[c]
+		flags := sync.SaveIRQ()
+		q.lock.Lock()
+		for j := 0; j < q.count; j++ {
+			q.tasks[j].vruntime = 0
+			q.tasks[j].age = 0
+		}
+		q.lock.Unlock()
+		sync.RestoreIRQ(flags)
+	}
+	return true
+}
+
+// SetPriority sets the nice value of task id, clamped to
+// [MinNice, MaxNice]. Lower values get more CPU time. It reports false
+// if no live task has that ID.
+func SetPriority(id int, nice int) bool {
+	flags := tasksLock.Lock()
+	t := findTask(id)
+	ok := t != nil && t.State != TaskDead
+	if ok {
+		t.Priority = clampNice(nice)
+	}
+	tasksLock.Unlock(flags)
+	return ok
+}
@@ -1,9 +1,12 @@
 package scheduler
 
-import "unsafe"
+import (
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+	"github.com/dmarro89/go-dav-os/kernel/timer"
+)
 
-const StackSize = 4096
 const MaxTasks = 16
+const MaxCPUs = 8
 
 type TaskState int
 
@@ -14,131 +17,574 @@ const (
 	TaskDead
 )
 
+// Task stacks come from the allocator the kernel installs with
+// SetStackAllocator. Their size is a whole number of pages.
+const (
+	DefaultStackSize = 16 * 1024
+	MaxStackSize     = 60 * 1024
+	stackPageSize    = 4096
+)
+
+// YieldVector is the software interrupt behind Yield. The kernel routes
+// it to Switch, like the IRQ path.
+const YieldVector = 0x81
+
 type Task struct {
-	ID    int
-	ESP   uint64
-	State TaskState
-	Stack [StackSize]byte
+	ID     int
+	Name   string
+	Parent int        // ID of the creating task, -1 for boot/idle tasks
+	Frame  *TrapFrame // saved context while not running, on Stack
+	State  TaskState
+	CPU    int
+
+	// stack of the task, [stackBase, stackTop); zero for boot and idle
+	// tasks, which run on their CPU's boot stack
+	stackBase uintptr
+	stackTop  uintptr
+	slot      int // index in taskPool, passed to the stack allocator
+
+	ExitStatus int // valid once State is TaskDead
+	waitFor    int // child ID this task is blocked on in Wait, -1 if none
+	used       bool
+	pinned     bool   // boot or idle task: runs on its CPU's boot stack, never exits
+	killed     bool   // Kill was called, the task dies at its next switch
+	sleepTimer int    // timer ID of a pending Sleep, -1 if none
+	sleepGen   uint32 // counts Sleep calls, so wakeTask can tell a stale timer
+
+	waitQ    *WaitQueue // queue this task is blocked on, nil if none
+	waitNext *Task      // next task on waitQ
+
+	exitHook func(arg uint64) // SetExitHook: runs if the task exits
+	exitArg  uint64
+
+	Priority int    // nice value, MinNice (most CPU) to MaxNice
+	Runtime  uint64 // timer ticks spent running
+	Switches uint64 // times the task was switched in
+	vruntime uint64 // fair policy: weighted runtime
+	age      int    // prio policy: decisions this task was passed over
+
+	// FXSAVE/XSAVE image of the task's FPU/SSE/AVX registers while
+	// another task owns the FPU (fpu.go)
+	fpu [FPUAreaSize + fpuAlign]byte
+}
+
+// runQueue holds the tasks bound to one CPU. Tasks never migrate, so a
+// CPU only ever switches between entries of its own queue.
+type runQueue struct {
+	lock     sync.SpinLock
+	tasks    [MaxTasks]*Task
+	count    int
+	current  *Task
+	online   bool
+	switches uint64
+	resched  bool // switch at the end of the current interrupt
+	yield    bool // the current task gives up the CPU (Yield)
+
+	fpuOwner *Task // task whose state is live in the FPU registers
+	inTrap   bool  // inside an interrupt that started with TrapEnter
 }
 
 var (
-	tasks       [MaxTasks]*Task
-	taskCount   int
-	currentTask *Task
-	nextID      int = 1
+	tasks     [MaxTasks]*Task
+	taskCount int
+	tasksLock sync.IRQSpinLock
+	nextID    int = 1
+
+	runQueues [MaxCPUs]runQueue
+
+	// returns the index of the executing CPU, nil means CPU 0
+	cpuProvider func() int
+
+	// waits for the next interrupt when a blocked task has nothing to
+	// switch to, nil means spin
+	idleHook func()
+
+	// wakes a CPU that may be idling with its tick stopped, nil if the
+	// tick never stops
+	kickHook func(cpu int)
+
+	// returns the top of a stack of size bytes for pool slot slot, 0 on
+	// failure; nil means tasks cannot be created
+	stackAlloc func(slot int, size uintptr) uintptr
+	stackSize  uintptr = DefaultStackSize
 
 	// Static allocation for tasks to avoid 'newobject' heap allocation
 	taskPool [MaxTasks]Task
 )
 
-// CpuSwitch is defined in switch.s
-func CpuSwitch(oldESP *uint64, newESP uint64)
+// yieldTrap raises YieldVector (switch.s)
+func yieldTrap()
+
+// SetCPUProvider installs the function used to find out which CPU is
+// running, so every CPU schedules from its own run queue.
+func SetCPUProvider(fn func() int) { cpuProvider = fn }
+
+// SetIdleHook installs the function a blocked task calls while no other
+// task on its CPU is runnable, typically a hlt with interrupts enabled.
+// It must not halt once CurrentWaiting reports false.
+func SetIdleHook(fn func()) { idleHook = fn }
+
+// SetKickHook installs the function used to wake another CPU when a task
+// bound to it becomes runnable.
+func SetKickHook(fn func(cpu int)) { kickHook = fn }
+
+// SetStackAllocator installs the function that provides task stacks. A
+// slot's stack is requested each time a task is created in it, so the
+// allocator may keep the memory of a slot for reuse.
+func SetStackAllocator(fn func(slot int, size uintptr) uintptr) { stackAlloc = fn }
+
+// SetStackSize sets the stack size of tasks created from now on, rounded
+// up to whole pages. It fails for 0 or more than MaxStackSize.
+func SetStackSize(size uintptr) bool {
+	size = (size + stackPageSize - 1) &^ (stackPageSize - 1)
+	if size == 0 || size > MaxStackSize {
+		return false
+	}
+	stackSize = size
+	return true
+}
+
+// StackSize returns the stack size of new tasks.
+func StackSize() uintptr { return stackSize }
+
+func kick(cpu int) {
+	if kickHook != nil && cpu != thisCPU() {
+		kickHook(cpu)
+	}
+}
+
+func thisCPU() int {
+	if cpuProvider == nil {
+		return 0
+	}
+	c := cpuProvider()
+	if c < 0 || c >= MaxCPUs {
+		return 0
+	}
+	return c
+}
+
+func current() *Task {
+	return runQueues[thisCPU()].current
+}
 
+// Init registers the boot context as task 0 on CPU 0.
+// It runs before any other CPU is started, so no locking is needed.
 func Init() {
 	taskCount = 0
+	for i := 0; i < MaxTasks; i++ {
+		taskPool[i].used = false
+		tasks[i] = nil
+	}
+	resetExits()
+
 	// Init initial task (0)
 	t := &taskPool[0]
 	t.ID = 0
+	t.slot = 0
+	t.stackBase = 0
+	t.stackTop = 0
+	t.Name = "main"
+	t.Parent = -1
+	t.Priority = 0
+	t.Runtime = 0
+	t.Switches = 0
+	t.waitFor = -1
+	t.sleepTimer = -1
+	t.killed = false
+	t.pinned = true
+	t.used = true
 	t.State = TaskRunning
+	t.CPU = 0
 
 	tasks[0] = t
 	taskCount = 1
-	currentTask = t
+
+	q := &runQueues[0]
+	q.tasks[0] = t
+	q.count = 1
+	q.current = t
+	q.fpuOwner = t
+	q.online = true
 }
 
-func NewTask(entry func()) *Task {
-	if taskCount >= MaxTasks {
-		return nil
+// allocTask takes a free slot of the task pool, nil if it is full.
+// Slots, and the stacks in them, come back through reap.
+func allocTask() *Task {
+	flags := tasksLock.Lock()
+	var t *Task
+	for i := 0; i < MaxTasks; i++ {
+		if !taskPool[i].used {
+			t = &taskPool[i]
+			t.used = true
+			t.slot = i
+			t.stackBase = 0
+			t.stackTop = 0
+			t.ID = nextID
+			t.Parent = -1
+			t.Name = ""
+			t.waitFor = -1
+			t.sleepTimer = -1
+			t.killed = false
+			t.pinned = false
+			t.waitQ = nil
+			t.waitNext = nil
+			t.exitHook = nil
+			t.ExitStatus = 0
+			t.Priority = 0
+			t.Runtime = 0
+			t.Switches = 0
+			t.vruntime = 0
+			t.age = 0
+			nextID++
+			tasks[i] = t
+			taskCount++
+			break
+		}
+	}
+	tasksLock.Unlock(flags)
+	return t
+}
+
+// allocStack gets a stack of the current size for t from the allocator.
+func allocStack(t *Task) bool {
+	if stackAlloc == nil {
+		return false
 	}
+	size := stackSize
+	top := stackAlloc(t.slot, size)
+	if top == 0 {
+		return false
+	}
+	t.stackTop = top
+	t.stackBase = top - size
+	return true
+}
 
-	idx := taskCount
-	t := &taskPool[idx]
-	t.ID = nextID
-	nextID++
-	t.State = TaskRunnable
+// freeSlotLocked returns t's pool slot. Callers hold tasksLock.
+func freeSlotLocked(t *Task) {
+	tasks[t.slot] = nil
+	t.used = false
+	taskCount--
+}
 
-	// Setup stack
-	// Stack grows down from t.Stack[StackSize]
+func freeSlot(t *Task) {
+	flags := tasksLock.Lock()
+	freeSlotLocked(t)
+	tasksLock.Unlock(flags)
+}
 
-	sp := uintptr(unsafe.Pointer(&t.Stack[StackSize-1]))
-	sp = sp & ^uintptr(15)
+func (q *runQueue) add(t *Task) {
+	flags := sync.SaveIRQ()
+	q.lock.Lock()
+	q.tasks[q.count] = t
+	q.count++
+	ActivePolicy().Enqueue(t, q.tasks[:q.count])
+	q.lock.Unlock()
+	sync.RestoreIRQ(flags)
+}
 
-	// Store return addr (entry) and register placeholders
-	sp -= 8
-	*(*uintptr)(unsafe.Pointer(sp)) = *(*uintptr)(unsafe.Pointer(&entry))
+// InitCPU registers the context running on an application processor as
+// that CPU's idle task and starts scheduling on it.
+func InitCPU(cpu int) bool {
+	if cpu <= 0 || cpu >= MaxCPUs {
+		return false
+	}
+	t := allocTask()
+	if t == nil {
+		return false
+	}
+	t.Name = "idle"
+	t.pinned = true
+	t.State = TaskRunning
+	t.CPU = cpu
+	t.Priority = MaxNice
 
-	sp -= 32 // 4 * 8 bytes for RBP, RBX, RSI, RDI
+	q := &runQueues[cpu]
+	q.add(t)
+	q.current = t
+	q.fpuOwner = t
+	q.online = true
+	return true
+}
 
-	t.ESP = uint64(sp)
+// pickCPU returns the online CPU with the fewest tasks.
+func pickCPU() int {
+	best := 0
+	for c := 1; c < MaxCPUs; c++ {
+		if runQueues[c].online && runQueues[c].count < runQueues[best].count {
+			best = c
+		}
+	}
+	return best
+}
 
-	tasks[idx] = t
-	taskCount++
+// NewTask starts entry as a new task on the least loaded CPU, nil if the
+// task pool is full.
+func NewTask(entry func()) *Task {
+	return NewNamedTask("task", entry)
+}
+
+// NewNamedTask is NewTask with a name for ps and top.
+func NewNamedTask(name string, entry func()) *Task {
+	t := allocTask()
+	if t == nil {
+		return nil
+	}
+	if !allocStack(t) {
+		freeSlot(t)
+		return nil
+	}
+	t.Name = name
+	t.State = TaskRunnable
+	t.Parent = CurrentTaskID()
+	paintStack(t)
+	t.Frame = initFrame(t, entry)
+	fpuReset(t.fpuArea())
+
+	t.CPU = pickCPU()
+	runQueues[t.CPU].add(t)
+	kick(t.CPU)
 	return t
 }
 
-func Exit() {
-	if currentTask == nil {
+// Exit ends the current task with the given status, which its parent
+// collects with Wait. The task's slot is reaped once another task runs.
+func Exit(status int) {
+	cur := current()
+	if cur == nil {
 		return
 	}
-	currentTask.State = TaskDead
-	Schedule()
-	// Should not return if Schedule switched
+	exitTask(cur, status)
+	Yield()
+	// Should not return if Yield switched
 	for {
 	}
 }
 
-func Schedule() {
-	if taskCount <= 1 {
+// Yield gives up the CPU to the next runnable task. It traps to
+// YieldVector so the switch goes through the same TrapFrame path as a
+// preemption, whatever the caller's interrupt state. The request is
+// made by the trap itself (YieldSwitch), so an interrupt taken before it
+// cannot consume it.
+func Yield() {
+	q := &runQueues[thisCPU()]
+	if q.count <= 1 {
 		return
 	}
+	yieldTrap()
+}
 
-	oldTask := currentTask
+// Preempt charges a tick to the running task and asks for a task switch
+// when the current interrupt returns. The timer interrupt calls it on
+// every tick.
+func Preempt() {
+	q := &runQueues[thisCPU()]
+	if cur := q.current; cur != nil {
+		cur.Runtime++
+		ActivePolicy().Tick(cur)
+	}
+	q.resched = true
+}
 
-	nextIndex := -1
-	currentIndex := -1
+// YieldSwitch is Switch for the YieldVector trap: the current task always
+// gives up the CPU, whatever interrupts did to the flags before it.
+func YieldSwitch(tf *TrapFrame) *TrapFrame {
+	q := &runQueues[thisCPU()]
+	q.resched = true
+	q.yield = true
+	return Switch(tf)
+}
 
-	for i := 0; i < taskCount; i++ {
-		if tasks[i] == currentTask {
-			currentIndex = i
-			break
-		}
+// Resched asks for a task switch when the current interrupt returns,
+// without charging a tick. The reschedule IPI calls it.
+func Resched() {
+	runQueues[thisCPU()].resched = true
+}
+
+// Switch runs with interrupts disabled on the way out of an interrupt,
+// with tf the frame of the interrupted task. If a switch was requested
+// it saves tf in the current task and returns the saved frame of the
+// next runnable one; otherwise, or if there is nothing else to run, it
+// returns tf unchanged. The interrupt stub resumes the returned frame.
+func Switch(tf *TrapFrame) *TrapFrame {
+	q := &runQueues[thisCPU()]
+	next := q.switchFrom(tf)
+	q.trapLeave()
+	return next
+}
+
+func (q *runQueue) switchFrom(tf *TrapFrame) *TrapFrame {
+	if !q.resched {
+		return tf
 	}
+	yield := q.yield
+	q.resched = false
+	q.yield = false
+	if q.count <= 1 {
+		return tf
+	}
+
+	q.lock.Lock()
+	q.killPending()
+	q.reap()
 
-	// Round-robin
-	for i := 1; i < taskCount; i++ {
-		idx := (currentIndex + i) % taskCount
-		if tasks[idx].State == TaskRunnable {
-			nextIndex = idx
+	oldTask := q.current
+
+	currentIndex := -1
+	for i := 0; i < q.count; i++ {
+		if q.tasks[i] == oldTask {
+			currentIndex = i
 			break
 		}
 	}
 
+	nextIndex := ActivePolicy().Pick(q.tasks[:q.count], currentIndex, yield)
+	if nextIndex == currentIndex {
+		q.lock.Unlock()
+		return tf
+	}
 	if nextIndex == -1 {
 		// No runnable task found.
-		// If current task is dead, we must find SOMETHING (maybe idle task 0?)
+		// If current task is dead, fall back to the CPU's first task
+		// (task 0 or the AP idle task), which never exits.
 		if oldTask.State == TaskDead {
-			// Fallback to task 0 usually, assuming it's permanent
 			nextIndex = 0
 		} else {
-			// Current task is still runnable, just return without switching
-			return
+			// Current task is still runnable, or waiting with nothing to
+			// switch to (the caller idles in place), so don't switch
+			q.lock.Unlock()
+			return tf
 		}
 	}
 
-	newTask := tasks[nextIndex]
+	newTask := q.tasks[nextIndex]
 
-	if oldTask.State != TaskDead {
+	oldTask.Frame = tf
+	if oldTask.State == TaskRunning {
 		oldTask.State = TaskRunnable
 	}
+	if oldTask.State == TaskDead && q.fpuOwner == oldTask {
+		q.fpuOwner = nil
+	}
 	newTask.State = TaskRunning
-	currentTask = newTask
+	newTask.Switches++
+	q.current = newTask
+	q.switches++
+	q.lock.Unlock()
 
-	CpuSwitch(&oldTask.ESP, newTask.ESP)
+	return newTask.Frame
+}
+
+// Sleep parks the current task in TaskWaiting for at least ms
+// milliseconds. Other tasks on the CPU run in the meantime; if there are
+// none, the task idles in place until its timer fires.
+func Sleep(ms uint64) {
+	cur := current()
+	if cur == nil || ms == 0 {
+		return
+	}
+
+	// The timer must not fire before the task is marked waiting.
+	flags := sync.SaveIRQ()
+	cur.sleepGen++
+	cur.State = TaskWaiting
+	deadline := timer.Ticks() + timer.MillisToTicks(ms)
+	id := timer.AddTimer(deadline, wakeTask, sleepArg(cur))
+	if id < 0 {
+		cur.State = TaskRunning
+		sync.RestoreIRQ(flags)
+		return
+	}
+	cur.sleepTimer = id
+	sync.RestoreIRQ(flags)
+
+	block(cur)
+	cur.sleepTimer = -1
+}
+
+// sleepArg packs the task ID and its sleep generation into the argument
+// of its Sleep timer.
+func sleepArg(t *Task) uint64 {
+	return uint64(t.ID)<<32 | uint64(t.sleepGen)
+}
+
+// wakeTask is the timer callback behind Sleep. Tick calls it after
+// dropping the timer lock, too late for Kill to cancel it, so it only
+// wakes the task if it still exists and is still in the Sleep that armed
+// the timer; a task that was killed meanwhile may be gone, and its slot
+// may hold another task.
+func wakeTask(arg uint64) {
+	flags := tasksLock.Lock()
+	t := findTask(int(arg >> 32))
+	ok := t != nil && t.sleepGen == uint32(arg) && t.State == TaskWaiting
+	cpu := -1
+	if ok {
+		t.State = TaskRunnable
+		cpu = t.CPU
+	}
+	tasksLock.Unlock(flags)
+	if ok {
+		kick(cpu)
+	}
+}
+
+func idle() {
+	if idleHook != nil {
+		idleHook()
+	}
 }
 
 func CurrentTaskID() int {
-	if currentTask == nil {
+	cur := current()
+	if cur == nil {
 		return -1
 	}
-	return currentTask.ID
+	return cur.ID
+}
+
+// CurrentWaiting reports whether the running task on this CPU is still
+// blocked. The idle hook calls it with interrupts disabled before it
+// halts, so a wake-up that landed since the task last checked its state
+// is not slept through.
+func CurrentWaiting() bool {
+	cur := current()
+	return cur != nil && cur.State == TaskWaiting
+}
+
+// HasRunnable reports whether a task other than the running one is
+// waiting for the given CPU. When it is not, the CPU may stop its tick.
+func HasRunnable(cpu int) bool {
+	if cpu < 0 || cpu >= MaxCPUs {
+		return false
+	}
+	q := &runQueues[cpu]
+	for i := 0; i < q.count; i++ {
+		if q.tasks[i] != q.current && q.tasks[i].State == TaskRunnable {
+			return true
+		}
+	}
+	return false
+}
+
+// CPUOnline reports whether the given CPU takes part in scheduling.
+func CPUOnline(cpu int) bool {
+	if cpu < 0 || cpu >= MaxCPUs {
+		return false
+	}
+	return runQueues[cpu].online
+}
+
+// CPUStats returns the number of tasks bound to a CPU, the ID of the task
+// it is running and how many context switches it has done.
+func CPUStats(cpu int) (count int, currentID int, switches uint64) {
+	if cpu < 0 || cpu >= MaxCPUs {
+		return 0, -1, 0
+	}
+	q := &runQueues[cpu]
+	currentID = -1
+	if q.current != nil {
+		currentID = q.current.ID
+	}
+	return q.count, currentID, q.switches
 }
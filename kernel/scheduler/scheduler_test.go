@@ -1,14 +1,37 @@
 package scheduler
 
-import "testing"
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/kernel/timer"
+)
+
+// testStacks backs task stacks in tests, one per pool slot
+var testStacks [MaxTasks][DefaultStackSize]byte
+
+func testStackAlloc(slot int, size uintptr) uintptr {
+	if size > DefaultStackSize {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&testStacks[slot][0])) + DefaultStackSize
+}
 
 func MockInit() {
 	taskCount = 0
-	currentTask = nil
+	cpuProvider = nil
+	idleHook = nil
+	activePolicy = 0
+	stackSize = DefaultStackSize
+	exitPC = funcPC(taskReturn)
+	SetStackAllocator(testStackAlloc)
 	// Reset tasks array if needed, though taskCount handles the logical reset
 	for i := 0; i < MaxTasks; i++ {
 		tasks[i] = nil
 	}
+	for i := 0; i < MaxCPUs; i++ {
+		runQueues[i] = runQueue{}
+	}
 }
 
 func TestInit(t *testing.T) {
@@ -32,7 +55,457 @@ func TestInit(t *testing.T) {
 		t.Errorf("Expected tasks[0].State to be TaskRunning, got %v", tasks[0].State)
 	}
 
-	if currentTask != tasks[0] {
+	if current() != tasks[0] {
 		t.Errorf("Expected currentTask to be tasks[0]")
 	}
+
+	if !CPUOnline(0) || CPUOnline(1) {
+		t.Errorf("Expected only CPU 0 to be online after Init")
+	}
+}
+
+func TestPickCPU(t *testing.T) {
+	MockInit()
+	Init()
+
+	runQueues[2].online = true
+	if c := pickCPU(); c != 2 {
+		t.Errorf("Expected the empty online CPU 2 to be picked, got %d", c)
+	}
+
+	runQueues[2].count = 3
+	if c := pickCPU(); c != 0 {
+		t.Errorf("Expected CPU 0 to be picked, got %d", c)
+	}
+}
+
+func TestSleepIdlesInPlace(t *testing.T) {
+	MockInit()
+	Init()
+	timer.Init(100)
+
+	// Nothing else is runnable, so Sleep must idle until the timer fires.
+	idles := 0
+	SetIdleHook(func() {
+		idles++
+		timer.Tick(timer.Ticks() + 1)
+	})
+	Sleep(50)
+
+	if idles != 5 {
+		t.Errorf("Expected 5 idle ticks for 50ms at 100Hz, got %d", idles)
+	}
+	if tasks[0].State != TaskRunning {
+		t.Errorf("Expected task 0 to be running after Sleep, got %v", tasks[0].State)
+	}
+	if timer.Pending() != 0 {
+		t.Errorf("Expected the sleep timer to be gone, got %d pending", timer.Pending())
+	}
+}
+
+func TestSwitchFrames(t *testing.T) {
+	MockInit()
+	Init()
+
+	task := NewTask(func() {})
+	if task == nil {
+		t.Fatalf("Expected NewTask to succeed")
+	}
+	if task.Frame == nil || task.Frame.RIP == 0 || task.Frame.CS != kernelCS ||
+		task.Frame.RFLAGS&rflagsIF == 0 || task.Frame.RSP%16 != 8 {
+		t.Errorf("Expected a new task to start from a kernel frame with interrupts on")
+	}
+
+	var boot TrapFrame
+	if got := Switch(&boot); got != &boot {
+		t.Errorf("Expected no switch without a reschedule request")
+	}
+
+	Preempt()
+	if got := Switch(&boot); got != task.Frame {
+		t.Errorf("Expected Switch to resume the new task's frame")
+	}
+	if tasks[0].Frame != &boot || tasks[0].State != TaskRunnable {
+		t.Errorf("Expected the preempted task to keep its frame and be runnable")
+	}
+	if current() != task || task.State != TaskRunning {
+		t.Errorf("Expected the new task to be current")
+	}
+
+	var frame TrapFrame
+	Preempt()
+	if got := Switch(&frame); got != &boot {
+		t.Errorf("Expected round-robin back to task 0")
+	}
+}
+
+func TestNewTaskFPUState(t *testing.T) {
+	MockInit()
+	Init()
+
+	task := NewTask(func() {})
+	if task == nil {
+		t.Fatalf("Expected NewTask to succeed")
+	}
+	area := task.fpuArea()
+	if area%fpuAlign != 0 {
+		t.Errorf("Expected the FPU area to be %d-byte aligned, got %#x", fpuAlign, area)
+	}
+	if fcw := *(*uint16)(unsafe.Pointer(area)); fcw != fpuInitFCW {
+		t.Errorf("Expected initial FCW %#x, got %#x", fpuInitFCW, fcw)
+	}
+	if mxcsr := *(*uint32)(unsafe.Pointer(area + fpuOffMXCSR)); mxcsr != fpuInitMXCSR {
+		t.Errorf("Expected initial MXCSR %#x, got %#x", fpuInitMXCSR, mxcsr)
+	}
+	if runQueues[0].fpuOwner != tasks[0] {
+		t.Errorf("Expected the boot task to own the FPU after Init")
+	}
+}
+
+func TestReapReusesSlots(t *testing.T) {
+	MockInit()
+	Init()
+
+	var boot TrapFrame
+	// Far more tasks than the pool holds, one at a time
+	for i := 0; i < 3*MaxTasks; i++ {
+		task := NewTask(func() {})
+		if task == nil {
+			t.Fatalf("Expected NewTask %d to succeed once dead tasks are reaped", i)
+		}
+		if task.Parent != 0 {
+			t.Errorf("Expected task 0 to be the parent, got %d", task.Parent)
+		}
+		exitTask(task, i)
+
+		Preempt()
+		Switch(&boot)
+		if taskCount != 1 || runQueues[0].count != 1 {
+			t.Fatalf("Expected the dead task to be reaped, %d tasks left", taskCount)
+		}
+	}
+}
+
+func TestWaitExitStatus(t *testing.T) {
+	MockInit()
+	Init()
+
+	child := NewTask(func() {})
+	id := child.ID
+	exitTask(child, 42)
+
+	// not reaped yet
+	if status, ok := Wait(id); !ok || status != 42 {
+		t.Errorf("Expected Wait to return 42, got %d (ok=%v)", status, ok)
+	}
+	if _, ok := Wait(id); ok {
+		t.Errorf("Expected a second Wait to fail")
+	}
+
+	// reaped before the parent waits
+	child = NewTask(func() {})
+	id = child.ID
+	exitTask(child, 7)
+	var boot TrapFrame
+	Preempt()
+	Switch(&boot)
+	if status, ok := Wait(id); !ok || status != 7 {
+		t.Errorf("Expected Wait on a reaped child to return 7, got %d (ok=%v)", status, ok)
+	}
+
+	if _, ok := Wait(12345); ok {
+		t.Errorf("Expected Wait on an unknown task to fail")
+	}
+}
+
+// runTicks preempts n times and counts how often each task was running.
+func runTicks(n int, counts map[*Task]int) {
+	var frame TrapFrame
+	for i := 0; i < n; i++ {
+		Preempt()
+		Switch(&frame)
+		counts[current()]++
+	}
+}
+
+func TestPolicyYieldSkipsCurrent(t *testing.T) {
+	for p := 0; p < PolicyCount(); p++ {
+		MockInit()
+		Init()
+		SetPolicy(p)
+		other := NewTask(func() {})
+
+		var frame TrapFrame
+		runQueues[0].resched = true
+		runQueues[0].yield = true
+		Switch(&frame)
+		if current() != other {
+			t.Errorf("%s: Expected a yielding task to give up the CPU", PolicyAt(p).Name())
+		}
+	}
+}
+
+func TestPriorityAgingNoStarvation(t *testing.T) {
+	MockInit()
+	Init()
+	SetPolicy(1)
+
+	hog := NewTask(func() {})
+	low := NewTask(func() {})
+	SetPriority(hog.ID, MinNice)
+	SetPriority(low.ID, MaxNice)
+
+	counts := map[*Task]int{}
+	runTicks(400, counts)
+	if counts[low] == 0 {
+		t.Errorf("Expected aging to let the nice 19 task run")
+	}
+	if counts[hog] <= counts[low] {
+		t.Errorf("Expected the nice -20 task to run more, got %d vs %d", counts[hog], counts[low])
+	}
+}
+
+func TestFairShares(t *testing.T) {
+	MockInit()
+	Init()
+	SetPolicy(2)
+
+	a := NewTask(func() {})
+	b := NewTask(func() {})
+	SetPriority(tasks[0].ID, MaxNice) // keep the boot task out of the way
+	SetPriority(b.ID, 5)
+
+	counts := map[*Task]int{}
+	runTicks(1000, counts)
+	if counts[a] <= counts[b] {
+		t.Errorf("Expected nice 0 to get more CPU than nice 5, got %d vs %d", counts[a], counts[b])
+	}
+	if counts[b] == 0 || counts[tasks[0]] == 0 {
+		t.Errorf("Expected every task to get some CPU, got %v", counts)
+	}
+
+	exitTask(a, 0)
+	if SetPriority(a.ID, 0) || SetPriority(999, 0) {
+		t.Errorf("Expected SetPriority of a dead or unknown task to fail")
+	}
+}
+
+func TestWaitQueueWake(t *testing.T) {
+	MockInit()
+	Init()
+
+	var q WaitQueue
+	if q.Wake() {
+		t.Errorf("Expected Wake on an empty queue to report false")
+	}
+
+	flags := q.Prepare()
+	if tasks[0].State != TaskWaiting || q.Len() != 1 {
+		t.Errorf("Expected Prepare to queue the task as waiting")
+	}
+	// a wake-up between Prepare and Block must not be lost
+	if !q.Wake() {
+		t.Errorf("Expected Wake to find the waiting task")
+	}
+	q.Block(flags)
+	if tasks[0].State != TaskRunning || q.Len() != 0 {
+		t.Errorf("Expected Block to return at once after an early Wake")
+	}
+
+	flags = q.Prepare()
+	q.Finish(flags)
+	if tasks[0].State != TaskRunning || q.Len() != 0 {
+		t.Errorf("Expected Finish to take the task off the queue")
+	}
+}
+
+func TestSemaphoreWakeFromIdle(t *testing.T) {
+	MockInit()
+	Init()
+
+	var s Semaphore
+	// stands in for an interrupt handler releasing the semaphore
+	idles := 0
+	SetIdleHook(func() {
+		idles++
+		s.Release()
+	})
+	s.Acquire()
+	if idles != 1 || s.Count() != 0 {
+		t.Errorf("Expected Acquire to block once, got %d idles and count %d", idles, s.Count())
+	}
+
+	s.Init(2)
+	if !s.TryAcquire() || !s.TryAcquire() || s.TryAcquire() {
+		t.Errorf("Expected exactly two units to be available")
+	}
+}
+
+func TestMutexAndCond(t *testing.T) {
+	MockInit()
+	Init()
+
+	var m Mutex
+	if !m.TryLock() {
+		t.Fatalf("Expected TryLock on a free mutex to succeed")
+	}
+	if owner, held := m.Owner(); !held || owner != 0 {
+		t.Errorf("Expected task 0 to hold the mutex, got %d (held=%v)", owner, held)
+	}
+	if m.TryLock() {
+		t.Errorf("Expected TryLock on a held mutex to fail")
+	}
+
+	// another task releases the mutex while we wait
+	SetIdleHook(func() { m.Unlock() })
+	m.Lock()
+	if _, held := m.Owner(); !held {
+		t.Errorf("Expected Lock to acquire the mutex after it was released")
+	}
+
+	var c Cond
+	ready := false
+	SetIdleHook(func() {
+		ready = true
+		c.Signal()
+	})
+	for !ready {
+		c.Wait(&m)
+	}
+	if _, held := m.Owner(); !held {
+		t.Errorf("Expected Cond.Wait to return with the mutex held")
+	}
+	m.Unlock()
+}
+
+func TestTaskInfo(t *testing.T) {
+	MockInit()
+	Init()
+
+	task := NewNamedTask("demo", func() {})
+	var info TaskInfo
+	if !TaskInfoAt(1, &info) || info.ID != task.ID || info.Name != "demo" || info.Parent != 0 {
+		t.Fatalf("Expected slot 1 to describe the new task, got %+v", info)
+	}
+	// only the initial frame is on the stack so far
+	if info.StackMax <= 0 || info.StackMax >= DefaultStackSize/2 {
+		t.Errorf("Expected a small stack high-water mark, got %d", info.StackMax)
+	}
+	if !TaskInfoAt(0, &info) || info.Name != "main" || info.StackMax != -1 {
+		t.Errorf("Expected slot 0 to be the boot task without a stack mark")
+	}
+	if TaskInfoAt(2, &info) {
+		t.Errorf("Expected slot 2 to be free")
+	}
+
+	var boot TrapFrame
+	Preempt()
+	Switch(&boot)
+	if task.Switches != 1 || TaskCount() != 2 {
+		t.Errorf("Expected one switch into the task, got %d", task.Switches)
+	}
+}
+
+func TestKill(t *testing.T) {
+	MockInit()
+	Init()
+
+	if Kill(0) {
+		t.Errorf("Expected the boot task not to be killable")
+	}
+
+	// a task blocked on a wait queue is woken and dies at the next switch,
+	// running its exit hook
+	task := NewTask(func() {})
+	var q WaitQueue
+	q.enqueue(task)
+	hookArg := uint64(0)
+	task.exitHook = func(arg uint64) { hookArg = arg }
+	task.exitArg = 7
+	if !Kill(task.ID) {
+		t.Fatalf("Expected Kill to succeed")
+	}
+	if q.Len() != 0 || task.State != TaskRunnable {
+		t.Errorf("Expected Kill to take the task off its wait queue")
+	}
+	var boot TrapFrame
+	Preempt()
+	if got := Switch(&boot); got != &boot {
+		t.Errorf("Expected the killed task never to run")
+	}
+	if status, ok := Wait(task.ID); !ok || status != KillStatus {
+		t.Errorf("Expected Wait to report KillStatus, got %d (ok=%v)", status, ok)
+	}
+	if hookArg != 7 {
+		t.Errorf("Expected the killed task's exit hook to run with its argument, got %d", hookArg)
+	}
+
+	// a sleeping task's timer is cancelled
+	timer.Init(100)
+	task = NewTask(func() {})
+	task.State = TaskWaiting
+	task.sleepTimer = timer.AddTimer(10, wakeTask, sleepArg(task))
+	Kill(task.ID)
+	if timer.Pending() != 0 {
+		t.Errorf("Expected Kill to cancel the sleep timer")
+	}
+	Preempt()
+	Switch(&boot)
+	if task.used {
+		t.Errorf("Expected the sleeping task to be dead and reaped after a switch")
+	}
+
+	// a timer that expired before Kill could cancel it does not wake
+	// the task that reuses the slot
+	stale := sleepArg(task)
+	next := NewTask(func() {})
+	next.State = TaskWaiting
+	wakeTask(stale)
+	if next.State != TaskWaiting {
+		t.Errorf("Expected a stale sleep timer to leave the slot's next task waiting")
+	}
+	next.sleepGen++
+	wakeTask(sleepArg(next) - 1)
+	if next.State != TaskWaiting {
+		t.Errorf("Expected a timer from an earlier Sleep not to wake the task")
+	}
+	wakeTask(sleepArg(next))
+	if next.State != TaskRunnable {
+		t.Errorf("Expected the task's own sleep timer to wake it")
+	}
+}
+
+func TestStackAllocation(t *testing.T) {
+	MockInit()
+	Init()
+
+	if SetStackSize(0) || SetStackSize(MaxStackSize+1) {
+		t.Errorf("Expected stack sizes of 0 and above MaxStackSize to be rejected")
+	}
+	if !SetStackSize(5000) || StackSize() != 2*stackPageSize {
+		t.Errorf("Expected 5000 bytes to round up to two pages, got %d", StackSize())
+	}
+	task := NewTask(func() {})
+	if task == nil || task.stackTop-task.stackBase != 2*stackPageSize {
+		t.Fatalf("Expected a two-page stack")
+	}
+	if task.Frame == nil || uintptr(unsafe.Pointer(task.Frame)) < task.stackBase ||
+		uintptr(unsafe.Pointer(task.Frame)) >= task.stackTop {
+		t.Errorf("Expected the initial frame to live on the task's stack")
+	}
+
+	// the allocator refuses: no task, and the slot is not lost
+	SetStackSize(MaxStackSize)
+	if NewTask(func() {}) != nil {
+		t.Errorf("Expected NewTask to fail without a stack")
+	}
+	if TaskCount() != 2 {
+		t.Errorf("Expected the pool slot to be returned, %d tasks", TaskCount())
+	}
+
+	SetStackAllocator(nil)
+	SetStackSize(DefaultStackSize)
+	if NewTask(func() {}) != nil {
+		t.Errorf("Expected NewTask to fail without a stack allocator")
+	}
 }
@@ -0,0 +1,84 @@
+package scheduler
+
+import "unsafe"
+
+// Task stacks are filled with this byte at creation; the deepest byte
+// that no longer holds it marks how much stack the task ever used.
+const stackPaint = 0x5A
+
+// TaskInfo is a snapshot of one task for ps and top.
+type TaskInfo struct {
+	ID       int
+	Parent   int
+	Name     string
+	State    TaskState
+	CPU      int
+	Priority int
+	Runtime  uint64 // timer ticks spent running
+	Switches uint64 // times switched in
+	StackMax int    // stack high-water mark in bytes, -1 for boot/idle tasks
+}
+
+func (s TaskState) String() string {
+	switch s {
+	case TaskRunnable:
+		return "ready"
+	case TaskRunning:
+		return "run"
+	case TaskWaiting:
+		return "wait"
+	case TaskDead:
+		return "dead"
+	}
+	return "?"
+}
+
+func paintStack(t *Task) {
+	for p := t.stackBase; p < t.stackTop; p++ {
+		*(*byte)(unsafe.Pointer(p)) = stackPaint
+	}
+}
+
+// stackHighWater returns how many bytes of its stack t has used so far.
+// Stacks grow down, so the scan starts at the bottom.
+func stackHighWater(t *Task) int {
+	p := t.stackBase
+	for p < t.stackTop && *(*byte)(unsafe.Pointer(p)) == stackPaint {
+		p++
+	}
+	return int(t.stackTop - p)
+}
+
+// TaskCount returns the number of tasks in the pool, dead ones that are
+// not reaped yet included.
+func TaskCount() int {
+	return taskCount
+}
+
+// TaskInfoAt fills info with the task in pool slot i (0 to MaxTasks-1)
+// and reports false if the slot is free.
+func TaskInfoAt(i int, info *TaskInfo) bool {
+	if i < 0 || i >= MaxTasks {
+		return false
+	}
+	flags := tasksLock.Lock()
+	t := tasks[i]
+	if t == nil {
+		tasksLock.Unlock(flags)
+		return false
+	}
+	info.ID = t.ID
+	info.Parent = t.Parent
+	info.Name = t.Name
+	info.State = t.State
+	info.CPU = t.CPU
+	info.Priority = t.Priority
+	info.Runtime = t.Runtime
+	info.Switches = t.Switches
+	info.StackMax = -1
+	if !t.pinned {
+		info.StackMax = stackHighWater(t)
+	}
+	tasksLock.Unlock(flags)
+	return true
+}
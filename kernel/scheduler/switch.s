@@ -2,23 +2,83 @@
 
 .code64
 .section .text
-/* Updated mangled name for github.com/dmarro89/go-dav-os/kernel/scheduler.CpuSwitch */
-.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.CpuSwitch
-.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.CpuSwitch, @function
+/* github.com/dmarro89/go-dav-os/kernel/scheduler.yieldTrap */
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.yieldTrap
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.yieldTrap, @function
 
-github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.CpuSwitch:
-	pushq %rbp
-	pushq %rbx
-	pushq %rsi
-	pushq %rdi
+/* The kernel's YieldVector (0x81) stub saves a full TrapFrame and returns
+   through Switch, so this task resumes right after the int when it is
+   scheduled again. */
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.yieldTrap:
+	int $0x81
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.yieldTrap, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.yieldTrap
+
+/* Entry functions of new tasks return here (initFrame). The ret leaves
+   RSP 16-byte aligned; the call gives taskReturn the alignment of any
+   other call. taskReturn exits the task and never comes back. */
+task_exit_stub:
+	call github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.taskReturn
+	ud2
+
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.taskExitAddr
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.taskExitAddr, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.taskExitAddr:
+	leaq task_exit_stub(%rip), %rax
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.taskExitAddr, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.taskExitAddr
+
+/* Lazy FPU switching (fpu.go). CR0.TS makes the next x87/SSE/AVX
+   instruction raise #NM. */
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.setTS
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.setTS, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.setTS:
+	movq %cr0, %rax
+	orq  $0x8, %rax
+	movq %rax, %cr0
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.setTS, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.setTS
 
-	# Args: old *uint64 in RDI, new uint64 in RSI.
-	movq %rsp, (%rdi)
-	movq %rsi, %rsp
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.clearTS
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.clearTS, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.clearTS:
+	clts
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.clearTS, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.clearTS
+
+/* fxsave(area uintptr) / fxrstor(area uintptr): area is 16-byte aligned */
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxsave
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxsave, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxsave:
+	fxsave64 (%rdi)
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxsave, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxsave
 
-	popq %rdi
-	popq %rsi
-	popq %rbx
-	popq %rbp
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxrstor
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxrstor, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxrstor:
+	fxrstor64 (%rdi)
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxrstor, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.fxrstor
+
+/* xsave(area uintptr, mask uint64) / xrstor(area uintptr, mask uint64):
+   area is 64-byte aligned, EDX:EAX selects the state components */
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xsave
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xsave, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xsave:
+	movq %rsi, %rax
+	movq %rsi, %rdx
+	shrq $32, %rdx
+	xsave64 (%rdi)
+	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xsave, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xsave
 
+.global github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xrstor
+.type   github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xrstor, @function
+github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xrstor:
+	movq %rsi, %rax
+	movq %rsi, %rdx
+	shrq $32, %rdx
+	xrstor64 (%rdi)
 	ret
+.size github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xrstor, . - github_0com_1dmarro89_1go_x2ddav_x2dos_1kernel_1scheduler.xrstor
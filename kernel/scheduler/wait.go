@@ -0,0 +1,193 @@
+package scheduler
+
+import "github.com/dmarro89/go-dav-os/kernel/sync"
+
+// WaitQueue is a FIFO of tasks blocked in TaskWaiting until another task
+// or an interrupt handler wakes them. Tasks are linked through their own
+// waitNext field, so a queue needs no storage of its own. The zero value
+// is an empty queue.
+type WaitQueue struct {
+	lock sync.SpinLock // always taken with interrupts off
+	head *Task
+	tail *Task
+}
+
+// Prepare puts the current task on the queue, marks it waiting and
+// disables interrupts. The caller then checks its wake-up condition and
+// calls Block if it still has to wait, or Finish if not, passing the
+// returned flags. A Wake in between (from another CPU) is not lost: it
+// makes the task runnable and Block returns at once.
+func (q *WaitQueue) Prepare() uint64 {
+	flags := sync.SaveIRQ()
+	if cur := current(); cur != nil {
+		q.lock.Lock()
+		q.enqueue(cur)
+		q.lock.Unlock()
+	}
+	return flags
+}
+
+// Block re-enables interrupts as saved by Prepare and waits until the
+// current task is woken.
+func (q *WaitQueue) Block(flags uint64) {
+	sync.RestoreIRQ(flags)
+	cur := current()
+	if cur == nil {
+		// no scheduler yet: let the caller poll its condition again
+		idle()
+		return
+	}
+	block(cur)
+	q.Finish(sync.SaveIRQ())
+}
+
+// Finish takes the current task off the queue, if it is still on it,
+// marks it running and restores the interrupt flag saved by Prepare.
+func (q *WaitQueue) Finish(flags uint64) {
+	if cur := current(); cur != nil {
+		q.lock.Lock()
+		q.remove(cur)
+		cur.State = TaskRunning
+		q.lock.Unlock()
+	}
+	sync.RestoreIRQ(flags)
+}
+
+// Sleep blocks the current task until it is woken.
+func (q *WaitQueue) Sleep() {
+	q.Block(q.Prepare())
+}
+
+// Wake makes the oldest waiter runnable and reports whether there was
+// one. Interrupt handlers may call it.
+func (q *WaitQueue) Wake() bool {
+	flags := sync.SaveIRQ()
+	q.lock.Lock()
+	woken := q.wakeLocked()
+	q.lock.Unlock()
+	sync.RestoreIRQ(flags)
+	return woken
+}
+
+// WakeAll makes every waiter runnable and returns how many there were.
+func (q *WaitQueue) WakeAll() int {
+	n := 0
+	for q.Wake() {
+		n++
+	}
+	return n
+}
+
+// Len returns the number of waiting tasks.
+func (q *WaitQueue) Len() int {
+	flags := sync.SaveIRQ()
+	q.lock.Lock()
+	n := 0
+	for t := q.head; t != nil; t = t.waitNext {
+		n++
+	}
+	q.lock.Unlock()
+	sync.RestoreIRQ(flags)
+	return n
+}
+
+// sleepLocked is Sleep for primitives whose state is guarded by q.lock:
+// called with q.lock held and flags from sync.SaveIRQ, it queues the task
+// before dropping the lock, so a waker that takes the lock next always
+// finds it. The lock is not held on return.
+func (q *WaitQueue) sleepLocked(flags uint64) {
+	cur := current()
+	if cur == nil {
+		q.lock.Unlock()
+		sync.RestoreIRQ(flags)
+		idle()
+		return
+	}
+	q.enqueue(cur)
+	q.lock.Unlock()
+	q.Block(flags)
+}
+
+// cancel takes t off the queue and makes it runnable, as Wake would.
+func (q *WaitQueue) cancel(t *Task) {
+	flags := sync.SaveIRQ()
+	q.lock.Lock()
+	if t.waitQ == q {
+		q.remove(t)
+		if t.State == TaskWaiting {
+			t.State = TaskRunnable
+		}
+	}
+	q.lock.Unlock()
+	sync.RestoreIRQ(flags)
+}
+
+// enqueue appends t, unless it is already queued. Called with q.lock held.
+func (q *WaitQueue) enqueue(t *Task) {
+	t.State = TaskWaiting
+	if t.waitQ == q {
+		return
+	}
+	t.waitQ = q
+	t.waitNext = nil
+	if q.tail == nil {
+		q.head = t
+	} else {
+		q.tail.waitNext = t
+	}
+	q.tail = t
+}
+
+// dequeue pops the oldest waiter, nil if there is none. Called with
+// q.lock held.
+func (q *WaitQueue) dequeue() *Task {
+	t := q.head
+	if t == nil {
+		return nil
+	}
+	q.head = t.waitNext
+	if q.head == nil {
+		q.tail = nil
+	}
+	t.waitNext = nil
+	t.waitQ = nil
+	return t
+}
+
+// remove unlinks t if it is on the queue. Called with q.lock held.
+func (q *WaitQueue) remove(t *Task) {
+	if t.waitQ != q {
+		return
+	}
+	var prev *Task
+	for c := q.head; c != nil; c = c.waitNext {
+		if c == t {
+			if prev == nil {
+				q.head = t.waitNext
+			} else {
+				prev.waitNext = t.waitNext
+			}
+			if q.tail == t {
+				q.tail = prev
+			}
+			break
+		}
+		prev = c
+	}
+	t.waitNext = nil
+	t.waitQ = nil
+}
+
+// wakeLocked wakes the oldest waiter. Tasks that left TaskWaiting some
+// other way (they exited, say) are dropped and do not count. Called with
+// q.lock held.
+func (q *WaitQueue) wakeLocked() bool {
+	for t := q.dequeue(); t != nil; t = q.dequeue() {
+		if t.State == TaskWaiting {
+			t.State = TaskRunnable
+			kick(t.CPU)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/acpi"
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/mem"
+	"github.com/dmarro89/go-dav-os/vmm"
+)
+
+// Assembly hooks (boot/stubs_amd64.s, boot/ap_trampoline.s)
+func getAPTrampolineStart() uint64
+func getAPTrampolineEnd() uint64
+func readCR3() uint64
+
+const (
+	maxCPUs = scheduler.MaxCPUs
+
+	// The trampoline runs in real mode, so it must live below 1 MiB at a
+	// page boundary: the SIPI vector is its page number.
+	apTrampolineAddr = 0x8000
+	apStackSize      = 16384
+
+	// Parameter block at the start of the trampoline (boot/ap_trampoline.s)
+	apParamCR3   = 8
+	apParamStack = 16
+	apParamCPU   = 24
+	apParamReady = 32
+
+	icrDeliveryInit    = 0x5 << 8
+	icrDeliveryStartup = 0x6 << 8
+	icrPending         = 1 << 12
+	icrLevelAssert     = 1 << 14
+	icrTriggerLevel    = 1 << 15
+
+	apStartTimeoutMs = 100
+)
+
+type cpuInfo struct {
+	apicID      uint8
+	online      bool
+	timerTicks  uint64
+	tickStopped bool // timer in one-shot mode while idle (tickless.go)
+}
+
+var (
+	cpus     [maxCPUs]cpuInfo
+	cpuCount = 1
+
+	// APIC ID -> CPU index, only valid once smpReady is set
+	apicToCPU [256]uint8
+	smpReady  bool
+
+	apStacks [maxCPUs][apStackSize]byte
+)
+
+// CPUIndex returns the index (0 = bootstrap processor) of the executing
+// CPU.
+func CPUIndex() int {
+	if !smpReady {
+		return 0
+	}
+	return int(apicToCPU[LAPICID()])
+}
+
+// CPUCount returns the number of CPUs that are online.
+func CPUCount() int { return cpuCount }
+
+// CPUInfo describes one CPU for the shell: its APIC ID, whether it is
+// online and how many timer interrupts it has taken.
+func CPUInfo(cpu int) (apicID uint8, online bool, timerTicks uint64) {
+	if cpu < 0 || cpu >= maxCPUs {
+		return 0, false, 0
+	}
+	c := &cpus[cpu]
+	return c.apicID, c.online, c.timerTicks
+}
+
+func apParam(off uintptr) uintptr {
+	return mem.PhysToVirt(apTrampolineAddr) + off
+}
+
+func copyTrampoline() {
+	start := uintptr(getAPTrampolineStart())
+	end := uintptr(getAPTrampolineEnd())
+	dst := mem.PhysToVirt(apTrampolineAddr)
+	for i := uintptr(0); start+i < end; i++ {
+		*(*byte)(unsafe.Pointer(dst + i)) = *(*byte)(unsafe.Pointer(start + i))
+	}
+}
+
+func lapicSendIPI(apicID uint8, low uint32) {
+	lapicWrite(lapicRegICRHigh, uint32(apicID)<<24)
+	lapicWrite(lapicRegICRLow, low)
+	for lapicRead(lapicRegICRLow)&icrPending != 0 {
+	}
+}
+
+// startAP wakes one application processor with the INIT-SIPI-SIPI
+// sequence and waits for it to report in.
+func startAP(cpu int, apicID uint8) bool {
+	stack := &apStacks[cpu]
+	top := uint64(uintptr(unsafe.Pointer(&stack[apStackSize-1]))) &^ 15
+
+	*(*uint64)(unsafe.Pointer(apParam(apParamStack))) = top
+	*(*uint64)(unsafe.Pointer(apParam(apParamCPU))) = uint64(cpu)
+	mmioWrite32(apParam(apParamReady), 0)
+
+	cpus[cpu].apicID = apicID
+	apicToCPU[apicID] = uint8(cpu)
+
+	lapicSendIPI(apicID, icrDeliveryInit|icrLevelAssert|icrTriggerLevel)
+	lapicSendIPI(apicID, icrDeliveryInit|icrTriggerLevel) // de-assert
+	pitWait(10000)
+
+	sipi := uint32(icrDeliveryStartup | icrLevelAssert | apTrampolineAddr>>12)
+	for i := 0; i < 2; i++ {
+		lapicSendIPI(apicID, sipi)
+		pitWait(200)
+		if mmioRead32(apParam(apParamReady)) != 0 {
+			return true
+		}
+	}
+
+	for ms := 0; ms < apStartTimeoutMs; ms++ {
+		if mmioRead32(apParam(apParamReady)) != 0 {
+			return true
+		}
+		pitWait(1000)
+	}
+	apicToCPU[apicID] = 0
+	return false
+}
+
+// StartAPs brings up every enabled CPU listed in the MADT. It needs the
+// local APIC and must run after scheduler.Init. Returns the number of
+// online CPUs.
+func StartAPs() int {
+	bsp := LAPICID()
+	cpus[0].apicID = bsp
+	cpus[0].online = true
+	apicToCPU[bsp] = 0
+	smpReady = true
+
+	if !useAPIC || acpi.CPUCount() <= 1 {
+		return cpuCount
+	}
+
+	copyTrampoline()
+	*(*uint64)(unsafe.Pointer(apParam(apParamCR3))) = readCR3()
+
+	// An AP turns on paging while it runs the trampoline, so the page
+	// needs an identity mapping until every AP is up. The boot tables
+	// still have one.
+	identity := vmm.Ready() && vmm.Map(apTrampolineAddr, apTrampolineAddr, 0)
+
+	for i := 0; i < acpi.CPUCount() && cpuCount < maxCPUs; i++ {
+		c := acpi.CPUEntry(i)
+		if !c.Enabled || c.APICID == bsp {
+			continue
+		}
+		if startAP(cpuCount, c.APICID) {
+			cpuCount++
+		}
+	}
+	if identity {
+		vmm.Unmap(apTrampolineAddr)
+	}
+	return cpuCount
+}
+
+// APEntry is where an application processor lands after the trampoline,
+// on its own stack, with the kernel page tables and a temporary GDT.
+func APEntry(cpu uint64) {
+	initCPUGDT(int(cpu))
+	LoadIDT(&idtr)
+	initCPUFPU()
+	lapicEnable()
+
+	// The trampoline and its parameters may now be reused for the next AP.
+	cpus[cpu].online = true
+	mmioWrite32(apParam(apParamReady), 1)
+
+	scheduler.InitCPU(int(cpu))
+	LAPICTimerStart(timerHz)
+
+	EnableInterrupts()
+	for {
+		apIdle()
+	}
+}
@@ -0,0 +1,119 @@
+package kernel
+
+import (
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+	"github.com/dmarro89/go-dav-os/mem"
+	"github.com/dmarro89/go-dav-os/terminal"
+	"github.com/dmarro89/go-dav-os/vmm"
+)
+
+// Task stacks live in their own virtual region in the upper half. Every
+// task pool slot owns a fixed window there; its stack
+// is mapped with 4 KiB pages at the top of the window and the rest stays
+// unmapped, so running off the bottom of a stack faults instead of
+// overwriting memory.
+//
+//	stackRegion + slot*stackWindow                          window top
+//	| unmapped guard (at least one page) | mapped stack pages |
+const (
+	stackRegion = 0xFFFFC00000000000
+	stackWindow = 64 * 1024
+
+	pageSize4K = 4096
+
+	vecDoubleFault = 8
+)
+
+var (
+	stacksReady bool
+
+	// pages mapped at the top of each window. A slot keeps them for the
+	// next task created in it, unless that task gets a smaller stack:
+	// unmapping needs a TLB shootdown on every CPU.
+	stackPages [scheduler.MaxTasks]int
+
+	stackLock sync.SpinLock
+)
+
+// InitStacks hands task stack allocation to the scheduler. Stack pages are
+// mapped through the vmm, whose page tables every CPU shares through CR3.
+func InitStacks() bool {
+	if !vmm.Ready() {
+		return false
+	}
+	stacksReady = true
+	scheduler.SetStackAllocator(allocStack)
+	return true
+}
+
+// allocStack is the scheduler's stack allocator: it maps pages at the top
+// of the slot's window until size bytes are mapped and returns the top.
+// Pages a previous, larger stack left below that are unmapped, so the
+// guard page sits right under the new stack.
+func allocStack(slot int, size uintptr) uintptr {
+	pages := int(size / pageSize4K)
+	if slot < 0 || slot >= scheduler.MaxTasks || pages >= stackWindow/pageSize4K {
+		return 0
+	}
+	top := stackRegion + uintptr(slot+1)*stackWindow
+
+	// Not under stackLock: every unmap waits for the other CPUs to flush,
+	// and the slot is not shared while its task is being created.
+	for stackPages[slot] > pages {
+		virt := top - uintptr(stackPages[slot])*pageSize4K
+		phys, _, ok := vmm.Translate(virt)
+		stackPages[slot]--
+		if ok && vmm.Unmap(virt) {
+			mem.FreePage(uint64(phys))
+		}
+	}
+
+	flags := sync.SaveIRQ()
+	stackLock.Lock()
+	for stackPages[slot] < pages {
+		phys := mem.AllocPage()
+		virt := top - uintptr(stackPages[slot]+1)*pageSize4K
+		if phys == 0 || !vmm.Map(virt, uintptr(phys), vmm.FlagWrite|vmm.FlagNoExec) {
+			if phys != 0 {
+				mem.FreePage(phys)
+			}
+			stackLock.Unlock()
+			sync.RestoreIRQ(flags)
+			return 0
+		}
+		stackPages[slot]++
+	}
+	stackLock.Unlock()
+	sync.RestoreIRQ(flags)
+	return top
+}
+
+// stackGuardSlot returns the pool slot whose guard area holds addr.
+func stackGuardSlot(addr uint64) (int, bool) {
+	if !stacksReady || addr < stackRegion || addr >= stackRegion+scheduler.MaxTasks*stackWindow {
+		return 0, false
+	}
+	slot := int((addr - stackRegion) / stackWindow)
+	top := stackRegion + uint64(slot+1)*stackWindow
+	return slot, addr < top-uint64(stackPages[slot])*pageSize4K
+}
+
+// reportStackOverflow names the running task if the fault address lies in
+// a guard area; a task only ever touches its own stack. The fault arrives
+// as #PF, or as #DF when the CPU could not push the #PF frame on the
+// exhausted stack.
+func reportStackOverflow(tf *TrapFrame) {
+	if tf.Vector != vecPageFault && tf.Vector != vecDoubleFault {
+		return
+	}
+	slot, ok := stackGuardSlot(tf.CR2)
+	if !ok {
+		return
+	}
+	faultPrint("\nstack overflow in task ")
+	terminal.PrintInt(scheduler.CurrentTaskID())
+	faultPrint(" (stack slot ")
+	terminal.PrintInt(slot)
+	faultPrint(")\n")
+}
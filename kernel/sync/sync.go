@@ -0,0 +1,101 @@
+// Package sync provides the locking primitives used by kernel subsystems.
+// There is no runtime to park goroutines on, so every lock here spins.
+package sync
+
+// Assembly hooks (boot/stubs_amd64.s)
+func xchg32(addr *uint32, v uint32) uint32
+func pause()
+func saveFlagsCli() uint64
+func restoreFlags(flags uint64)
+
+const flagsIF = 1 << 9
+
+// SpinLock is a test-and-test-and-set lock. It does not touch the
+// interrupt flag, so it must not be taken by code that an interrupt
+// handler on the same CPU may also try to lock; use IRQSpinLock there.
+// The zero value is unlocked.
+type SpinLock struct {
+	state uint32
+}
+
+// Lock spins until the lock is acquired.
+func (l *SpinLock) Lock() {
+	for xchg32(&l.state, 1) != 0 {
+		for l.state != 0 {
+			pause()
+		}
+	}
+}
+
+// TryLock acquires the lock if it is free and reports whether it did.
+func (l *SpinLock) TryLock() bool {
+	return xchg32(&l.state, 1) == 0
+}
+
+// Unlock releases the lock. xchg is a full barrier, so stores made while
+// holding the lock are visible before it is seen free.
+func (l *SpinLock) Unlock() {
+	xchg32(&l.state, 0)
+}
+
+// Locked reports whether the lock is currently held by anyone.
+func (l *SpinLock) Locked() bool {
+	return l.state != 0
+}
+
+// SaveIRQ disables interrupts on the executing CPU and returns the
+// previous RFLAGS, to be handed back to RestoreIRQ.
+func SaveIRQ() uint64 {
+	return saveFlagsCli()
+}
+
+// RestoreIRQ re-enables interrupts only if they were enabled when flags
+// was saved, so nested critical sections unwind correctly.
+func RestoreIRQ(flags uint64) {
+	restoreFlags(flags)
+}
+
+// IRQEnabled reports whether the saved flags had interrupts enabled.
+func IRQEnabled(flags uint64) bool {
+	return flags&flagsIF != 0
+}
+
+// IRQSpinLock is a SpinLock that also disables interrupts on the local
+// CPU while held. Use it for data shared with interrupt handlers.
+type IRQSpinLock struct {
+	lock SpinLock
+}
+
+// Lock disables interrupts, acquires the lock and returns the saved
+// RFLAGS for Unlock.
+func (l *IRQSpinLock) Lock() uint64 {
+	flags := saveFlagsCli()
+	l.lock.Lock()
+	return flags
+}
+
+// Unlock releases the lock and restores the interrupt flag from flags.
+func (l *IRQSpinLock) Unlock(flags uint64) {
+	l.lock.Unlock()
+	restoreFlags(flags)
+}
+
+// Once runs a function exactly once, even if several CPUs race to it.
+type Once struct {
+	done uint32
+	lock IRQSpinLock
+}
+
+// Do calls f if and only if Do is being called for the first time on o.
+// Other callers wait until f has returned.
+func (o *Once) Do(f func()) {
+	if o.done != 0 {
+		return
+	}
+	flags := o.lock.Lock()
+	if o.done == 0 {
+		f()
+		xchg32(&o.done, 1)
+	}
+	o.lock.Unlock(flags)
+}
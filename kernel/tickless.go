@@ -0,0 +1,159 @@
+package kernel
+
+import (
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/timer"
+)
+
+// Assembly hook (boot/stubs_amd64.s)
+func idleHalt()
+
+const (
+	nsPerTick = nsPerSec / tickHz
+
+	pitDivisor  = pitFreq / tickHz
+	pitMaxCount = 0xFFFF
+)
+
+// ticklessReady reports whether the tick may be stopped. The tick count is
+// rebuilt from Now after an idle period, so the clocksource must not be
+// the tick itself.
+func ticklessReady() bool {
+	return clockSource != clockTicks && clockFreq != 0
+}
+
+// syncTicks sets the tick count from the clocksource. It never moves
+// backwards, so a tick that ran slightly fast is not undone.
+func syncTicks() {
+	if t := Now() / nsPerTick; t > ticks {
+		ticks = t
+	}
+}
+
+// idleWait is the scheduler's idle hook, called by a blocked task. It
+// gives the CPU to another runnable task if there is one, else halts
+// until the next interrupt. The task's own state is checked again with
+// interrupts off, so a wake-up since the caller last looked is not slept
+// through.
+func idleWait() {
+	cpu := CPUIndex()
+	if scheduler.HasRunnable(cpu) {
+		scheduler.Yield()
+		return
+	}
+
+	DisableInterrupts()
+	if !scheduler.CurrentWaiting() {
+		EnableInterrupts()
+		return
+	}
+	haltIdle(cpu)
+}
+
+// apIdle is the loop body of an application processor's idle task.
+func apIdle() {
+	cpu := CPUIndex()
+	if scheduler.HasRunnable(cpu) {
+		scheduler.Yield()
+		return
+	}
+
+	DisableInterrupts()
+	haltIdle(cpu)
+}
+
+// haltIdle halts until the next interrupt, called with interrupts
+// disabled. If no task is runnable, the periodic tick is first replaced
+// by a one-shot interrupt at the next timer deadline (on the bootstrap
+// processor) or as far out as the hardware allows (on the others).
+func haltIdle(cpu int) {
+	if scheduler.HasRunnable(cpu) {
+		// made runnable from this CPU, which sends itself no kick
+		EnableInterrupts()
+		return
+	}
+	if ticklessReady() {
+		stopTick(cpu)
+	}
+	idleHalt()
+}
+
+func stopTick(cpu int) {
+	n := uint64(0xFFFFFFFF)
+	if cpu == 0 {
+		if d, ok := timer.NextDeadline(); ok {
+			if d <= ticks+1 {
+				return
+			}
+			n = d - ticks
+		}
+	}
+	if !timerOneShot(n) {
+		return
+	}
+	cpus[cpu].tickStopped = true
+}
+
+// timerOneShot programs the local tick source to fire once, n ticks from
+// now or at its longest interval if that is shorter. It returns false if
+// stopping would not save a single tick.
+func timerOneShot(n uint64) bool {
+	if useAPIC {
+		if lapicTickCount == 0 {
+			return false
+		}
+		if limit := uint64(lapicMaxTimerInit / lapicTickCount); n > limit {
+			n = limit
+		}
+		if n <= 1 {
+			return false
+		}
+		lapicWrite(lapicRegTimerDivide, timerDivideBy16)
+		lapicWrite(lapicRegLVTTimer, lapicTimerVector)
+		lapicWrite(lapicRegTimerInit, uint32(n*uint64(lapicTickCount)))
+		return true
+	}
+
+	if limit := uint64(pitMaxCount / pitDivisor); n > limit {
+		n = limit
+	}
+	if n <= 1 {
+		return false
+	}
+	count := n * pitDivisor
+	// channel 0, lobyte/hibyte, mode 0 (interrupt on terminal count)
+	outb(0x43, 0x30)
+	outb(0x40, byte(count&0xFF))
+	outb(0x40, byte(count>>8))
+	return true
+}
+
+// tickWake runs at the start of every IRQ. If the executing CPU stopped
+// its tick to idle, the periodic tick is restarted and, on the bootstrap
+// processor, the tick count catches up with the time spent idle.
+func tickWake() {
+	cpu := CPUIndex()
+	if !cpus[cpu].tickStopped {
+		return
+	}
+	cpus[cpu].tickStopped = false
+	if useAPIC {
+		lapicWrite(lapicRegLVTTimer, lvtTimerPeriodic|lapicTimerVector)
+		lapicWrite(lapicRegTimerInit, lapicTickCount)
+	} else {
+		PITInit(tickHz)
+	}
+	if cpu == 0 {
+		syncTicks()
+	}
+}
+
+// kickCPU makes another CPU reschedule now, rather than at its next tick,
+// which may be far away while it idles. The IPI has a vector of its own,
+// so it is not counted as a tick.
+func kickCPU(cpu int) {
+	if !useAPIC || cpu < 0 || cpu >= maxCPUs || !cpus[cpu].online {
+		return
+	}
+	lapicSendIPI(cpus[cpu].apicID, icrLevelAssert|reschedVector)
+}
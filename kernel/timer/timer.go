@@ -0,0 +1,267 @@
+// Package timer keeps one-shot and periodic callbacks keyed on the
+// scheduler tick. Timers hang off a hashed wheel: a timer expiring at tick
+// t lives in slot t % wheelSize, so each tick only walks one short list.
+package timer
+
+import "github.com/dmarro89/go-dav-os/kernel/sync"
+
+// Func is a timer callback. It runs in interrupt context on the bootstrap
+// processor, so it must not block.
+type Func func(arg uint64)
+
+const (
+	maxTimers = 64
+	wheelSize = 64
+
+	// IDs carry a generation above the pool index, so cancelling a timer
+	// that already fired cannot hit an unrelated one reusing its slot.
+	idShift = 8
+	idMask  = 1<<idShift - 1
+
+	defaultHz = 100
+)
+
+type timer struct {
+	used    bool
+	expires uint64
+	period  uint64 // 0 for one-shot timers
+	fn      Func
+	arg     uint64
+	gen     uint16
+	next    int // pool index + 1 of the next timer in the slot, 0 ends it
+}
+
+type firing struct {
+	fn  Func
+	arg uint64
+}
+
+var (
+	pool  [maxTimers]timer
+	wheel [wheelSize]int // pool index + 1 of the first timer, 0 if empty
+	now   uint64
+	hz    uint64 = defaultHz
+
+	// due is filled under the lock and run after dropping it, so
+	// callbacks may add or cancel timers. Only Tick uses it.
+	due [maxTimers]firing
+
+	lock sync.IRQSpinLock
+)
+
+// Init sets the tick rate used to convert milliseconds and drops every
+// pending timer.
+func Init(tickHz uint64) {
+	flags := lock.Lock()
+	if tickHz != 0 {
+		hz = tickHz
+	}
+	for i := 0; i < maxTimers; i++ {
+		pool[i].used = false
+		pool[i].next = 0
+	}
+	for i := 0; i < wheelSize; i++ {
+		wheel[i] = 0
+	}
+	lock.Unlock(flags)
+}
+
+// Ticks returns the tick the wheel was last advanced to.
+func Ticks() uint64 { return now }
+
+// Hz returns the tick rate.
+func Hz() uint64 { return hz }
+
+// MillisToTicks converts a duration to ticks, rounding up so a timer
+// never fires early. Any non-zero duration is at least one tick.
+func MillisToTicks(ms uint64) uint64 {
+	t := (ms*hz + 999) / 1000
+	if t == 0 && ms != 0 {
+		t = 1
+	}
+	return t
+}
+
+// AddTimer arms a one-shot timer that calls fn(arg) once the tick count
+// reaches deadline. A deadline in the past fires on the next tick.
+// Returns the timer ID, or -1 if fn is nil or every timer is in use.
+func AddTimer(deadline uint64, fn Func, arg uint64) int {
+	return AddPeriodic(deadline, 0, fn, arg)
+}
+
+// AddPeriodic is AddTimer for a timer that re-arms itself every period
+// ticks after its first deadline, until cancelled.
+func AddPeriodic(deadline, period uint64, fn Func, arg uint64) int {
+	if fn == nil {
+		return -1
+	}
+	flags := lock.Lock()
+	idx := -1
+	for i := 0; i < maxTimers; i++ {
+		if !pool[i].used {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		lock.Unlock(flags)
+		return -1
+	}
+	t := &pool[idx]
+	t.used = true
+	t.expires = deadline
+	t.period = period
+	t.fn = fn
+	t.arg = arg
+	t.gen++
+	insert(idx)
+	id := int(t.gen)<<idShift | idx
+	lock.Unlock(flags)
+	return id
+}
+
+// Cancel disarms a timer. It reports false if the timer already fired
+// (one-shot), was cancelled before, or id is not valid.
+func Cancel(id int) bool {
+	idx := id & idMask
+	if id < 0 || idx >= maxTimers {
+		return false
+	}
+	flags := lock.Lock()
+	t := &pool[idx]
+	ok := t.used && int(t.gen) == id>>idShift
+	if ok {
+		unlink(idx)
+		t.used = false
+	}
+	lock.Unlock(flags)
+	return ok
+}
+
+// Pending returns the number of armed timers.
+func Pending() int {
+	n := 0
+	flags := lock.Lock()
+	for i := 0; i < maxTimers; i++ {
+		if pool[i].used {
+			n++
+		}
+	}
+	lock.Unlock(flags)
+	return n
+}
+
+// NextDeadline returns the earliest deadline of all armed timers, and
+// false if there is none. Tickless idle sleeps until then.
+func NextDeadline() (uint64, bool) {
+	var next uint64
+	found := false
+	flags := lock.Lock()
+	for i := 0; i < maxTimers; i++ {
+		t := &pool[i]
+		if t.used && (!found || t.expires < next) {
+			next = t.expires
+			found = true
+		}
+	}
+	lock.Unlock(flags)
+	return next, found
+}
+
+// Tick advances the wheel to tick `to` and runs every timer that expired
+// on the way. It is called from the timer interrupt on the bootstrap
+// processor, once per tick or with a bigger step after a tickless idle.
+func Tick(to uint64) {
+	flags := lock.Lock()
+	if to <= now {
+		lock.Unlock(flags)
+		return
+	}
+	// After a full turn every slot has been visited once.
+	from := now + 1
+	if to-now > wheelSize {
+		from = to - wheelSize + 1
+	}
+	now = to
+
+	n := 0
+	for tick := from; tick <= to; tick++ {
+		n = expire(int(tick%wheelSize), n)
+	}
+	lock.Unlock(flags)
+
+	for i := 0; i < n; i++ {
+		due[i].fn(due[i].arg)
+		due[i].fn = nil
+	}
+}
+
+// expire moves the expired timers of one slot to due[n:], re-arming
+// periodic ones, and returns the new length of due.
+func expire(slot int, n int) int {
+	prev := 0
+	cur := wheel[slot]
+	for cur != 0 {
+		idx := cur - 1
+		t := &pool[idx]
+		next := t.next
+		if t.expires > now {
+			prev = cur
+			cur = next
+			continue
+		}
+
+		if prev == 0 {
+			wheel[slot] = next
+		} else {
+			pool[prev-1].next = next
+		}
+		t.next = 0
+
+		due[n].fn = t.fn
+		due[n].arg = t.arg
+		n++
+
+		if t.period != 0 {
+			for t.expires <= now {
+				t.expires += t.period
+			}
+			insert(idx)
+		} else {
+			t.used = false
+		}
+		cur = next
+	}
+	return n
+}
+
+// insert links pool[idx] into the slot of its deadline. Overdue timers go
+// into the slot that the next tick visits.
+func insert(idx int) {
+	t := &pool[idx]
+	at := t.expires
+	if at <= now {
+		at = now + 1
+	}
+	slot := int(at % wheelSize)
+	t.next = wheel[slot]
+	wheel[slot] = idx + 1
+}
+
+func unlink(idx int) {
+	for slot := 0; slot < wheelSize; slot++ {
+		prev := 0
+		for cur := wheel[slot]; cur != 0; cur = pool[cur-1].next {
+			if cur-1 == idx {
+				if prev == 0 {
+					wheel[slot] = pool[idx].next
+				} else {
+					pool[prev-1].next = pool[idx].next
+				}
+				pool[idx].next = 0
+				return
+			}
+			prev = cur
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package timer
+
+import "testing"
+
+var fired [4]int
+
+func count(arg uint64) { fired[arg]++ }
+
+func reset() {
+	now = 0
+	Init(100)
+	for i := range fired {
+		fired[i] = 0
+	}
+}
+
+func TestMillisToTicks(t *testing.T) {
+	reset()
+	if got := MillisToTicks(10); got != 1 {
+		t.Errorf("Expected 10ms to be 1 tick, got %d", got)
+	}
+	if got := MillisToTicks(15); got != 2 {
+		t.Errorf("Expected 15ms to round up to 2 ticks, got %d", got)
+	}
+	if got := MillisToTicks(0); got != 0 {
+		t.Errorf("Expected 0ms to be 0 ticks, got %d", got)
+	}
+}
+
+func TestOneShot(t *testing.T) {
+	reset()
+	if AddTimer(5, count, 0) < 0 {
+		t.Fatalf("Expected AddTimer to succeed")
+	}
+	for tick := uint64(1); tick < 5; tick++ {
+		Tick(tick)
+	}
+	if fired[0] != 0 {
+		t.Errorf("Expected timer not to fire before its deadline")
+	}
+	Tick(5)
+	Tick(6)
+	if fired[0] != 1 {
+		t.Errorf("Expected timer to fire once, fired %d times", fired[0])
+	}
+	if Pending() != 0 {
+		t.Errorf("Expected no pending timers, got %d", Pending())
+	}
+}
+
+func TestFarDeadline(t *testing.T) {
+	reset()
+	AddTimer(wheelSize+3, count, 0)
+	for tick := uint64(1); tick <= wheelSize+2; tick++ {
+		Tick(tick)
+	}
+	if fired[0] != 0 {
+		t.Errorf("Expected timer a full wheel turn away not to fire early")
+	}
+	Tick(wheelSize + 3)
+	if fired[0] != 1 {
+		t.Errorf("Expected timer to fire at its deadline")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	reset()
+	id := AddTimer(3, count, 0)
+	AddTimer(3, count, 1)
+	if !Cancel(id) {
+		t.Errorf("Expected Cancel to succeed")
+	}
+	if Cancel(id) {
+		t.Errorf("Expected second Cancel to fail")
+	}
+	Tick(3)
+	if fired[0] != 0 || fired[1] != 1 {
+		t.Errorf("Expected only the other timer to fire, got %d and %d", fired[0], fired[1])
+	}
+
+	// a stale ID must not cancel the timer now using the same slot
+	id2 := AddTimer(5, count, 2)
+	if id2&idMask == id&idMask && Cancel(id) {
+		t.Errorf("Expected stale ID not to cancel a reused slot")
+	}
+}
+
+func TestPeriodic(t *testing.T) {
+	reset()
+	id := AddPeriodic(2, 3, count, 0)
+	for tick := uint64(1); tick <= 11; tick++ {
+		Tick(tick)
+	}
+	// fires at 2, 5, 8, 11
+	if fired[0] != 4 {
+		t.Errorf("Expected periodic timer to fire 4 times, got %d", fired[0])
+	}
+	if !Cancel(id) {
+		t.Errorf("Expected periodic timer to still be armed")
+	}
+}
+
+func TestTickJump(t *testing.T) {
+	reset()
+	AddTimer(2, count, 0)
+	AddTimer(40, count, 1)
+	AddTimer(500, count, 2)
+	Tick(200)
+	if fired[0] != 1 || fired[1] != 1 || fired[2] != 0 {
+		t.Errorf("Expected timers up to tick 200 to fire, got %v", fired)
+	}
+}
+
+func TestPastDeadline(t *testing.T) {
+	reset()
+	Tick(10)
+	AddTimer(4, count, 0)
+	Tick(11)
+	if fired[0] != 1 {
+		t.Errorf("Expected overdue timer to fire on the next tick")
+	}
+}
+
+func TestNextDeadline(t *testing.T) {
+	reset()
+	if _, ok := NextDeadline(); ok {
+		t.Errorf("Expected no deadline without timers")
+	}
+	AddTimer(30, count, 0)
+	id := AddTimer(12, count, 1)
+	if d, ok := NextDeadline(); !ok || d != 12 {
+		t.Errorf("Expected next deadline 12, got %d", d)
+	}
+	Cancel(id)
+	if d, _ := NextDeadline(); d != 30 {
+		t.Errorf("Expected next deadline 30 after cancel, got %d", d)
+	}
+}
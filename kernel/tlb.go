@@ -0,0 +1,63 @@
+package kernel
+
+import (
+	"github.com/dmarro89/go-dav-os/terminal"
+	"github.com/dmarro89/go-dav-os/vmm"
+)
+
+// A CPU that removed or restricted a mapping flushes its own TLB entry and
+// then has every other online CPU reload CR3: it raises their pending
+// flag, kicks them with an IPI and waits until each has flushed. A CPU
+// that halts for good goes offline first, as it would never flush.
+var tlbPending [maxCPUs]uint32
+
+// A CPU only flushes when it takes an interrupt; one that has kept them
+// off for this many polls is stuck, and the shootdown goes on without it.
+// Its flag stays raised, so it still flushes on its next interrupt.
+const tlbMaxSpins = 1 << 26
+
+// tlbShootdown is the vmm shootdown hook. Two CPUs may shoot down at the
+// same time, so each one serves its own flag while waiting.
+func tlbShootdown() {
+	if !smpReady || cpuCount <= 1 {
+		return
+	}
+	self := CPUIndex()
+	for cpu := 0; cpu < cpuCount; cpu++ {
+		if cpu != self && cpus[cpu].online {
+			tlbPending[cpu] = 1
+			kickCPU(cpu)
+		}
+	}
+	for cpu := 0; cpu < cpuCount; cpu++ {
+		for spins := 0; cpu != self && tlbPending[cpu] != 0 && cpus[cpu].online; spins++ {
+			if spins == tlbMaxSpins {
+				terminal.Print("tlb: CPU ")
+				terminal.PrintInt(cpu)
+				terminal.Print(" did not flush, going on without it\n")
+				break
+			}
+			tlbService()
+		}
+	}
+}
+
+// cpuStopped takes the executing CPU out of TLB shootdowns before it
+// halts for good.
+func cpuStopped() {
+	if smpReady {
+		cpus[CPUIndex()].online = false
+	}
+}
+
+// tlbService flushes the TLB of the executing CPU if a shootdown asked
+// for it. IRQDispatch runs it for every interrupt. The flag is cleared
+// first, so a request that arrives during the flush is not lost.
+func tlbService() {
+	cpu := CPUIndex()
+	if tlbPending[cpu] == 0 {
+		return
+	}
+	tlbPending[cpu] = 0
+	vmm.FlushTLB()
+}
@@ -0,0 +1,38 @@
+package kernel
+
+import (
+	"github.com/dmarro89/go-dav-os/acpi"
+	"github.com/dmarro89/go-dav-os/drivers/rtc"
+)
+
+// tickHz is the rate of the scheduler tick, from the PIT or the LAPIC timer
+const tickHz = 100
+
+var (
+	// RTC reading at boot, seconds since the Unix epoch (0 if the CMOS
+	// clock is not set)
+	bootUnix  int64
+	bootTicks uint64
+)
+
+// initWallClock latches the RTC once. From then on the wall clock moves
+// with the tick counter, so it never goes backwards the way a CMOS
+// re-read across a manual clock change could.
+func initWallClock() {
+	rtc.SetCenturyRegister(acpi.FADTInfo().Century)
+	t := rtc.Read()
+	if t.Valid() {
+		bootUnix = t.Unix()
+	}
+	bootTicks = ticks
+}
+
+// UnixTime returns the wall clock in seconds since 1970-01-01 UTC.
+func UnixTime() int64 {
+	return bootUnix + int64((ticks-bootTicks)/tickHz)
+}
+
+// UptimeMillis returns the time since the tick started, in milliseconds.
+func UptimeMillis() uint64 {
+	return ticks * 1000 / tickHz
+}
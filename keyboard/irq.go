@@ -1,11 +1,23 @@
 package keyboard
 
+import (
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+)
+
 const bufSize = 256
 
 var buf [bufSize]rune
 var head uint32
 var tail uint32
 
+// bufLock guards buf/head/tail between the IRQ handler and readers,
+// which may run on another CPU
+var bufLock sync.IRQSpinLock
+
+// tasks blocked in Read until a key arrives
+var readers scheduler.WaitQueue
+
 func push(r rune) {
 	next := (head + 1) & (bufSize - 1)
 	if next == tail {
@@ -34,15 +46,33 @@ func IRQHandler() {
 		return
 	}
 
+	flags := bufLock.Lock()
 	push(r)
+	bufLock.Unlock(flags)
+	readers.Wake()
 }
 
 // Non-blocking read used by the shell loop.
 func TryRead() (rune, bool) {
+	flags := bufLock.Lock()
 	if tail == head {
+		bufLock.Unlock(flags)
 		return 0, false
 	}
 	r := buf[tail]
 	tail = (tail + 1) & (bufSize - 1)
+	bufLock.Unlock(flags)
 	return r, true
 }
+
+// Read blocks the calling task until a key is available and returns it.
+func Read() rune {
+	for {
+		flags := readers.Prepare()
+		if r, ok := TryRead(); ok {
+			readers.Finish(flags)
+			return r
+		}
+		readers.Block(flags)
+	}
+}
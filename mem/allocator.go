@@ -1,6 +1,10 @@
 package mem
 
-import "unsafe"
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+)
 
 const pageSize = 4096
 
@@ -14,15 +18,20 @@ var (
 	bitmapPhys  uint64 // Physical address of the bitmap
 	bitmapBytes uint64
 	scanStart   uint64 // First page index to start scanning from
+
+	// pfaLock guards the bitmap and the counters once InitPFA is done
+	pfaLock sync.IRQSpinLock
 )
 
+// kernelEndPhys returns the physical end of the loaded kernel image; the
+// linker symbols are higher-half addresses.
 func kernelEndPhys() uint64 {
 	kend := kernelEnd()
 	bend := bootstrapEnd()
 	if bend > kend {
-		return bend
+		kend = bend
 	}
-	return kend
+	return kend - KernelBase
 }
 
 func alignUp(v, a uint64) uint64 {
@@ -56,8 +65,7 @@ func maxAvailableEnd() uint64 {
 }
 
 func bitmapBytePtr(off uint64) *byte {
-	// assumes identity mapping / paging off: physical == directly addressable pointer
-	return (*byte)(unsafe.Pointer(uintptr(bitmapPhys) + uintptr(off)))
+	return (*byte)(unsafe.Pointer(PhysToVirt(bitmapPhys + off)))
 }
 
 func bitmapGet(page uint64) bool {
@@ -210,6 +218,13 @@ func UsedPages() uint64  { return totalPages - freePages }
 
 func AllocPage() uint64 {
 	// returns a physical address of a 4KB page, or 0 on failure
+	flags := pfaLock.Lock()
+	addr := allocPage()
+	pfaLock.Unlock(flags)
+	return addr
+}
+
+func allocPage() uint64 {
 	if !pfaReady {
 		return 0
 	}
@@ -229,6 +244,13 @@ func AllocPage() uint64 {
 
 func FreePage(addr uint64) bool {
 	// frees a page previously returned by AllocPage
+	flags := pfaLock.Lock()
+	ok := freePage(addr)
+	pfaLock.Unlock(flags)
+	return ok
+}
+
+func freePage(addr uint64) bool {
 	if !pfaReady {
 		return false
 	}
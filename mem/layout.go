@@ -0,0 +1,25 @@
+package mem
+
+// Kernel virtual address layout, shared with boot/boot.s and
+// boot/linker.ld. The lower half stays unmapped once the vmm runs.
+const (
+	// DirectMapBase maps physical memory below DirectMapSize, so the
+	// kernel reaches page frames, firmware tables and MMIO through it.
+	DirectMapBase = 0xFFFF800000000000
+	DirectMapSize = 4 << 30
+
+	// KernelBase is where the kernel image is linked: the image loaded at
+	// physical address p runs at KernelBase + p.
+	KernelBase = 0xFFFFFFFF80000000
+)
+
+// PhysToVirt returns the address physical address phys is reached at
+// through the direct map.
+func PhysToVirt(phys uint64) uintptr {
+	return uintptr(phys + DirectMapBase)
+}
+
+// VirtToPhys is the inverse of PhysToVirt for direct-map addresses.
+func VirtToPhys(virt uintptr) uint64 {
+	return uint64(virt - DirectMapBase)
+}
@@ -17,11 +17,19 @@ var (
 	// mmapEntries stores a compact snapshot of the memory map provided by GRUB
 	mmapEntries [maxMMapEntries]mmapEntry
 	mmapCount   int
+
+	// rsdpCopy keeps the ACPI RSDP handed over by GRUB, since the
+	// Multiboot info area itself is not reserved from the PFA
+	rsdpCopy  [36]byte
+	rsdpFound bool
+	rsdpIsV2  bool
 )
 
 const (
-	multiboot2TagTypeEnd  = 0
-	multiboot2TagTypeMmap = 6
+	multiboot2TagTypeEnd     = 0
+	multiboot2TagTypeMmap    = 6
+	multiboot2TagTypeACPIOld = 14
+	multiboot2TagTypeACPINew = 15
 )
 
 // readU32 reads a 32-bit value from memory at the given address
@@ -39,15 +47,18 @@ func alignUp8(p uintptr) uintptr {
 }
 
 // InitMultiboot initializes the memory map from the Multiboot info structure
+// at physical address mbInfoAddr, read through the direct map
 // Returns true if the memory map is valid, false otherwise
 func InitMultiboot(mbInfoAddr uint64) bool {
 	// reset the memory map counter
 	mmapCount = 0
+	rsdpFound = false
+	rsdpIsV2 = false
 	if mbInfoAddr == 0 {
 		return false
 	}
 
-	info := uintptr(mbInfoAddr)
+	info := PhysToVirt(mbInfoAddr)
 	totalSize := readU32(info)
 	if totalSize < 16 {
 		return false
@@ -92,12 +103,37 @@ func InitMultiboot(mbInfoAddr uint64) bool {
 			}
 		}
 
+		// ACPI 2.0+ RSDP wins over the 1.0 one if GRUB passes both
+		if tagType == multiboot2TagTypeACPINew || (tagType == multiboot2TagTypeACPIOld && !rsdpIsV2) {
+			copyRSDP(p+8, uintptr(tagSize)-8)
+			rsdpIsV2 = tagType == multiboot2TagTypeACPINew
+		}
+
 		p = alignUp8(p + uintptr(tagSize))
 	}
 
 	return foundMmap
 }
 
+func copyRSDP(src uintptr, n uintptr) {
+	if n > uintptr(len(rsdpCopy)) {
+		n = uintptr(len(rsdpCopy))
+	}
+	for i := uintptr(0); i < n; i++ {
+		rsdpCopy[i] = *(*byte)(unsafe.Pointer(src + i))
+	}
+	rsdpFound = n >= 20
+}
+
+// ACPIRSDP returns the address of the RSDP copy from the Multiboot2 ACPI
+// tags, or 0 if GRUB did not provide one
+func ACPIRSDP() uintptr {
+	if !rsdpFound {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&rsdpCopy[0]))
+}
+
 // MMapCount returns the number of memory map entries
 func MMapCount() int { return mmapCount }
 
@@ -38,7 +38,6 @@ def main():
         "-monitor", "stdio",
         "-display", "none",
         "-no-reboot",
-        "-no-shutdown",
     ]
     
     # Start QEMU process
@@ -130,7 +129,28 @@ def main():
             print("ERROR: 64-bit marker not found in version output.")
             sys.exit(1)
         print("64-bit marker detected in version output.")
-        
+
+        # 5. Power off through ACPI; QEMU exits on its own when it works.
+        print("Sending 'shutdown' command via QEMU monitor...")
+        keys = ['s', 'h', 'u', 't', 'd', 'o', 'w', 'n', 'ret']
+        for k in keys:
+            cmd_str = f"sendkey {k}\n"
+            try:
+                process.stdin.write(cmd_str)
+                process.stdin.flush()
+            except BrokenPipeError:
+                print("Error: QEMU closed stdin (crashed?)")
+                break
+            time.sleep(0.1)
+
+        print("Waiting for QEMU to power off...")
+        try:
+            process.wait(timeout=10)
+        except subprocess.TimeoutExpired:
+            print("ERROR: QEMU still running after 'shutdown'.")
+            sys.exit(1)
+        print("Test Passed: 'shutdown' powered off the VM.")
+
     finally:
         if process.poll() is None:
             process.terminate()
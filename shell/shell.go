@@ -3,9 +3,13 @@ package shell
 import (
 	"unsafe"
 
+	"github.com/dmarro89/go-dav-os/acpi"
 	"github.com/dmarro89/go-dav-os/drivers/ata"
+	"github.com/dmarro89/go-dav-os/drivers/rtc"
 	"github.com/dmarro89/go-dav-os/fs"
 	"github.com/dmarro89/go-dav-os/fs/fat16"
+	"github.com/dmarro89/go-dav-os/heap"
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
 	"github.com/dmarro89/go-dav-os/mem"
 	"github.com/dmarro89/go-dav-os/terminal"
 )
@@ -19,12 +23,19 @@ const (
 )
 
 var (
-	lineBuf  [maxLine]byte
-	lineLen  int
-	getTicks func() uint64
-	tmpName  [16]byte
-	tmpData  [4096]byte
-	diskBuf  [512]byte
+	lineBuf   [maxLine]byte
+	lineLen   int
+	getTicks  func() uint64
+	getUnix   func() int64
+	getUptime func() uint64
+	nowNs     func() uint64
+	clockName func() string
+	benchBuf  [512]byte
+	cpuCount  func() int
+	cpuInfo   func(cpu int) (apicID uint8, online bool, timerTicks uint64)
+	tmpName   [16]byte
+	tmpData   [4096]byte
+	diskBuf   [512]byte
 
 	// History ring buffer
 	// historyBuf stores the content of the commands
@@ -41,13 +52,33 @@ var (
 const maxHistory = 32
 
 var commandBuf = [...]string{
-	"help", "clear", "echo", "ticks", "mem", "mmap",
-	"pfa", "alloc", "free", "ls", "write", "cat", "rm", "stat",
-	"version", "history",
+	"help", "clear", "echo", "ticks", "mem", "mmap", "vmmap",
+	"pfa", "heap", "slabinfo", "alloc", "free", "ls", "write", "cat", "rm", "stat",
+	"version", "history", "date", "uptime", "bench", "sleep", "acpi", "cpus", "nice", "sched",
+	"stacksize", "ps", "kill", "spawn", "top", "shutdown", "reboot",
 }
 
 func SetTickProvider(fn func() uint64) { getTicks = fn }
 
+// SetClockProvider wires the wall clock (Unix seconds) and the uptime in
+// milliseconds for `date` and `uptime`
+func SetClockProvider(unix func() int64, uptimeMs func() uint64) {
+	getUnix = unix
+	getUptime = uptimeMs
+}
+
+// SetClockSource wires the nanosecond clock used by `bench`
+func SetClockSource(now func() uint64, name func() string) {
+	nowNs = now
+	clockName = name
+}
+
+// SetCPUProvider wires the kernel's per-CPU information for `cpus`
+func SetCPUProvider(count func() int, info func(cpu int) (uint8, bool, uint64)) {
+	cpuCount = count
+	cpuInfo = info
+}
+
 func Init() {
 	lineLen = 0
 	terminal.Print("Welcome to " + osName + " " + osVersion + "\n")
@@ -160,7 +191,7 @@ func execute() {
 	}
 
 	if matchLiteral(cmdStart, cmdEnd, "help") {
-		terminal.Print("Commands: help, clear, echo, ticks, mem, mmap, pfa, alloc, free, ls, write, cat, rm, stat, version, history, disk, fatinit, fatformat, fatinfo, fatls, fatcreate, fatread\n")
+		terminal.Print("Commands: help, clear, echo, ticks, mem, mmap, vmmap, pfa, heap, slabinfo, alloc, free, ls, write, cat, rm, stat, version, history, date, uptime, bench, sleep, acpi, cpus, nice, sched, stacksize, ps, kill, spawn, top, shutdown, reboot, disk, fatinit, fatformat, fatinfo, fatls, fatcreate, fatread\n")
 		return
 	}
 
@@ -178,6 +209,58 @@ func execute() {
 		return
 	}
 
+	if matchLiteral(cmdStart, cmdEnd, "date") {
+		if getUnix == nil {
+			terminal.Print("date: not wired yet\n")
+			return
+		}
+		printDate(rtc.FromUnix(getUnix()))
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "uptime") {
+		if getUptime == nil {
+			terminal.Print("uptime: not wired yet\n")
+			return
+		}
+		printUptime(getUptime())
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "bench") {
+		a1s, a1e, ok := nextArg(cmdEnd, end)
+		if !ok {
+			terminal.Print("Usage: bench <now|alloc|ata> [iterations]\n")
+			return
+		}
+		iters := 100
+		if a2s, a2e, ok := nextArg(a1e, end); ok {
+			n, ok := parseDec(a2s, a2e)
+			if !ok || n <= 0 {
+				terminal.Print("bench: invalid iteration count\n")
+				return
+			}
+			iters = n
+		}
+		runBench(a1s, a1e, iters)
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "sleep") {
+		a1s, a1e, ok := nextArg(cmdEnd, end)
+		if !ok {
+			terminal.Print("Usage: sleep <ms>\n")
+			return
+		}
+		ms, ok := parseDec(a1s, a1e)
+		if !ok || ms < 0 {
+			terminal.Print("sleep: invalid duration\n")
+			return
+		}
+		scheduler.Sleep(uint64(ms))
+		return
+	}
+
 	if matchLiteral(cmdStart, cmdEnd, "ticks") {
 		if getTicks == nil {
 			terminal.Print("ticks: not wired yet\n")
@@ -188,9 +271,8 @@ func execute() {
 		return
 	}
 
-	// VGA mem 0xB8000 160
-	// kernel mem 0x00100000 256, mem 0x00101000 256 ...
-	// .rodata & .data mem 0x00104000 256, mem 0x00108000 256, mem 0x0010C000 256
+	// VGA mem FFFF8000000B8000 160 (direct map of physical memory)
+	// kernel mem FFFFFFFF80101000 256, mem FFFFFFFF80102000 256 ...
 	if matchLiteral(cmdStart, cmdEnd, "mem") {
 		a1s, a1e, ok := nextArg(cmdEnd, end)
 		if !ok {
@@ -221,6 +303,10 @@ func execute() {
 		if length > 512 {
 			length = 512
 		}
+		if !mapped(addr, length) {
+			terminal.Print("mem: address not mapped\n")
+			return
+		}
 
 		dumpMemory(addr, length)
 		return
@@ -242,6 +328,11 @@ func execute() {
 		return
 	}
 
+	if matchLiteral(cmdStart, cmdEnd, "vmmap") {
+		printVMMap()
+		return
+	}
+
 	if matchLiteral(cmdStart, cmdEnd, "mmapmax") {
 		var maxEnd uint64
 		n := mem.MMapCount()
@@ -280,6 +371,31 @@ func execute() {
 		return
 	}
 
+	if matchLiteral(cmdStart, cmdEnd, "heap") {
+		if !heap.Ready() {
+			terminal.Print("heap: not ready\n")
+			return
+		}
+
+		var st heap.Stats
+		heap.ReadStats(&st)
+		terminal.Print("heap mapped=")
+		printUint(uint64(st.Mapped))
+		terminal.Print(" used=")
+		printUint(uint64(st.Used))
+		terminal.Print(" allocs=")
+		printUint(st.Allocs)
+		terminal.Print(" frees=")
+		printUint(st.Frees)
+		terminal.PutRune('\n')
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "slabinfo") {
+		printSlabInfo()
+		return
+	}
+
 	if matchLiteral(cmdStart, cmdEnd, "alloc") {
 		// allocate one 4KB page and print its physical address
 		if !mem.PFAReady() {
@@ -387,7 +503,7 @@ func execute() {
 			return
 		}
 
-		p := uintptr(page)
+		p := mem.PhysToVirt(page)
 		for i := uint64(0); i < size; i++ {
 			b := *(*byte)(unsafe.Pointer(p + uintptr(i)))
 			terminal.PutRune(rune(b))
@@ -644,6 +760,127 @@ func execute() {
 		return
 	}
 
+	if matchLiteral(cmdStart, cmdEnd, "acpi") {
+		printACPI()
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "cpus") {
+		printCPUs()
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "nice") {
+		a1s, a1e, ok1 := nextArg(cmdEnd, end)
+		a2s, a2e, ok2 := nextArg(a1e, end)
+		if !ok1 || !ok2 {
+			terminal.Print("Usage: nice <id> <prio>\n")
+			return
+		}
+		id, ok := parseDec(a1s, a1e)
+		if !ok {
+			terminal.Print("nice: invalid task id\n")
+			return
+		}
+		prio, ok := parseSigned(a2s, a2e)
+		if !ok || prio < scheduler.MinNice || prio > scheduler.MaxNice {
+			terminal.Print("nice: priority must be between -20 and 19\n")
+			return
+		}
+		if !scheduler.SetPriority(id, prio) {
+			terminal.Print("nice: no such task\n")
+		}
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "sched") {
+		a1s, a1e, ok := nextArg(cmdEnd, end)
+		if !ok {
+			terminal.Print("policy: ")
+			terminal.Print(scheduler.ActivePolicy().Name())
+			terminal.Print(" (available:")
+			for i := 0; i < scheduler.PolicyCount(); i++ {
+				terminal.Print(" ")
+				terminal.Print(scheduler.PolicyAt(i).Name())
+			}
+			terminal.Print(")\n")
+			return
+		}
+		for i := 0; i < scheduler.PolicyCount(); i++ {
+			if matchLiteral(a1s, a1e, scheduler.PolicyAt(i).Name()) {
+				scheduler.SetPolicy(i)
+				return
+			}
+		}
+		terminal.Print("sched: unknown policy\n")
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "stacksize") {
+		a1s, a1e, ok := nextArg(cmdEnd, end)
+		if !ok {
+			terminal.Print("stack size of new tasks: ")
+			printUint(uint64(scheduler.StackSize() / 1024))
+			terminal.Print(" KiB\n")
+			return
+		}
+		kib, ok := parseDec(a1s, a1e)
+		if !ok || !scheduler.SetStackSize(uintptr(kib)*1024) {
+			terminal.Print("stacksize: size must be 1 to ")
+			printUint(scheduler.MaxStackSize / 1024)
+			terminal.Print(" KiB\n")
+		}
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "ps") {
+		printTasks(false, 0)
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "kill") {
+		a1s, a1e, ok := nextArg(cmdEnd, end)
+		if !ok {
+			terminal.Print("Usage: kill <id>\n")
+			return
+		}
+		killTask(a1s, a1e)
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "spawn") {
+		a1s, a1e, ok := nextArg(cmdEnd, end)
+		if !ok {
+			terminal.Print("Usage: spawn <task>\n")
+			return
+		}
+		spawnTask(a1s, a1e)
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "top") {
+		runTop()
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "shutdown") {
+		syncDisks()
+		terminal.Print("Powering off...\n")
+		if acpi.Shutdown() {
+			terminal.Print("shutdown: ACPI power off failed, it is now safe to turn off the machine\n")
+		} else {
+			terminal.Print("shutdown: no ACPI S5 support, it is now safe to turn off the machine\n")
+		}
+		return
+	}
+
+	if matchLiteral(cmdStart, cmdEnd, "reboot") {
+		syncDisks()
+		terminal.Print("Rebooting...\n")
+		acpi.Reboot()
+		return
+	}
+
 	if matchLiteral(cmdStart, cmdEnd, "version") {
 		terminal.Print(osName + " " + osVersion)
 		proof := uint64(0x0123456789ABCDEF)
@@ -682,6 +919,232 @@ func execute() {
 	terminal.PutRune('\n')
 }
 
+const (
+	benchNow = iota
+	benchAlloc
+	benchATA
+)
+
+// benchOnce runs one iteration of the named benchmark
+func benchOnce(kind int) bool {
+	switch kind {
+	case benchAlloc:
+		p := mem.AllocPage()
+		if p == 0 {
+			return false
+		}
+		mem.FreePage(p)
+	case benchATA:
+		return ata.ReadSector(0, &benchBuf)
+	}
+	return true
+}
+
+func runBench(start, end, iters int) {
+	if nowNs == nil {
+		terminal.Print("bench: not wired yet\n")
+		return
+	}
+
+	var kind int
+	switch {
+	case matchLiteral(start, end, "now"):
+		kind = benchNow
+	case matchLiteral(start, end, "alloc"):
+		if !mem.PFAReady() {
+			terminal.Print("bench: pfa not ready\n")
+			return
+		}
+		kind = benchAlloc
+	case matchLiteral(start, end, "ata"):
+		kind = benchATA
+	default:
+		terminal.Print("bench: unknown benchmark\n")
+		return
+	}
+
+	minNs := ^uint64(0)
+	var maxNs, total uint64
+	for i := 0; i < iters; i++ {
+		t0 := nowNs()
+		if !benchOnce(kind) {
+			terminal.Print("bench: operation failed\n")
+			return
+		}
+		d := nowNs() - t0
+		total += d
+		if d < minNs {
+			minNs = d
+		}
+		if d > maxNs {
+			maxNs = d
+		}
+	}
+
+	printRange(start, end)
+	terminal.Print(": ")
+	printUint(uint64(iters))
+	terminal.Print(" runs, min ")
+	printUint(minNs)
+	terminal.Print(" ns, avg ")
+	printUint(total / uint64(iters))
+	terminal.Print(" ns, max ")
+	printUint(maxNs)
+	terminal.Print(" ns (")
+	if clockName != nil {
+		terminal.Print(clockName())
+	}
+	terminal.Print(")\n")
+}
+
+func printDate(t rtc.Time) {
+	printUint(uint64(t.Year))
+	terminal.PutRune('-')
+	print2Digits(t.Month)
+	terminal.PutRune('-')
+	print2Digits(t.Day)
+	terminal.PutRune(' ')
+	print2Digits(t.Hour)
+	terminal.PutRune(':')
+	print2Digits(t.Minute)
+	terminal.PutRune(':')
+	print2Digits(t.Second)
+	terminal.Print(" UTC\n")
+}
+
+func printUptime(ms uint64) {
+	secs := ms / 1000
+	terminal.Print("up ")
+	if days := secs / 86400; days > 0 {
+		printUint(days)
+		terminal.Print("d ")
+	}
+	print2Digits(int(secs / 3600 % 24))
+	terminal.PutRune(':')
+	print2Digits(int(secs / 60 % 60))
+	terminal.PutRune(':')
+	print2Digits(int(secs % 60))
+	terminal.PutRune('.')
+	frac := ms % 1000
+	terminal.PutRune(rune('0' + frac/100))
+	terminal.PutRune(rune('0' + frac/10%10))
+	terminal.PutRune(rune('0' + frac%10))
+	terminal.PutRune('\n')
+}
+
+func print2Digits(v int) {
+	terminal.PutRune(rune('0' + v/10%10))
+	terminal.PutRune(rune('0' + v%10))
+}
+
+func printCPUs() {
+	if cpuCount == nil || cpuInfo == nil {
+		terminal.Print("cpus: not wired yet\n")
+		return
+	}
+
+	terminal.Print("CPUs online: ")
+	printUint(uint64(cpuCount()))
+	terminal.PutRune('\n')
+
+	for i := 0; i < scheduler.MaxCPUs; i++ {
+		apicID, online, timerTicks := cpuInfo(i)
+		if !online {
+			continue
+		}
+		tasks, cur, switches := scheduler.CPUStats(i)
+		terminal.Print("cpu")
+		printUint(uint64(i))
+		terminal.Print(" apic=")
+		printUint(uint64(apicID))
+		terminal.Print(" tasks=")
+		printUint(uint64(tasks))
+		terminal.Print(" running=")
+		if cur < 0 {
+			terminal.Print("-")
+		} else {
+			printUint(uint64(cur))
+		}
+		terminal.Print(" switches=")
+		printUint(switches)
+		terminal.Print(" ticks=")
+		printUint(timerTicks)
+		terminal.PutRune('\n')
+	}
+}
+
+// syncDisks flushes and unmounts the FAT16 volume before power goes away
+func syncDisks() {
+	if !fat16.Mounted() {
+		return
+	}
+	if !fat16.Unmount() {
+		terminal.Print("warning: disk cache flush failed\n")
+	}
+}
+
+func printACPI() {
+	if !acpi.Ready() {
+		terminal.Print("acpi: no tables found\n")
+		return
+	}
+
+	terminal.Print("ACPI rev ")
+	printUint(uint64(acpi.RSDPRevision()))
+	terminal.Print(", ")
+	printUint(uint64(acpi.TableCount()))
+	terminal.Print(" tables")
+	if n := acpi.BadChecksumCount(); n > 0 {
+		terminal.Print(" (")
+		printUint(uint64(n))
+		terminal.Print(" bad checksum)")
+	}
+	terminal.PutRune('\n')
+
+	for i := 0; i < acpi.TableCount(); i++ {
+		sig, addr, length, rev, oem := acpi.Table(i)
+		terminal.Print("  ")
+		for j := 0; j < 4; j++ {
+			terminal.PutRune(rune(sig[j]))
+		}
+		terminal.Print(" 0x")
+		printHexU64(uint64(addr))
+		terminal.Print(" len=")
+		printUint(uint64(length))
+		terminal.Print(" rev=")
+		printUint(uint64(rev))
+		terminal.Print(" oem=")
+		for j := 0; j < 6; j++ {
+			terminal.PutRune(rune(oem[j]))
+		}
+		terminal.PutRune('\n')
+	}
+
+	terminal.Print("MADT: cpus=")
+	printUint(uint64(acpi.CPUCount()))
+	terminal.Print(" ioapics=")
+	printUint(uint64(acpi.IOAPICCount()))
+	terminal.Print(" overrides=")
+	printUint(uint64(acpi.OverrideCount()))
+	terminal.PutRune('\n')
+
+	if f := acpi.FADTInfo(); f.Present {
+		terminal.Print("FADT: pm1a_cnt=0x")
+		printHex32(f.PM1aControl)
+		terminal.Print(" sci=")
+		printUint(uint64(f.SCIInterrupt))
+		terminal.Print(" reset=0x")
+		printHexU64(f.ResetReg.Address)
+		terminal.PutRune('\n')
+	}
+
+	if h := acpi.HPET(); h.Present {
+		terminal.Print("HPET: base=0x")
+		printHexU64(h.Address)
+		terminal.PutRune('\n')
+	}
+}
+
 func isSpace(b byte) bool {
 	return b == ' ' || b == '\t'
 }
@@ -786,6 +1249,15 @@ func parseDec(start, end int) (int, bool) {
 	return n, true
 }
 
+// parseSigned is parseDec with an optional leading '-'
+func parseSigned(start, end int) (int, bool) {
+	if start < end && lineBuf[start] == '-' {
+		n, ok := parseDec(start+1, end)
+		return -n, ok
+	}
+	return parseDec(start, end)
+}
+
 func parseHex64(start, end int) (uint64, bool) {
 	if start >= end {
 		return 0, false
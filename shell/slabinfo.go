@@ -0,0 +1,28 @@
+package shell
+
+import (
+	"github.com/dmarro89/go-dav-os/slab"
+	"github.com/dmarro89/go-dav-os/terminal"
+)
+
+var slabInfo slab.CacheInfo
+
+// printSlabInfo lists every slab cache with its object size, how many
+// objects are handed out out of how many its slabs hold, and its counters
+func printSlabInfo() {
+	terminal.Print("NAME           SIZE ACTIVE  TOTAL SLABS   ALLOCS    FREES\n")
+	for i := 0; i < slab.CacheCount(); i++ {
+		if !slab.CacheInfoAt(i, &slabInfo) {
+			continue
+		}
+		ci := &slabInfo
+		printPadded(ci.Name, 12)
+		printIntPad(ci.Size, 7)
+		printIntPad(ci.Active, 7)
+		printIntPad(ci.Slabs*ci.PerSlab, 7)
+		printIntPad(ci.Slabs, 6)
+		printIntPad(int(ci.Allocs), 9)
+		printIntPad(int(ci.Frees), 9)
+		terminal.PutRune('\n')
+	}
+}
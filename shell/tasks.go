@@ -0,0 +1,270 @@
+package shell
+
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/heap"
+	"github.com/dmarro89/go-dav-os/kernel/channel"
+	"github.com/dmarro89/go-dav-os/kernel/scheduler"
+	"github.com/dmarro89/go-dav-os/kernel/timer"
+	"github.com/dmarro89/go-dav-os/terminal"
+)
+
+const (
+	topRefreshMs = 1000
+	topPollMs    = 100
+	pingRounds   = 1000
+)
+
+var (
+	// returns a pending key without blocking, for `top`
+	tryKey func() (rune, bool)
+
+	taskInfo scheduler.TaskInfo
+
+	// runtime of each pool slot at the previous `top` refresh
+	topPrevID      [scheduler.MaxTasks]int
+	topPrevRuntime [scheduler.MaxTasks]uint64
+
+	// `top` wakes on a periodic tick timer; topFired counts its runs
+	topWake  scheduler.WaitQueue
+	topFired uint64
+
+	spinCount uint64
+)
+
+// SetKeyProvider wires a non-blocking keyboard read, used by `top` to
+// notice a key press between refreshes
+func SetKeyProvider(fn func() (rune, bool)) { tryKey = fn }
+
+// demoCount and demoAt list the task functions `spawn` can start
+func demoCount() int { return 3 }
+
+func demoAt(i int) (string, func()) {
+	switch i {
+	case 0:
+		return "spin", demoSpin
+	case 1:
+		return "sleeper", demoSleeper
+	case 2:
+		return "pingpong", demoPing
+	}
+	return "", nil
+}
+
+// demoSpin burns CPU until killed
+func demoSpin() {
+	for {
+		spinCount++
+	}
+}
+
+// demoSleeper wakes up twice a second and goes back to sleep
+func demoSleeper() {
+	for {
+		scheduler.Sleep(500)
+	}
+}
+
+// demoPing sends pingRounds values over an unbuffered channel of its own
+// to a pong child and exits with the child's status
+func demoPing() {
+	ch := new(channel.Chan)
+	pong := scheduler.NewNamedTask("pong", func() { demoPong(ch) })
+	if pong == nil {
+		heap.Free(unsafe.Pointer(ch))
+		scheduler.Exit(1)
+	}
+	for i := uint64(1); i <= pingRounds; i++ {
+		ch.Send(i)
+	}
+	ch.Close()
+	status, _ := scheduler.Wait(pong.ID)
+	heap.Free(unsafe.Pointer(ch))
+	scheduler.Exit(status)
+}
+
+func demoPong(ch *channel.Chan) {
+	sum := uint64(0)
+	for {
+		v, ok := ch.Recv()
+		if !ok {
+			break
+		}
+		sum += v
+	}
+	if sum != pingRounds*(pingRounds+1)/2 {
+		scheduler.Exit(1)
+	}
+	scheduler.Exit(0)
+}
+
+func spawnTask(start, end int) {
+	for i := 0; i < demoCount(); i++ {
+		name, fn := demoAt(i)
+		if !matchLiteral(start, end, name) {
+			continue
+		}
+		t := scheduler.NewNamedTask(name, fn)
+		if t == nil {
+			terminal.Print("spawn: too many tasks\n")
+			return
+		}
+		terminal.Print("spawned ")
+		terminal.Print(name)
+		terminal.Print(" as task ")
+		printUint(uint64(t.ID))
+		terminal.PutRune('\n')
+		return
+	}
+	terminal.Print("spawn: unknown task, try:")
+	for i := 0; i < demoCount(); i++ {
+		name, _ := demoAt(i)
+		terminal.Print(" ")
+		terminal.Print(name)
+	}
+	terminal.PutRune('\n')
+}
+
+// printTasks lists every task. For `top` it adds the share of CPU time
+// each task got in the elapsed ticks since the previous refresh.
+func printTasks(top bool, elapsed uint64) {
+	terminal.Print("   ID PPID NAME       STATE CPU NICE    TICKS SWITCHES STACK")
+	if top {
+		terminal.Print("  %CPU")
+	}
+	terminal.PutRune('\n')
+
+	for i := 0; i < scheduler.MaxTasks; i++ {
+		if !scheduler.TaskInfoAt(i, &taskInfo) {
+			if top {
+				topPrevID[i] = -1
+			}
+			continue
+		}
+		ti := &taskInfo
+		printIntPad(ti.ID, 5)
+		printIntPad(ti.Parent, 5)
+		terminal.PutRune(' ')
+		printPadded(ti.Name, 10)
+		terminal.PutRune(' ')
+		printPadded(ti.State.String(), 5)
+		printIntPad(ti.CPU, 4)
+		printIntPad(ti.Priority, 5)
+		printIntPad(int(ti.Runtime), 9)
+		printIntPad(int(ti.Switches), 9)
+		if ti.StackMax < 0 {
+			printPadded("     -", 6)
+		} else {
+			printIntPad(ti.StackMax, 6)
+		}
+		if top {
+			if elapsed == 0 || topPrevID[i] != ti.ID {
+				printPadded("     -", 6)
+			} else {
+				delta := ti.Runtime - topPrevRuntime[i]
+				printIntPad(int(delta*100/elapsed), 6)
+			}
+			topPrevID[i] = ti.ID
+			topPrevRuntime[i] = ti.Runtime
+		}
+		terminal.PutRune('\n')
+	}
+}
+
+// runTop redraws the task list every topRefreshMs until a key is pressed.
+// It is woken by a periodic timer on the tick, every topPollMs, to look
+// for a key.
+func runTop() {
+	if tryKey == nil || getTicks == nil {
+		terminal.Print("top: not wired yet\n")
+		return
+	}
+	period := timer.MillisToTicks(topPollMs)
+	id := timer.AddPeriodic(timer.Ticks()+period, period, topTick, 0)
+	if id < 0 {
+		terminal.Print("top: no timer left\n")
+		return
+	}
+	for i := 0; i < scheduler.MaxTasks; i++ {
+		topPrevID[i] = -1
+	}
+	seen := topFired
+	last := getTicks()
+	elapsed := uint64(0)
+	for {
+		terminal.Clear()
+		terminal.Print("top - ")
+		printUint(uint64(scheduler.TaskCount()))
+		terminal.Print(" tasks, policy ")
+		terminal.Print(scheduler.ActivePolicy().Name())
+		terminal.Print(", ticks ")
+		printUint(last)
+		terminal.Print(" (press any key to quit)\n\n")
+		printTasks(true, elapsed)
+
+		for waited := 0; waited < topRefreshMs; waited += topPollMs {
+			if _, ok := tryKey(); ok {
+				timer.Cancel(id)
+				return
+			}
+			seen = waitTopTick(seen)
+		}
+		now := getTicks()
+		elapsed = now - last
+		last = now
+	}
+}
+
+// topTick is the `top` timer callback, run in the tick interrupt.
+func topTick(arg uint64) {
+	topFired++
+	topWake.Wake()
+}
+
+// waitTopTick blocks until the `top` timer ran since it had run seen
+// times, and returns the new count.
+func waitTopTick(seen uint64) uint64 {
+	for {
+		flags := topWake.Prepare()
+		if n := topFired; n != seen {
+			topWake.Finish(flags)
+			return n
+		}
+		topWake.Block(flags)
+	}
+}
+
+func killTask(start, end int) {
+	id, ok := parseDec(start, end)
+	if !ok {
+		terminal.Print("kill: invalid task id\n")
+		return
+	}
+	if !scheduler.Kill(id) {
+		terminal.Print("kill: no such task, or it cannot be killed\n")
+	}
+}
+
+// printPadded prints s left-aligned in a field of width characters
+func printPadded(s string, width int) {
+	terminal.Print(s)
+	for i := len(s); i < width; i++ {
+		terminal.PutRune(' ')
+	}
+}
+
+// printIntPad prints v right-aligned in a field of width characters
+func printIntPad(v int, width int) {
+	n := 1
+	if v < 0 {
+		n++
+	}
+	for u := v / 10; u != 0; u /= 10 {
+		n++
+	}
+	for i := n; i < width; i++ {
+		terminal.PutRune(' ')
+	}
+	terminal.PrintInt(v)
+}
@@ -0,0 +1,98 @@
+package shell
+
+import (
+	"github.com/dmarro89/go-dav-os/terminal"
+	"github.com/dmarro89/go-dav-os/vmm"
+)
+
+// printVMMap lists the kernel mappings, one line per run of virtually and
+// physically contiguous pages with the same flags
+func printVMMap() {
+	if !vmm.Ready() {
+		terminal.Print("vmmap: vmm not initialized\n")
+		return
+	}
+	terminal.Print("START            END              PHYS                SIZE FLAGS\n")
+	from := uintptr(0)
+	for {
+		start, end, phys, flags, ok := vmm.NextRegion(from)
+		if !ok {
+			return
+		}
+		printHexU64(uint64(start))
+		terminal.PutRune(' ')
+		printHexU64(uint64(end))
+		terminal.PutRune(' ')
+		printHexU64(uint64(phys))
+		printSizePad(uint64(end-start), 7)
+		terminal.PutRune(' ')
+		printMapFlags(flags)
+		terminal.PutRune('\n')
+		if end == 0 {
+			return // region reaches the top of the address space
+		}
+		from = end
+	}
+}
+
+// printSizePad prints a byte count in the largest unit that divides it,
+// right-aligned in a field of width characters
+func printSizePad(v uint64, width int) {
+	unit := "K"
+	v >>= 10
+	if v%1024 == 0 {
+		unit = "M"
+		v >>= 10
+		if v%1024 == 0 {
+			unit = "G"
+			v >>= 10
+		}
+	}
+	printIntPad(int(v), width-1)
+	terminal.Print(unit)
+}
+
+func printMapFlags(flags uint64) {
+	terminal.Print("r")
+	if flags&vmm.FlagWrite != 0 {
+		terminal.Print("w")
+	} else {
+		terminal.Print("-")
+	}
+	if flags&vmm.FlagNoExec == 0 {
+		terminal.Print("x")
+	} else {
+		terminal.Print("-")
+	}
+	if flags&vmm.FlagUser != 0 {
+		terminal.Print(" user")
+	}
+	if flags&vmm.FlagWriteThrough != 0 {
+		terminal.Print(" wt")
+	}
+	if flags&vmm.FlagNoCache != 0 {
+		terminal.Print(" nocache")
+	}
+	if flags&vmm.FlagGlobal != 0 {
+		terminal.Print(" global")
+	}
+}
+
+// mapped reports whether every page of [addr, addr+length) is mapped, so
+// `mem` does not fault on a bad address. Without the vmm the boot tables
+// are still live and the check is skipped.
+func mapped(addr uint64, length int) bool {
+	if !vmm.Ready() {
+		return true
+	}
+	end := addr + uint64(length)
+	if end < addr {
+		return false
+	}
+	for p := addr &^ (vmm.PageSize - 1); p < end; p += vmm.PageSize {
+		if _, _, ok := vmm.Translate(uintptr(p)); !ok {
+			return false
+		}
+	}
+	return true
+}
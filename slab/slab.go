@@ -0,0 +1,407 @@
+// Package slab is an object-cache allocator for small kernel objects. A
+// Cache hands out objects of one size carved from slabs: PFA pages reached
+// through the direct map, each starting with a header and a free-list
+// index per object, followed by the objects.
+//
+//	| header | index[0..n) | pad | obj 0 | obj 1 | ... | obj n-1 | unused |
+//
+// The index lives outside the objects, so a cache with a constructor keeps
+// its objects constructed while they sit free. A general cache per power
+// of two from 16 to 1024 bytes backs Alloc and Free for callers that only
+// know a size.
+package slab
+
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+	"github.com/dmarro89/go-dav-os/mem"
+)
+
+const (
+	pageSize = 4096
+
+	// MaxSize is the largest object Alloc serves; bigger ones need whole
+	// pages from mem.AllocPage.
+	MaxSize = 1024
+
+	minSize  = 16
+	maxCache = 32
+
+	slabMagic = 0x51AB51AB
+
+	// index entries: the next free object, or one of these
+	noObject  = 0xFFFE // end of the free list
+	allocated = 0xFFFF // object is handed out
+)
+
+// header starts every slab page.
+type header struct {
+	magic uint32
+	free  uint16 // first free object, or noObject
+	inUse uint16
+	cache *Cache
+	prev  uintptr // neighbours in the cache's partial list
+	next  uintptr
+}
+
+const headerSize = unsafe.Sizeof(header{})
+
+// Cache is a pool of objects of one size. The zero value is unusable;
+// call Init first.
+type Cache struct {
+	name    string
+	size    uintptr // object size, a multiple of the alignment
+	perSlab int
+	objOff  uintptr // offset of object 0 in a slab
+	ctor    func(obj unsafe.Pointer)
+
+	partial uintptr // slabs with at least one free object
+
+	lock sync.IRQSpinLock
+
+	slabs  int
+	active int
+	allocs uint64
+	frees  uint64
+}
+
+// CacheInfo is a snapshot of one cache for slabinfo.
+type CacheInfo struct {
+	Name    string
+	Size    int    // object size in bytes, padding included
+	PerSlab int    // objects per slab page
+	Slabs   int    // slab pages held
+	Active  int    // objects handed out
+	Allocs  uint64 // successful Alloc calls
+	Frees   uint64 // successful Free calls
+}
+
+var (
+	caches     [maxCache]*Cache
+	cacheCount int
+	cachesLock sync.IRQSpinLock
+
+	sizeNames = [...]string{"size-16", "size-32", "size-64", "size-128", "size-256", "size-512", "size-1024"}
+	sizeCache [len(sizeNames)]Cache
+	ready     bool
+
+	// where slab pages can live: the direct map, or test memory
+	pagesBase uintptr = mem.DirectMapBase
+	pagesEnd  uintptr = mem.DirectMapBase + mem.DirectMapSize
+
+	// page hooks for tests; nil means PFA pages through the direct map
+	pageAlloc func() uintptr
+	pageFree  func(page uintptr)
+)
+
+// Init sets up the general caches behind Alloc. Their slabs come from the
+// PFA, so they grow only once it is ready.
+func Init() bool {
+	if ready {
+		return false
+	}
+	for i := range sizeCache {
+		if !sizeCache[i].Init(sizeNames[i], minSize<<uint(i), 0, nil) {
+			return false
+		}
+	}
+	ready = true
+	return true
+}
+
+// Alloc returns a zeroed object of at least size bytes from the smallest
+// general cache that fits, or nil if size is 0 or above MaxSize, or if
+// memory runs out.
+func Alloc(size uintptr) unsafe.Pointer {
+	if !ready || size == 0 || size > MaxSize {
+		return nil
+	}
+	i := 0
+	for uintptr(minSize)<<uint(i) < size {
+		i++
+	}
+	return sizeCache[i].Alloc()
+}
+
+// Free returns an object from any cache to the cache it came from. It
+// reports false if p is not a live slab object.
+func Free(p unsafe.Pointer) bool {
+	if !ready || !inPages(uintptr(p)) {
+		return false
+	}
+	h := slabOf(uintptr(p))
+	if h.magic != slabMagic {
+		return false
+	}
+	c := h.cache
+	if !registered(c) {
+		return false
+	}
+	return c.Free(p)
+}
+
+// Init prepares the cache and registers it for slabinfo. Objects are size
+// bytes, aligned to align (0 means 8, otherwise a power of two). ctor, if
+// set, runs once on every object when its slab is created; Free expects
+// objects back in their constructed state. Without a ctor Alloc zeroes
+// each object. ctor runs with the cache locked and must not use it.
+func (c *Cache) Init(name string, size, align uintptr, ctor func(obj unsafe.Pointer)) bool {
+	if align == 0 {
+		align = 8
+	}
+	if size == 0 || align&(align-1) != 0 || align > pageSize/2 {
+		return false
+	}
+	size = (size + align - 1) &^ (align - 1)
+
+	// as many objects as fit after the header and their index entries
+	n := int((pageSize - headerSize) / (size + 2))
+	off := uintptr(0)
+	for ; n > 0; n-- {
+		off = (headerSize + uintptr(n)*2 + align - 1) &^ (align - 1)
+		if off+uintptr(n)*size <= pageSize {
+			break
+		}
+	}
+	if n == 0 {
+		return false
+	}
+
+	f := cachesLock.Lock()
+	ok := cacheCount < maxCache
+	if ok {
+		c.name = name
+		c.size = size
+		c.perSlab = n
+		c.objOff = off
+		c.ctor = ctor
+		caches[cacheCount] = c
+		cacheCount++
+	}
+	cachesLock.Unlock(f)
+	return ok
+}
+
+// Size returns the size of the cache's objects, padding included.
+func (c *Cache) Size() uintptr { return c.size }
+
+// Alloc takes a free object, adding a slab when none is left. It returns
+// nil when no page can be had.
+func (c *Cache) Alloc() unsafe.Pointer {
+	if c.perSlab == 0 {
+		return nil
+	}
+	f := c.lock.Lock()
+	s := c.partial
+	if s == 0 {
+		s = c.grow()
+	}
+	obj := uintptr(0)
+	if s != 0 {
+		h := slabOf(s)
+		i := h.free
+		h.free = *c.index(s, i)
+		*c.index(s, i) = allocated
+		h.inUse++
+		if h.free == noObject {
+			c.unlink(s)
+		}
+		c.active++
+		c.allocs++
+		obj = s + c.objOff + uintptr(i)*c.size
+	}
+	c.lock.Unlock(f)
+	if obj == 0 {
+		return nil
+	}
+	if c.ctor == nil {
+		zero(obj, c.size)
+	}
+	return unsafe.Pointer(obj)
+}
+
+// Free gives an object back to the cache. A slab left empty goes back to
+// the PFA unless it is the cache's last one with room. Free reports false
+// for pointers the cache did not hand out and for objects already free.
+func (c *Cache) Free(p unsafe.Pointer) bool {
+	obj := uintptr(p)
+	if !inPages(obj) {
+		return false
+	}
+	s := obj &^ (pageSize - 1)
+	f := c.lock.Lock()
+	i, ok := c.slot(s, obj)
+	if ok {
+		h := slabOf(s)
+		if h.free == noObject {
+			c.push(s)
+		}
+		*c.index(s, i) = h.free
+		h.free = i
+		h.inUse--
+		c.active--
+		c.frees++
+		if h.inUse == 0 && (c.partial != s || h.next != 0) {
+			c.unlink(s)
+			h.magic = 0
+			c.slabs--
+			releasePage(s)
+		}
+	}
+	c.lock.Unlock(f)
+	return ok
+}
+
+// CacheCount returns the number of registered caches.
+func CacheCount() int { return cacheCount }
+
+// CacheInfoAt fills info with cache i (0 to CacheCount()-1) and reports
+// false if there is none.
+func CacheInfoAt(i int, info *CacheInfo) bool {
+	if i < 0 || i >= cacheCount {
+		return false
+	}
+	c := caches[i]
+	f := c.lock.Lock()
+	info.Name = c.name
+	info.Size = int(c.size)
+	info.PerSlab = c.perSlab
+	info.Slabs = c.slabs
+	info.Active = c.active
+	info.Allocs = c.allocs
+	info.Frees = c.frees
+	c.lock.Unlock(f)
+	return true
+}
+
+// grow builds a new slab, runs the constructor on its objects and puts it
+// on the partial list. Called with c.lock held.
+func (c *Cache) grow() uintptr {
+	s := newPage()
+	if s == 0 {
+		return 0
+	}
+	h := slabOf(s)
+	h.magic = slabMagic
+	h.cache = c
+	h.inUse = 0
+	h.free = 0
+	for i := 0; i < c.perSlab; i++ {
+		next := uint16(i + 1)
+		if i == c.perSlab-1 {
+			next = noObject
+		}
+		*c.index(s, uint16(i)) = next
+		if c.ctor != nil {
+			c.ctor(unsafe.Pointer(s + c.objOff + uintptr(i)*c.size))
+		}
+	}
+	c.slabs++
+	c.push(s)
+	return s
+}
+
+// slot returns the index of obj in slab s if it is an object of c that is
+// handed out. Called with c.lock held.
+func (c *Cache) slot(s, obj uintptr) (uint16, bool) {
+	if c.slabs == 0 || obj < s+c.objOff {
+		return 0, false
+	}
+	h := slabOf(s)
+	if h.magic != slabMagic || h.cache != c {
+		return 0, false
+	}
+	off := obj - s - c.objOff
+	if off%c.size != 0 || off/c.size >= uintptr(c.perSlab) {
+		return 0, false
+	}
+	i := uint16(off / c.size)
+	return i, *c.index(s, i) == allocated
+}
+
+func (c *Cache) index(s uintptr, i uint16) *uint16 {
+	return (*uint16)(unsafe.Pointer(s + headerSize + uintptr(i)*2))
+}
+
+// push adds slab s at the head of the partial list.
+func (c *Cache) push(s uintptr) {
+	h := slabOf(s)
+	h.prev = 0
+	h.next = c.partial
+	if c.partial != 0 {
+		slabOf(c.partial).prev = s
+	}
+	c.partial = s
+}
+
+// unlink takes slab s off the partial list.
+func (c *Cache) unlink(s uintptr) {
+	h := slabOf(s)
+	if h.prev != 0 {
+		slabOf(h.prev).next = h.next
+	} else {
+		c.partial = h.next
+	}
+	if h.next != 0 {
+		slabOf(h.next).prev = h.prev
+	}
+	h.prev = 0
+	h.next = 0
+}
+
+// registered reports whether c is one of the registered caches, so a page
+// that merely looks like a slab cannot hand Free a stray *Cache.
+func registered(c *Cache) bool {
+	f := cachesLock.Lock()
+	ok := false
+	for i := 0; i < cacheCount; i++ {
+		if caches[i] == c {
+			ok = true
+			break
+		}
+	}
+	cachesLock.Unlock(f)
+	return ok
+}
+
+// inPages reports whether p is an address a slab page can hold, so its
+// page header can be read.
+func inPages(p uintptr) bool {
+	return p >= pagesBase && p < pagesEnd
+}
+
+func slabOf(s uintptr) *header {
+	return (*header)(unsafe.Pointer(s &^ (pageSize - 1)))
+}
+
+// newPage returns the direct-map address of a fresh page, or 0. Pages
+// above the direct map are handed back.
+func newPage() uintptr {
+	if pageAlloc != nil {
+		return pageAlloc()
+	}
+	p := mem.AllocPage()
+	if p == 0 {
+		return 0
+	}
+	if p >= mem.DirectMapSize {
+		mem.FreePage(p)
+		return 0
+	}
+	return mem.PhysToVirt(p)
+}
+
+func releasePage(s uintptr) {
+	if pageFree != nil {
+		pageFree(s)
+		return
+	}
+	mem.FreePage(mem.VirtToPhys(s))
+}
+
+func zero(p, n uintptr) {
+	for i := uintptr(0); i < n; i++ {
+		*(*byte)(unsafe.Pointer(p + i)) = 0
+	}
+}
@@ -0,0 +1,219 @@
+package slab
+
+import (
+	"testing"
+	"unsafe"
+)
+
+const testPages = 16
+
+// slabPages backs slabs in tests: mockInit makes its page-aligned part the
+// slab range, and pages are handed out from it in order
+var (
+	slabPages [(testPages + 1) * pageSize]byte
+	nextPage  uintptr
+	freed     int
+)
+
+func mockInit(t *testing.T) {
+	pagesBase = (uintptr(unsafe.Pointer(&slabPages[0])) + pageSize - 1) &^ (pageSize - 1)
+	pagesEnd = pagesBase + testPages*pageSize
+	for i := range slabPages {
+		slabPages[i] = 0xAA
+	}
+	nextPage = pagesBase
+	freed = 0
+	pageAlloc = func() uintptr {
+		if nextPage == pagesEnd {
+			return 0
+		}
+		nextPage += pageSize
+		return nextPage - pageSize
+	}
+	pageFree = func(page uintptr) { freed++ }
+	cacheCount = 0
+	ready = false
+	for i := range sizeCache {
+		sizeCache[i] = Cache{}
+	}
+	if !Init() {
+		t.Fatalf("Expected Init to succeed")
+	}
+}
+
+func TestCacheLayout(t *testing.T) {
+	mockInit(t)
+
+	var c Cache
+	if !c.Init("odd", 24, 16, nil) {
+		t.Fatalf("Expected Init to succeed")
+	}
+	if c.Size() != 32 {
+		t.Errorf("Expected size rounded up to 32, got %d", c.Size())
+	}
+	if c.objOff%16 != 0 || c.objOff < headerSize+uintptr(c.perSlab)*2 {
+		t.Errorf("Expected objects aligned after the index, got offset %d for %d objects", c.objOff, c.perSlab)
+	}
+	if c.objOff+uintptr(c.perSlab+1)*c.size <= pageSize {
+		t.Errorf("Expected %d objects to fill the slab, one more still fits", c.perSlab)
+	}
+	var big Cache
+	if big.Init("big", pageSize, 0, nil) {
+		t.Errorf("Expected Init of a page-sized object to fail")
+	}
+	if c.Init("bad", 8, 3, nil) {
+		t.Errorf("Expected Init with a non power of two alignment to fail")
+	}
+}
+
+func TestAllocFree(t *testing.T) {
+	mockInit(t)
+
+	var c Cache
+	c.Init("obj", 100, 0, nil)
+	objs := make([]unsafe.Pointer, 0, c.perSlab+1)
+	for i := 0; i <= c.perSlab; i++ {
+		p := c.Alloc()
+		if p == nil {
+			t.Fatalf("Expected Alloc %d to succeed", i)
+		}
+		b := (*[100]byte)(p)
+		for j, v := range b {
+			if v != 0 {
+				t.Fatalf("Expected object %d to be zeroed, byte %d is %#x", i, j, v)
+			}
+		}
+		b[0] = 0xFF
+		objs = append(objs, p)
+	}
+	if c.slabs != 2 || c.active != c.perSlab+1 {
+		t.Errorf("Expected 2 slabs and %d active objects, got %d and %d", c.perSlab+1, c.slabs, c.active)
+	}
+
+	if !c.Free(objs[0]) {
+		t.Fatalf("Expected Free to succeed")
+	}
+	if c.Free(objs[0]) {
+		t.Errorf("Expected a double Free to fail")
+	}
+	if c.Free(unsafe.Pointer(uintptr(objs[1]) + 8)) {
+		t.Errorf("Expected Free of an interior pointer to fail")
+	}
+	if p := c.Alloc(); p != objs[0] {
+		t.Errorf("Expected the freed object to be reused, got %#x want %#x", uintptr(p), uintptr(objs[0]))
+	}
+
+	// emptying the second slab keeps it: it is the only one with room
+	c.Free(objs[c.perSlab])
+	if c.slabs != 2 || freed != 0 {
+		t.Errorf("Expected the last slab with room to stay, got %d slabs and %d pages freed", c.slabs, freed)
+	}
+	// once another slab has room, an emptied slab goes back
+	for i := 0; i < c.perSlab; i++ {
+		if !c.Free(objs[i]) {
+			t.Errorf("Expected Free of object %d to succeed", i)
+		}
+	}
+	if c.slabs != 1 || freed != 1 || c.active != 0 {
+		t.Errorf("Expected 1 slab left, 1 page freed and nothing active, got %d, %d and %d", c.slabs, freed, c.active)
+	}
+}
+
+func TestConstructor(t *testing.T) {
+	mockInit(t)
+
+	calls := 0
+	var c Cache
+	c.Init("ctor", 16, 0, func(obj unsafe.Pointer) {
+		calls++
+		*(*uint64)(obj) = 42
+	})
+	p := c.Alloc()
+	if calls != c.perSlab {
+		t.Errorf("Expected the constructor to run on all %d objects of the slab, got %d", c.perSlab, calls)
+	}
+	if v := *(*uint64)(p); v != 42 {
+		t.Errorf("Expected a constructed object, got %d", v)
+	}
+	c.Free(p)
+	q := c.Alloc()
+	if calls != c.perSlab || *(*uint64)(q) != 42 {
+		t.Errorf("Expected a reused object to keep its state without another constructor call")
+	}
+}
+
+func TestGeneralCaches(t *testing.T) {
+	mockInit(t)
+
+	for _, tc := range []struct {
+		size uintptr
+		want string
+	}{{1, "size-16"}, {16, "size-16"}, {17, "size-32"}, {300, "size-512"}, {MaxSize, "size-1024"}} {
+		p := Alloc(tc.size)
+		if p == nil {
+			t.Fatalf("Expected Alloc(%d) to succeed", tc.size)
+		}
+		if got := slabOf(uintptr(p)).cache.name; got != tc.want {
+			t.Errorf("Expected Alloc(%d) from %s, got %s", tc.size, tc.want, got)
+		}
+		if !Free(p) {
+			t.Errorf("Expected Free of a %d byte object to succeed", tc.size)
+		}
+	}
+	if Alloc(0) != nil || Alloc(MaxSize+1) != nil {
+		t.Errorf("Expected Alloc of 0 or more than MaxSize bytes to fail")
+	}
+	if Free(unsafe.Pointer(pagesEnd)) {
+		t.Errorf("Expected Free of memory outside any slab to fail")
+	}
+	var local uint64
+	if Free(unsafe.Pointer(&local)) || sizeCache[0].Free(unsafe.Pointer(&local)) {
+		t.Errorf("Expected Free of memory outside the slab range to fail")
+	}
+
+	// a slab header pointing at a cache that was never registered
+	p := Alloc(16)
+	c := &sizeCache[0]
+	stray := &Cache{size: c.size, perSlab: c.perSlab, objOff: c.objOff, slabs: 1}
+	slabOf(uintptr(p)).cache = stray
+	if Free(p) {
+		t.Errorf("Expected Free through an unregistered cache to fail")
+	}
+	slabOf(uintptr(p)).cache = c
+}
+
+func TestOutOfPages(t *testing.T) {
+	mockInit(t)
+
+	n := 0
+	for Alloc(MaxSize) != nil {
+		n++
+	}
+	if n != testPages*sizeCache[len(sizeCache)-1].perSlab {
+		t.Errorf("Expected every test page to be used, got %d objects", n)
+	}
+}
+
+func TestCacheInfo(t *testing.T) {
+	mockInit(t)
+
+	var c Cache
+	c.Init("info", 64, 0, nil)
+	p := c.Alloc()
+	c.Alloc()
+	c.Free(p)
+
+	if CacheCount() != len(sizeNames)+1 {
+		t.Fatalf("Expected %d caches, got %d", len(sizeNames)+1, CacheCount())
+	}
+	var info CacheInfo
+	if !CacheInfoAt(CacheCount()-1, &info) {
+		t.Fatalf("Expected info for the last cache")
+	}
+	if info.Name != "info" || info.Size != 64 || info.Slabs != 1 || info.Active != 1 || info.Allocs != 2 || info.Frees != 1 {
+		t.Errorf("Expected info 64 byte objects, 1 slab, 1 active, 2 allocs, 1 free, got %+v", info)
+	}
+	if CacheInfoAt(CacheCount(), &info) {
+		t.Errorf("Expected no cache past the last one")
+	}
+}
@@ -1,6 +1,10 @@
 package terminal
 
-import "unsafe"
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/mem"
+)
 
 func outb(port uint16, value byte)
 func debugChar(c byte)
@@ -13,7 +17,8 @@ const (
 	vgaCursorDataPort  uint16 = 0x3D5
 )
 
-const videoMemoryAddr uintptr = 0xB8000
+// VGA text buffer at physical 0xB8000
+const videoMemoryAddr uintptr = mem.DirectMapBase + 0xB8000
 
 func getVidMem() *[VGAHeight][VGAWidth][2]byte {
 	return (*[VGAHeight][VGAWidth][2]byte)(unsafe.Pointer(videoMemoryAddr))
@@ -0,0 +1,385 @@
+// Package vmm owns the kernel page tables. Init replaces the boot tables
+// with ones built from PFA pages and loads them into CR3; from then on
+// pages can be mapped, unmapped and re-protected one 4 KiB page at a time.
+// A 2 MiB page is split into a page table the first time a page inside it
+// changes.
+//
+// Layout (the lower half stays unmapped, so null pointers fault):
+//
+//	0xFFFF800000000000  direct map of physical memory below 4 GiB (mem)
+//	0xFFFFC00000000000  task stacks (kernel/stacks.go)
+//	0xFFFFD00000000000  kernel heap (heap)
+//	0xFFFFFFFF80000000  kernel image (boot/linker.ld)
+package vmm
+
+import (
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/kernel/sync"
+	"github.com/dmarro89/go-dav-os/mem"
+)
+
+// Assembly hooks (boot/stubs_amd64.s)
+func writeCR3(v uint64)
+func invlpg(addr uintptr)
+
+// kernelLayout stores the linker's section bounds: start of .text, start
+// of .rodata, start of .data and end of the image.
+func kernelLayout(out *[4]uintptr)
+
+const (
+	PageSize = 4096
+	hugeSize = 2 << 20
+
+	// Flags accepted by Map and Protect; every mapping is present.
+	FlagWrite        = 1 << 1
+	FlagUser         = 1 << 2
+	FlagWriteThrough = 1 << 3
+	FlagNoCache      = 1 << 4
+	FlagGlobal       = 1 << 8
+	FlagNoExec       = 1 << 63
+
+	flagPresent = 1 << 0
+	flagHuge    = 1 << 7
+	flagMask    = FlagWrite | FlagUser | FlagWriteThrough | FlagNoCache | FlagGlobal | FlagNoExec
+	addrMask    = 0x000FFFFFFFFFF000
+
+	// canonical address hole between the lower and the upper half
+	lowerHalfEnd   = 0x0000800000000000
+	upperHalfStart = 0xFFFF800000000000
+)
+
+var (
+	pml4   uintptr // physical address of the root table
+	active bool    // pml4 is loaded in CR3
+	nx     bool    // EFER.NXE is on, FlagNoExec may be set
+
+	// where page tables are read and written: physical memory through
+	// the direct map. Tests use ordinary memory and set it to 0.
+	physBase uintptr = mem.DirectMapBase
+
+	lock sync.IRQSpinLock
+
+	// allocates a page-table page (physical address, 0 on failure);
+	// nil means mem.AllocPage
+	pageAlloc func() uint64
+
+	// tells the other CPUs to flush their TLBs after a mapping was
+	// removed or restricted; nil on a single CPU
+	shootdown func()
+)
+
+// SetShootdownHook installs the function that makes every other CPU
+// flush its TLB. Unmap and Protect call it after invalidating their own.
+func SetShootdownHook(fn func()) { shootdown = fn }
+
+// Init builds the kernel page tables and switches CR3 to them. The PFA
+// must be ready. noExec tells whether boot.s turned on EFER.NXE; without
+// it FlagNoExec is dropped. Init runs before the other CPUs start, which
+// then load the same CR3.
+func Init(noExec bool) bool {
+	if active || !mem.PFAReady() {
+		return false
+	}
+	nx = noExec
+	var layout [4]uintptr
+	kernelLayout(&layout)
+	if !build() || !mapImage(&layout) {
+		pml4 = 0
+		return false
+	}
+	writeCR3(uint64(pml4))
+	active = true
+	return true
+}
+
+// Ready reports whether Init switched to the vmm page tables.
+func Ready() bool { return active }
+
+// build creates the root table and the direct map of physical memory,
+// writable and not executable, with 2 MiB pages.
+func build() bool {
+	root := newTable()
+	if root == 0 {
+		return false
+	}
+	for phys := uintptr(0); phys < mem.DirectMapSize; phys += hugeSize {
+		pd := walk(root, mem.DirectMapBase+phys, 1, true)
+		if pd == nil {
+			return false
+		}
+		*pd = uint64(phys) | pteFlags(FlagWrite|FlagNoExec) | flagHuge
+	}
+	pml4 = root
+	return true
+}
+
+// mapImage maps the kernel image at its link address with 4 KiB pages:
+// .text read-only and executable, .rodata read-only, .data, .bss and the
+// boot stack writable.
+func mapImage(layout *[4]uintptr) bool {
+	for virt := layout[0]; virt < layout[3]; virt += PageSize {
+		flags := uint64(0)
+		if virt >= layout[2] {
+			flags = FlagWrite | FlagNoExec
+		} else if virt >= layout[1] {
+			flags = FlagNoExec
+		}
+		if !Map(virt, virt-mem.KernelBase, flags) {
+			return false
+		}
+	}
+	return true
+}
+
+// Map maps the 4 KiB page at virt to phys. Both must be page aligned and
+// virt must not be mapped yet.
+func Map(virt, phys uintptr, flags uint64) bool {
+	if virt%PageSize != 0 || phys%PageSize != 0 || pml4 == 0 {
+		return false
+	}
+	f := lock.Lock()
+	pte := leaf(virt, true)
+	ok := pte != nil && *pte&flagPresent == 0
+	if ok {
+		*pte = uint64(phys) | pteFlags(flags)
+	}
+	lock.Unlock(f)
+	return ok
+}
+
+// Unmap removes the mapping of the page at virt and returns false if
+// there was none. The physical page is not freed.
+func Unmap(virt uintptr) bool {
+	return change(virt, 0, true)
+}
+
+// Protect replaces the flags of the mapped page at virt.
+func Protect(virt uintptr, flags uint64) bool {
+	return change(virt, flags, false)
+}
+
+func change(virt uintptr, flags uint64, unmap bool) bool {
+	if virt%PageSize != 0 || pml4 == 0 {
+		return false
+	}
+	f := lock.Lock()
+	pte := leaf(virt, false)
+	ok := pte != nil && *pte&flagPresent != 0
+	if ok {
+		if unmap {
+			*pte = 0
+		} else {
+			*pte = *pte&addrMask | pteFlags(flags)
+		}
+		flush(virt)
+	}
+	lock.Unlock(f)
+	if ok && active && shootdown != nil {
+		shootdown()
+	}
+	return ok
+}
+
+// Translate returns the physical address and flags virt is mapped to.
+func Translate(virt uintptr) (phys uintptr, flags uint64, ok bool) {
+	if pml4 == 0 {
+		return 0, 0, false
+	}
+	f := lock.Lock()
+	e, size := lookup(virt)
+	if e != 0 {
+		phys = uintptr(e&addrMask)&^(size-1) + virt&(size-1)
+		flags = e & flagMask
+		ok = true
+	}
+	lock.Unlock(f)
+	return phys, flags, ok
+}
+
+// Root returns the physical address of the root table, for CR3.
+func Root() uint64 { return uint64(pml4) }
+
+// FlushTLB drops every non-global TLB entry of the executing CPU by
+// reloading CR3. Other CPUs call it when asked by the shootdown hook.
+func FlushTLB() {
+	if active {
+		writeCR3(uint64(pml4))
+	}
+}
+
+// pteFlags turns Map/Protect flags into the low bits of a present entry.
+func pteFlags(flags uint64) uint64 {
+	flags &= flagMask
+	if !nx {
+		flags &^= FlagNoExec
+	}
+	return flags | flagPresent
+}
+
+func flush(virt uintptr) {
+	if active {
+		invlpg(virt)
+	}
+}
+
+// entry returns a pointer to entry i of the table at physical address t.
+func entry(t uintptr, i uintptr) *uint64 {
+	return (*uint64)(unsafe.Pointer(physToVirt(t) + i*8))
+}
+
+// physToVirt returns where a page table at physical address phys is
+// accessed.
+func physToVirt(phys uintptr) uintptr { return phys + physBase }
+
+func index(virt uintptr, level int) uintptr {
+	return virt >> (12 + 9*uint(level)) & 511
+}
+
+// newTable allocates a zeroed page-table page. PFA pages must lie in the
+// direct map to be reachable.
+func newTable() uintptr {
+	var p uint64
+	if pageAlloc != nil {
+		p = pageAlloc()
+	} else if p = mem.AllocPage(); p >= mem.DirectMapSize {
+		mem.FreePage(p)
+		p = 0
+	}
+	if p == 0 {
+		return 0
+	}
+	for i := uintptr(0); i < PageSize/8; i++ {
+		*entry(uintptr(p), i) = 0
+	}
+	return uintptr(p)
+}
+
+// walk returns the entry for virt in the table at level stop (3 = PML4,
+// 0 = page table), starting at root. Missing tables are created if
+// create is set, else walk returns nil. Intermediate entries are writable
+// and user-accessible: the leaf decides.
+func walk(root uintptr, virt uintptr, stop int, create bool) *uint64 {
+	t := root
+	for level := 3; level > stop; level-- {
+		e := entry(t, index(virt, level))
+		if *e&flagPresent == 0 {
+			if !create {
+				return nil
+			}
+			n := newTable()
+			if n == 0 {
+				return nil
+			}
+			*e = uint64(n) | flagPresent | FlagWrite | FlagUser
+		}
+		if *e&flagHuge != 0 {
+			return nil
+		}
+		t = uintptr(*e & addrMask)
+	}
+	return entry(t, index(virt, stop))
+}
+
+// leaf returns the page table entry of virt, splitting a 2 MiB page that
+// covers it. Called with lock held.
+func leaf(virt uintptr, create bool) *uint64 {
+	pd := walk(pml4, virt, 1, create)
+	if pd == nil {
+		return nil
+	}
+	if *pd&flagHuge != 0 {
+		if !split(pd) {
+			return nil
+		}
+		// drop the 2 MiB TLB entry before the CPU can mix it with
+		// entries of the new page table
+		flush(virt)
+	}
+	if *pd&flagPresent == 0 {
+		if !create {
+			return nil
+		}
+		n := newTable()
+		if n == 0 {
+			return nil
+		}
+		*pd = uint64(n) | flagPresent | FlagWrite | FlagUser
+	}
+	return entry(uintptr(*pd&addrMask), index(virt, 0))
+}
+
+// split replaces a 2 MiB mapping with a page table of 512 pages mapping
+// the same memory with the same flags.
+func split(pd *uint64) bool {
+	pt := newTable()
+	if pt == 0 {
+		return false
+	}
+	base := *pd & addrMask &^ (hugeSize - 1)
+	flags := *pd&flagMask | flagPresent
+	for i := uintptr(0); i < 512; i++ {
+		*entry(pt, i) = base + uint64(i*PageSize) | flags
+	}
+	*pd = uint64(pt) | flagPresent | FlagWrite | FlagUser
+	return true
+}
+
+// lookup returns the leaf entry mapping virt and the size of the page it
+// maps, or 0 and the size of the unmapped area around virt, so a scan can
+// skip it. Called with lock held.
+func lookup(virt uintptr) (uint64, uintptr) {
+	t := pml4
+	for level := 3; level >= 0; level-- {
+		size := uintptr(1) << (12 + 9*uint(level))
+		e := *entry(t, index(virt, level))
+		if e&flagPresent == 0 {
+			return 0, size
+		}
+		if level == 0 || e&flagHuge != 0 {
+			return e, size
+		}
+		t = uintptr(e & addrMask)
+	}
+	return 0, PageSize
+}
+
+// NextRegion finds the first mapped region at or above from and returns
+// it as [start, end) mapped to phys with the given flags. Pages are merged
+// into one region while they are physically contiguous and have the same
+// flags. ok is false once nothing is mapped above from.
+func NextRegion(from uintptr) (start, end, phys uintptr, flags uint64, ok bool) {
+	if pml4 == 0 {
+		return 0, 0, 0, 0, false
+	}
+	f := lock.Lock()
+	virt := from &^ (PageSize - 1)
+	for {
+		if virt >= lowerHalfEnd && virt < upperHalfStart {
+			virt = upperHalfStart
+		}
+		e, size := lookup(virt)
+		if e != 0 {
+			start = virt
+			phys = uintptr(e&addrMask)&^(size-1) + virt&(size-1)
+			flags = e & flagMask
+			end = virt&^(size-1) + size
+			ok = true
+			break
+		}
+		next := virt&^(size-1) + size
+		if next <= virt {
+			break // wrapped past the top of the address space
+		}
+		virt = next
+	}
+	for ok && end != 0 && !(end >= lowerHalfEnd && end < upperHalfStart) {
+		e, size := lookup(end)
+		if e == 0 || e&flagMask != flags || uintptr(e&addrMask)&^(size-1) != phys+(end-start) {
+			break
+		}
+		end += size
+	}
+	lock.Unlock(f)
+	return start, end, phys, flags, ok
+}
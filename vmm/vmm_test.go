@@ -0,0 +1,226 @@
+package vmm
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/dmarro89/go-dav-os/mem"
+)
+
+const testTablePages = 64
+
+// testMem backs page-table pages in tests; testBase is its first 4 KiB
+// aligned address
+var (
+	testMem  [(testTablePages + 1) * PageSize]byte
+	testBase uintptr
+	testUsed int
+)
+
+func testPageAlloc() uint64 {
+	if testUsed == testTablePages {
+		return 0
+	}
+	p := testBase + uintptr(testUsed)*PageSize
+	testUsed++
+	return uint64(p)
+}
+
+func mockInit(t *testing.T) {
+	testBase = (uintptr(unsafe.Pointer(&testMem[0])) + PageSize - 1) &^ (PageSize - 1)
+	testUsed = 0
+	pml4 = 0
+	active = false
+	nx = false
+	physBase = 0
+	shootdown = nil
+	pageAlloc = testPageAlloc
+	if !build() {
+		t.Fatalf("Expected build to succeed")
+	}
+}
+
+func TestBuildDirectMap(t *testing.T) {
+	mockInit(t)
+
+	// PML4, one PDPT and four page directories
+	if testUsed != 6 {
+		t.Errorf("Expected 6 table pages, got %d", testUsed)
+	}
+	for _, addr := range []uintptr{0, 0x1234, 0x200000, 0xFEE00000, mem.DirectMapSize - 1} {
+		phys, flags, ok := Translate(mem.DirectMapBase + addr)
+		if !ok || phys != addr {
+			t.Errorf("Expected %#x to map %#x, got %#x (ok=%v)", mem.DirectMapBase+addr, addr, phys, ok)
+		}
+		if flags != FlagWrite {
+			t.Errorf("Expected %#x to be writable, got flags %#x", addr, flags)
+		}
+	}
+	if _, _, ok := Translate(mem.DirectMapBase + mem.DirectMapSize); ok {
+		t.Errorf("Expected nothing mapped past the direct map")
+	}
+	if _, _, ok := Translate(0); ok {
+		t.Errorf("Expected the lower half to be unmapped")
+	}
+}
+
+func TestNoExec(t *testing.T) {
+	mockInit(t)
+	nx = true
+	defer func() { nx = false }()
+
+	if !Map(0x100000000, 0x5000, FlagWrite|FlagNoExec) {
+		t.Fatalf("Expected Map to succeed")
+	}
+	if _, flags, _ := Translate(0x100000000); flags != FlagWrite|FlagNoExec {
+		t.Errorf("Expected writable no-exec page, got flags %#x", flags)
+	}
+
+	nx = false
+	if !Map(0x100001000, 0x6000, FlagNoExec) {
+		t.Fatalf("Expected Map to succeed")
+	}
+	if _, flags, _ := Translate(0x100001000); flags != 0 {
+		t.Errorf("Expected FlagNoExec to be dropped without NXE, got flags %#x", flags)
+	}
+}
+
+func TestMapImage(t *testing.T) {
+	mockInit(t)
+	nx = true
+	defer func() { nx = false }()
+
+	base := uintptr(mem.KernelBase + 0x100000)
+	layout := [4]uintptr{base, base + 2*PageSize, base + 3*PageSize, base + 5*PageSize}
+	if !mapImage(&layout) {
+		t.Fatalf("Expected mapImage to succeed")
+	}
+	want := []uint64{0, 0, FlagNoExec, FlagWrite | FlagNoExec, FlagWrite | FlagNoExec}
+	for i, w := range want {
+		virt := base + uintptr(i)*PageSize
+		phys, flags, ok := Translate(virt)
+		if !ok || phys != 0x100000+uintptr(i)*PageSize || flags != w {
+			t.Errorf("Expected page %d at %#x with flags %#x, got %#x flags %#x (ok=%v)", i, 0x100000+uintptr(i)*PageSize, w, phys, flags, ok)
+		}
+	}
+	if _, _, ok := Translate(base + 5*PageSize); ok {
+		t.Errorf("Expected nothing mapped past the image")
+	}
+}
+
+func TestMapUnmap(t *testing.T) {
+	mockInit(t)
+
+	virt := uintptr(0x100000000)
+	if !Map(virt, 0x5000, FlagWrite) {
+		t.Fatalf("Expected Map to succeed")
+	}
+	if Map(virt, 0x6000, FlagWrite) {
+		t.Errorf("Expected Map of a mapped page to fail")
+	}
+	if Map(virt+1, 0x6000, FlagWrite) {
+		t.Errorf("Expected Map of an unaligned address to fail")
+	}
+	phys, flags, ok := Translate(virt + 0x123)
+	if !ok || phys != 0x5123 || flags != FlagWrite {
+		t.Errorf("Expected 0x5123 writable, got %#x flags %#x (ok=%v)", phys, flags, ok)
+	}
+	if _, _, ok := Translate(virt + PageSize); ok {
+		t.Errorf("Expected the next page to stay unmapped")
+	}
+
+	if !Unmap(virt) {
+		t.Fatalf("Expected Unmap to succeed")
+	}
+	if _, _, ok := Translate(virt); ok {
+		t.Errorf("Expected page to be unmapped")
+	}
+	if Unmap(virt) {
+		t.Errorf("Expected second Unmap to fail")
+	}
+}
+
+func TestUnmapSplitsHugePage(t *testing.T) {
+	mockInit(t)
+
+	calls := 0
+	SetShootdownHook(func() { calls++ })
+	defer SetShootdownHook(nil)
+
+	virt := uintptr(mem.DirectMapBase + 0x201000)
+	if !Unmap(virt) {
+		t.Fatalf("Expected Unmap of a direct-map page to succeed")
+	}
+	if _, _, ok := Translate(virt); ok {
+		t.Errorf("Expected %#x to be unmapped", virt)
+	}
+	for _, addr := range []uintptr{0x200000, 0x202000, 0x3FF000} {
+		if phys, _, ok := Translate(mem.DirectMapBase + addr); !ok || phys != addr {
+			t.Errorf("Expected neighbour %#x to stay mapped, got %#x (ok=%v)", addr, phys, ok)
+		}
+	}
+	// the shootdown only runs once the tables are live in CR3
+	if calls != 0 {
+		t.Errorf("Expected no shootdown before Init, got %d", calls)
+	}
+
+	if !Map(virt, 0x9000, FlagWrite|FlagNoCache) {
+		t.Errorf("Expected the hole to be mappable again")
+	}
+	if phys, flags, _ := Translate(virt); phys != 0x9000 || flags != FlagWrite|FlagNoCache {
+		t.Errorf("Expected 0x9000 uncached, got %#x flags %#x", phys, flags)
+	}
+}
+
+func TestProtect(t *testing.T) {
+	mockInit(t)
+
+	virt := uintptr(mem.DirectMapBase + 0x400000)
+	if !Protect(virt, 0) {
+		t.Fatalf("Expected Protect to succeed")
+	}
+	if phys, flags, ok := Translate(virt); !ok || phys != 0x400000 || flags != 0 {
+		t.Errorf("Expected read-only page, got %#x flags %#x (ok=%v)", phys, flags, ok)
+	}
+	if _, flags, _ := Translate(virt + PageSize); flags != FlagWrite {
+		t.Errorf("Expected neighbour to stay writable, got flags %#x", flags)
+	}
+	if Protect(0x100000000, FlagWrite) {
+		t.Errorf("Expected Protect of an unmapped page to fail")
+	}
+}
+
+func TestNextRegion(t *testing.T) {
+	mockInit(t)
+
+	Protect(mem.DirectMapBase+0x1000, 0)
+	Map(0x100000000, 0x10000, FlagWrite)
+	Map(0x100001000, 0x11000, FlagWrite)
+	Map(0x100003000, 0x13000, FlagWrite)
+
+	want := []struct {
+		start, end, phys uintptr
+		flags            uint64
+	}{
+		{0x100000000, 0x100002000, 0x10000, FlagWrite},
+		{0x100003000, 0x100004000, 0x13000, FlagWrite},
+		{mem.DirectMapBase, mem.DirectMapBase + 0x1000, 0, FlagWrite},
+		{mem.DirectMapBase + 0x1000, mem.DirectMapBase + 0x2000, 0x1000, 0},
+		{mem.DirectMapBase + 0x2000, mem.DirectMapBase + mem.DirectMapSize, 0x2000, FlagWrite},
+	}
+	from := uintptr(0)
+	for i, w := range want {
+		start, end, phys, flags, ok := NextRegion(from)
+		if !ok {
+			t.Fatalf("Expected region %d, got none", i)
+		}
+		if start != w.start || end != w.end || phys != w.phys || flags != w.flags {
+			t.Errorf("Expected region %d to be %#x-%#x -> %#x flags %#x, got %#x-%#x -> %#x flags %#x",
+				i, w.start, w.end, w.phys, w.flags, start, end, phys, flags)
+		}
+		from = end
+	}
+	if _, _, _, _, ok := NextRegion(from); ok {
+		t.Errorf("Expected no region after %#x", from)
+	}
+}